@@ -0,0 +1,113 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ACL restricts the clients allowed to query a listener, queries of other
+// clients are answered with REFUSED.
+type ACL struct {
+	// Allow is the addresses and CIDRs of the allowed clients.
+	Allow []string `json:"allow,omitempty"`
+	// Deny is the addresses and CIDRs of the denied clients, it takes
+	// precedence over Allow.
+	Deny []string `json:"deny,omitempty"`
+	// DefaultDeny refuses the clients which are in neither list, they are
+	// allowed by default.
+	DefaultDeny bool `json:"default_deny,omitempty"`
+	// Log logs the refused queries.
+	Log bool `json:"log,omitempty"`
+}
+
+// Upstream refuses the queries of denied clients and asks up for the
+// others, it is up itself for a nil ACL.
+func (a *ACL) Upstream(up Upstream, lg *zap.Logger) (Upstream, error) {
+	u, err := a.upstream(up, lg)
+	if err != nil || u == nil {
+		return up, err
+	}
+	return u, nil
+}
+
+// upstream is Upstream which returns nil for a nil ACL.
+func (a *ACL) upstream(up Upstream, lg *zap.Logger) (*aclUpstream, error) {
+	if a == nil {
+		return nil, nil
+	}
+	allow, err := parsePrefixes(a.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("acl: %w", err)
+	}
+	deny, err := parsePrefixes(a.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("acl: %w", err)
+	}
+	return &aclUpstream{
+		allow:       allow,
+		deny:        deny,
+		defaultDeny: a.DefaultDeny,
+		log:         a.Log,
+		up:          up,
+		lg:          lg,
+	}, nil
+}
+
+// aclUpstream is an Upstream for the allowed clients of an ACL.
+type aclUpstream struct {
+	allow       []netip.Prefix
+	deny        []netip.Prefix
+	defaultDeny bool
+	log         bool
+	up          Upstream
+	lg          *zap.Logger
+}
+
+// Exchange is ...
+func (u *aclUpstream) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return u.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c, unknown clients are
+// neither allowed nor denied.
+func (u *aclUpstream) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	if u.allowed(c) {
+		return ExchangeClient(u.up, c, in)
+	}
+	if u.log {
+		name, addr := "", net.Addr(nil)
+		if len(in.Question) > 0 {
+			name = in.Question[0].Name
+		}
+		if c != nil {
+			addr = c.Addr
+		}
+		u.lg.Info(fmt.Sprintf("acl: refused query %v from %v", name, addr))
+	}
+	return new(dns.Msg).SetRcode(in, dns.RcodeRefused), nil
+}
+
+// allowed tells whether c is allowed, every client is allowed by a nil
+// aclUpstream.
+func (u *aclUpstream) allowed(c *Client) bool {
+	if u == nil {
+		return true
+	}
+	if c == nil || c.Addr == nil {
+		return !u.defaultDeny
+	}
+	switch {
+	case containsAddr(u.deny, c.Addr):
+		return false
+	case containsAddr(u.allow, c.Addr):
+		return true
+	default:
+		return !u.defaultDeny
+	}
+}
+
+var _ ClientUpstream = (*aclUpstream)(nil)
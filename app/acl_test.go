@@ -0,0 +1,53 @@
+package app
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestACL(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		acl    ACL
+		client string
+		want   int
+	}{
+		{"allowed", ACL{Allow: []string{"192.0.2.0/24"}, DefaultDeny: true}, "192.0.2.1:53", dns.RcodeSuccess},
+		{"default deny", ACL{Allow: []string{"192.0.2.0/24"}, DefaultDeny: true}, "198.51.100.1:53", dns.RcodeRefused},
+		{"default allow", ACL{Allow: []string{"192.0.2.0/24"}}, "198.51.100.1:53", dns.RcodeSuccess},
+		{"denied", ACL{Deny: []string{"198.51.100.1"}}, "198.51.100.1:53", dns.RcodeRefused},
+		{"deny before allow", ACL{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25"}}, "192.0.2.200:53", dns.RcodeRefused},
+		{"ipv6", ACL{Allow: []string{"2001:db8::/32"}, DefaultDeny: true, Log: true}, "[2001:db8::1]:53", dns.RcodeSuccess},
+		{"mapped ipv4", ACL{Allow: []string{"192.0.2.0/24"}, DefaultDeny: true}, "[::ffff:192.0.2.1]:53", dns.RcodeSuccess},
+		{"unknown client", ACL{Allow: []string{"192.0.2.0/24"}, DefaultDeny: true, Log: true}, "", dns.RcodeRefused},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up, err := tt.acl.Upstream(echoUpstream, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := (*Client)(nil)
+			if tt.client != "" {
+				c = &Client{Addr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tt.client)), Transport: "udp"}
+			}
+			out, err := ExchangeClient(up, c, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Rcode != tt.want {
+				t.Errorf("rcode = %v, want %v", dns.RcodeToString[out.Rcode], dns.RcodeToString[tt.want])
+			}
+		})
+	}
+
+	if _, err := (&ACL{Deny: []string{"192.0.2.0/33"}}).Upstream(echoUpstream, zap.NewNop()); err == nil {
+		t.Errorf("invalid prefix is accepted")
+	}
+	if up, err := (*ACL)(nil).Upstream(echoUpstream, zap.NewNop()); err != nil || up == nil {
+		t.Errorf("nil ACL: %v, %v", up, err)
+	}
+}
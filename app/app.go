@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 
 	"github.com/miekg/dns"
 	"go.uber.org/multierr"
@@ -23,6 +27,11 @@ const (
 	DefaultTLSPort = 853
 	// DefaultQuicPort is ...
 	DefaultQuicPort = 853
+	// DefaultDNSCryptPort is ...
+	DefaultDNSCryptPort = 5443
+	// DefaultGracePeriod is how long to wait for queries in flight when
+	// stopping the servers if no grace period is configured.
+	DefaultGracePeriod = 30 * time.Second
 )
 
 func init() {
@@ -46,8 +55,23 @@ type App struct {
 	ListenTLS int `json:"tls,omitempty"`
 	// ListenQuic is ...
 	ListenQuic int `json:"quic,omitempty"`
+	// ListenDNSCrypt is the UDP and TCP port of the "dnscrypt" server.
+	ListenDNSCrypt int `json:"dnscrypt,omitempty"`
 	// Servers is ...
 	Servers []string `json:"servers,omitempty"`
+	// ServerOptions is ...
+	ServerOptions map[string]ServerOptions `json:"server_options,omitempty"`
+	// DDR is ...
+	DDR *DDR `json:"ddr,omitempty"`
+	// DNSCrypt is the provider of the "dnscrypt" server.
+	DNSCrypt *DNSCrypt `json:"dnscrypt_provider,omitempty"`
+	// Cookies enables DNS Cookies on the "udp" server.
+	Cookies *Cookies `json:"cookies,omitempty"`
+	// GracePeriod is how long to wait for queries in flight when stopping
+	// the servers, connections are closed by force after that. It is the
+	// grace_period of the http app when unset, or DefaultGracePeriod when
+	// neither is set, and eternal when negative.
+	GracePeriod caddy.Duration `json:"grace_period,omitempty"`
 
 	lg       *zap.Logger
 	ctx      caddy.Context
@@ -77,10 +101,29 @@ func (app *App) Provision(ctx caddy.Context) error {
 	if app.ListenQuic == 0 {
 		app.ListenQuic = DefaultQuicPort
 	}
+	if app.ListenDNSCrypt == 0 {
+		app.ListenDNSCrypt = DefaultDNSCryptPort
+	}
 
 	app.lg = ctx.Logger(app)
 	app.ctx = ctx
 
+	if app.DDR != nil {
+		if err := app.DDR.Provision(app); err != nil {
+			return err
+		}
+	}
+	if app.DNSCrypt != nil {
+		if err := app.DNSCrypt.Provision(app); err != nil {
+			return err
+		}
+	}
+	if app.Cookies != nil {
+		if err := app.Cookies.Provision(app); err != nil {
+			return err
+		}
+	}
+
 	for _, v := range app.Handlers {
 		hd := Handler{}
 
@@ -110,7 +153,7 @@ func (app *App) Provision(ctx caddy.Context) error {
 func (app *App) Start() error {
 	for _, v := range app.Servers {
 		switch v {
-		case "tcp", "udp", "tls", "quic":
+		case "tcp", "udp", "tls", "quic", "dnscrypt":
 			srv, err := NewServer(app, app.ctx, v)
 			if err != nil {
 				return err
@@ -129,21 +172,59 @@ func (app *App) Start() error {
 
 // Stop is ...
 func (app *App) Stop() error {
-	errs := []error{}
-	for _, srv := range app.servers {
-		if err := srv.Close(); err != nil {
-			errs = append(errs, err)
-		}
+	ctx := context.Background()
+	if grace := app.gracePeriod(); grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+		app.lg.Info("servers shutting down; grace period initiated", zap.Duration("duration", grace))
 	}
-	if len(errs) != 0 {
-		return multierr.Combine(errs...)
+
+	errs := make([]error, len(app.servers))
+	wg := sync.WaitGroup{}
+	for i, srv := range app.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}()
 	}
-	return nil
+	wg.Wait()
+	app.servers = nil
+
+	return multierr.Combine(errs...)
+}
+
+// gracePeriod returns GracePeriod, the grace_period of the http app or
+// DefaultGracePeriod, zero means waiting forever.
+func (app *App) gracePeriod() time.Duration {
+	switch {
+	case app.GracePeriod < 0:
+		return 0
+	case app.GracePeriod > 0:
+		return time.Duration(app.GracePeriod)
+	}
+	if mod, err := app.ctx.AppIfConfigured("http"); err == nil {
+		if h, ok := mod.(*caddyhttp.App); ok && h.GracePeriod > 0 {
+			return time.Duration(h.GracePeriod)
+		}
+	}
+	return DefaultGracePeriod
 }
 
 // Cleanup is ...
 func (app *App) Cleanup() error {
 	errs := []error{}
+	if app.DNSCrypt != nil {
+		if err := app.DNSCrypt.Cleanup(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if app.Cookies != nil {
+		if err := app.Cookies.Cleanup(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	for _, v := range app.handlers {
 		if err := v.Cleanup(); err != nil {
 			errs = append(errs, err)
@@ -162,9 +243,19 @@ func (app *App) Logger() *zap.Logger {
 
 // Exchange is ...
 func (app *App) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return app.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c.
+func (app *App) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	if app.DDR != nil {
+		if out, ok := app.DDR.Exchange(in); ok {
+			return out, nil
+		}
+	}
 	for _, v := range app.handlers {
-		if v.Match(in) {
-			return v.Exchange(in)
+		if v.MatchClient(c, in) {
+			return ExchangeClient(v.Upstream, c, in)
 		}
 	}
 	return nil, errors.New("no valid handler")
@@ -180,8 +271,13 @@ type Handler struct {
 
 // Match is ...
 func (h *Handler) Match(msg *dns.Msg) bool {
+	return h.MatchClient(nil, msg)
+}
+
+// MatchClient is Match for a query from c.
+func (h *Handler) MatchClient(c *Client, msg *dns.Msg) bool {
 	for _, v := range h.Matchers {
-		if v.Match(msg) {
+		if MatchClient(v, c, msg) {
 			return true
 		}
 	}
@@ -190,21 +286,11 @@ func (h *Handler) Match(msg *dns.Msg) bool {
 
 // Cleanup is ...
 func (h *Handler) Cleanup() error {
-	errs := []error{}
-	for _, vv := range h.Matchers {
-		if cu, ok := vv.(caddy.CleanerUpper); ok {
-			if err := cu.Cleanup(); err != nil {
-				errs = append(errs, err)
-			}
-		}
-	}
-	if len(errs) != 0 {
-		return multierr.Combine(errs...)
-	}
-	return nil
+	return cleanupMatchers(h.Matchers...)
 }
 
 var (
+	_ ClientUpstream     = (*App)(nil)
 	_ caddy.App          = (*App)(nil)
 	_ caddy.CleanerUpper = (*App)(nil)
 	_ caddy.Provisioner  = (*App)(nil)
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Client is the client sending a query, as seen by the server.
+type Client struct {
+	// Addr is the address of the client, taken from the PROXY protocol
+	// header when the query comes through a load balancer.
+	Addr net.Addr
+	// Transport is the server type the query arrived on, "udp", "tcp",
+	// "tls", "quic" or "dnscrypt", or "https" for the DoH handler.
+	Transport string
+	// Listener is the name of the listener the query arrived on, the name
+	// of the server options or of the http server for the DoH handler.
+	Listener string
+	// UDP is set when the response is sent in a datagram, which clients
+	// retry over TCP when it is truncated.
+	UDP bool
+	// Cookie is set when the query carries a valid server cookie, so that
+	// the client address is not spoofed.
+	Cookie bool
+}
+
+// ClientUpstream is an Upstream which also looks at the client of a query.
+type ClientUpstream interface {
+	Upstream
+	// ExchangeClient is Exchange for a query from c, c is nil when the
+	// client is not known.
+	ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error)
+}
+
+// ErrDropped is returned for queries which are not answered at all.
+var ErrDropped = errors.New("query dropped")
+
+// ExchangeClient asks up for the answer of a query from c.
+func ExchangeClient(up Upstream, c *Client, in *dns.Msg) (*dns.Msg, error) {
+	if cu, ok := up.(ClientUpstream); ok {
+		return cu.ExchangeClient(c, in)
+	}
+	return up.Exchange(in)
+}
+
+// exchangeCopy is ExchangeClient for upstreams which ask a query again or
+// change the response. The query is copied as the next upstream may change
+// it, and so is the response as it may be shared with a cache.
+func exchangeCopy(up Upstream, c *Client, in *dns.Msg) (*dns.Msg, error) {
+	out, err := ExchangeClient(up, c, in.Copy())
+	if err != nil || out == nil {
+		return out, err
+	}
+	return out.Copy(), nil
+}
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// DefaultCookieSecretTTL is how long a server secret of Cookies is used.
+const DefaultCookieSecretTTL = 24 * time.Hour
+
+const (
+	// clientCookieSize is the size of a client cookie.
+	clientCookieSize = 8
+	// serverCookieSize is the size of the server cookies of RFC 9018.
+	serverCookieSize = 16
+	// cookieVersion is the version of the server cookies of RFC 9018.
+	cookieVersion = 1
+	// cookieLifetime is how long a server cookie is valid.
+	cookieLifetime = time.Hour
+	// cookieClockSkew is how far in the future a server cookie may be
+	// dated, for servers sharing the secret with unsynchronized clocks.
+	cookieClockSkew = 5 * time.Minute
+)
+
+// Cookies is the server side of DNS Cookies, RFC 7873, on the "udp" server.
+// Server cookies follow RFC 9018 and the secret is kept in Caddy storage, so
+// that all instances sharing the storage accept the cookies of each other.
+type Cookies struct {
+	// Require answers queries with a client cookie but without a valid
+	// server cookie with BADCOOKIE and a fresh cookie, instead of answering
+	// them. Queries without any cookie are answered as usual.
+	Require bool `json:"require,omitempty"`
+	// SecretTTL is how long a server secret is used before a new one is
+	// generated, cookies of the previous secret are still accepted.
+	SecretTTL caddy.Duration `json:"secret_ttl,omitempty"`
+
+	storage certmagic.Storage
+	lg      *zap.Logger
+	cancel  context.CancelFunc
+
+	mu      sync.RWMutex
+	secrets [][16]byte
+}
+
+type cookieStored struct {
+	Secrets []cookieStoredSecret `json:"secrets"`
+}
+
+type cookieStoredSecret struct {
+	Secret    []byte `json:"secret"`
+	NotBefore int64  `json:"not_before"`
+}
+
+// Provision is ...
+func (c *Cookies) Provision(app *App) error {
+	c.storage = app.ctx.Storage()
+	c.lg = app.Logger().Named("cookies")
+	return c.start()
+}
+
+func (c *Cookies) start() error {
+	if c.SecretTTL <= 0 {
+		c.SecretTTL = caddy.Duration(DefaultCookieSecretTTL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.rotate(ctx); err != nil {
+		cancel()
+		return err
+	}
+	c.cancel = cancel
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.SecretTTL) / 8)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.rotate(ctx); err != nil && ctx.Err() == nil {
+					c.lg.Error(fmt.Sprintf("cookies error: rotate secret error: %v", err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Cleanup is ...
+func (c *Cookies) Cleanup() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return nil
+}
+
+const cookieStorageKey = "dnsproxy/cookies/secrets.json"
+
+// rotate loads the secrets from storage, generating a new one when the
+// newest is older than SecretTTL. The previous secret is kept.
+func (c *Cookies) rotate(ctx context.Context) error {
+	if err := c.storage.Lock(ctx, cookieStorageKey); err != nil {
+		return err
+	}
+	defer c.storage.Unlock(ctx, cookieStorageKey)
+
+	stored := cookieStored{}
+	bb, err := c.storage.Load(ctx, cookieStorageKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bb, &stored); err != nil {
+			return err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return err
+	}
+
+	now := time.Now()
+	if n := len(stored.Secrets); n == 0 || len(stored.Secrets[n-1].Secret) != 16 ||
+		now.After(time.Unix(stored.Secrets[n-1].NotBefore, 0).Add(time.Duration(c.SecretTTL))) {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		stored.Secrets = append(stored.Secrets, cookieStoredSecret{Secret: secret, NotBefore: now.Unix()})
+		if n := len(stored.Secrets); n > 2 {
+			stored.Secrets = stored.Secrets[n-2:]
+		}
+		bb, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := c.storage.Store(ctx, cookieStorageKey, bb); err != nil {
+			return err
+		}
+		c.lg.Info("generate cookie secret")
+	}
+
+	// the newest secret comes first
+	secrets := make([][16]byte, 0, len(stored.Secrets))
+	for i := len(stored.Secrets) - 1; i >= 0; i-- {
+		if len(stored.Secrets[i].Secret) == 16 {
+			secrets = append(secrets, [16]byte(stored.Secrets[i].Secret))
+		}
+	}
+
+	c.mu.Lock()
+	c.secrets = secrets
+	c.mu.Unlock()
+	return nil
+}
+
+// serverCookie returns the server cookie of RFC 9018 for a client.
+func serverCookie(secret [16]byte, client []byte, ip netip.Addr, now time.Time) []byte {
+	b := make([]byte, 0, clientCookieSize+8+16)
+	b = append(b, client...)
+	b = append(b, cookieVersion, 0, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(now.Unix()))
+	b = append(b, ip.AsSlice()...)
+	h := siphash24(secret, b)
+	return binary.LittleEndian.AppendUint64(b[clientCookieSize:clientCookieSize+8], h)
+}
+
+// cookieStatus is the kind of cookie a query carries.
+type cookieStatus uint8
+
+const (
+	cookieNone cookieStatus = iota
+	cookieClient
+	cookieInvalid
+	cookieValid
+)
+
+// check finds the cookie of a query, which is removed so that it is not
+// sent to the upstream. The cookie is malformed when an error is returned.
+func (c *Cookies) check(in *dns.Msg, ip netip.Addr, now time.Time) ([]byte, cookieStatus, error) {
+	opt := in.IsEdns0()
+	if opt == nil {
+		return nil, cookieNone, nil
+	}
+	var cookie *dns.EDNS0_COOKIE
+	options := opt.Option[:0]
+	for _, v := range opt.Option {
+		if o, ok := v.(*dns.EDNS0_COOKIE); ok {
+			cookie = o
+			continue
+		}
+		options = append(options, v)
+	}
+	opt.Option = options
+	if cookie == nil {
+		return nil, cookieNone, nil
+	}
+
+	b, err := hex.DecodeString(cookie.Cookie)
+	if err != nil {
+		return nil, cookieNone, err
+	}
+	switch n := len(b); {
+	case n == clientCookieSize:
+		return b, cookieClient, nil
+	case n < clientCookieSize+8 || n > clientCookieSize+32:
+		return nil, cookieNone, fmt.Errorf("invalid cookie size %d", n)
+	case n != clientCookieSize+serverCookieSize || b[clientCookieSize] != cookieVersion:
+		return b[:clientCookieSize], cookieInvalid, nil
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint32(b[clientCookieSize+4:])), 0)
+	if ts.Before(now.Add(-cookieLifetime)) || ts.After(now.Add(cookieClockSkew)) {
+		return b[:clientCookieSize], cookieInvalid, nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, secret := range c.secrets {
+		want := serverCookie(secret, b[:clientCookieSize], ip, ts)
+		if subtle.ConstantTimeCompare(want, b[clientCookieSize:]) == 1 {
+			return b[:clientCookieSize], cookieValid, nil
+		}
+	}
+	return b[:clientCookieSize], cookieInvalid, nil
+}
+
+// reply returns a response with a fresh server cookie. The response of the
+// upstream may be shared, so it is copied rather than modified.
+func (c *Cookies) reply(out *dns.Msg, client []byte, ip netip.Addr, now time.Time) *dns.Msg {
+	c.mu.RLock()
+	secret := c.secrets[0]
+	c.mu.RUnlock()
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	if v := out.IsEdns0(); v != nil {
+		opt.Hdr = v.Hdr
+		for _, o := range v.Option {
+			// the cookie of the upstream server is of no use to the client
+			if _, ok := o.(*dns.EDNS0_COOKIE); !ok {
+				opt.Option = append(opt.Option, o)
+			}
+		}
+	}
+	b := append(append([]byte{}, client...), serverCookie(secret, client, ip, now)...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(b)})
+
+	msg := *out
+	msg.Extra = make([]dns.RR, 0, len(out.Extra)+1)
+	for _, rr := range out.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			msg.Extra = append(msg.Extra, rr)
+		}
+	}
+	msg.Extra = append(msg.Extra, opt)
+	return &msg
+}
+
+// siphash24 is SipHash-2-4 with a 64-bit output.
+func siphash24(key [16]byte, b []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	last := [8]byte{7: byte(n)}
+	copy(last[:], b)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
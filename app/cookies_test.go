@@ -0,0 +1,286 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func newTestCookies(t *testing.T, storage certmagic.Storage, require bool) *Cookies {
+	t.Helper()
+
+	c := &Cookies{Require: require, storage: storage, lg: zap.NewNop()}
+	if err := c.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Cleanup() })
+	return c
+}
+
+// cookieQuery is a query with the hex-encoded cookie.
+func cookieQuery(cookie string) *dns.Msg {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	if cookie != "" {
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return msg
+}
+
+// responseCookie returns the hex-encoded cookie of a response.
+func responseCookie(msg *dns.Msg) string {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, v := range opt.Option {
+			if o, ok := v.(*dns.EDNS0_COOKIE); ok {
+				return o.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+func TestSipHash24(t *testing.T) {
+	key := [16]byte{}
+	for i := range key {
+		key[i] = byte(i)
+	}
+	b := make([]byte, 15)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	for _, tt := range []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{15, 0xa129ca6149be45e5},
+	} {
+		if got := siphash24(key, b[:tt.n]); got != tt.want {
+			t.Errorf("siphash24(%d bytes) = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	// RFC 9018 Appendix A.1
+	secret, _ := hex.DecodeString("e5e973e5a6b2a43f48e7dc849e37bfcf")
+	client, _ := hex.DecodeString("2464c4abcf10c957")
+	got := serverCookie([16]byte(secret), client, netip.MustParseAddr("198.51.100.100"), time.Unix(1559731985, 0))
+	if s := hex.EncodeToString(got); s != "010000005cf79f111f8130c3eee29480" {
+		t.Errorf("server cookie = %v", s)
+	}
+}
+
+func TestCookies_Check(t *testing.T) {
+	c := newTestCookies(t, &certmagic.FileStorage{Path: t.TempDir()}, false)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+	client := "0102030405060708"
+	valid := client + hex.EncodeToString(serverCookie(c.secrets[0], []byte{1, 2, 3, 4, 5, 6, 7, 8}, ip, now.Add(-time.Minute)))
+	expired := client + hex.EncodeToString(serverCookie(c.secrets[0], []byte{1, 2, 3, 4, 5, 6, 7, 8}, ip, now.Add(-2*time.Hour)))
+
+	for _, tt := range []struct {
+		name   string
+		msg    *dns.Msg
+		ip     string
+		status cookieStatus
+		err    bool
+	}{
+		{"no edns", new(dns.Msg).SetQuestion("example.com.", dns.TypeA), "192.0.2.1", cookieNone, false},
+		{"no cookie", cookieQuery(""), "192.0.2.1", cookieNone, false},
+		{"client cookie", cookieQuery(client), "192.0.2.1", cookieClient, false},
+		{"valid", cookieQuery(valid), "192.0.2.1", cookieValid, false},
+		{"other client", cookieQuery(valid), "192.0.2.2", cookieInvalid, false},
+		{"expired", cookieQuery(expired), "192.0.2.1", cookieInvalid, false},
+		{"other server", cookieQuery(client + "0123456789abcdef"), "192.0.2.1", cookieInvalid, false},
+		{"too short", cookieQuery("01020304"), "192.0.2.1", cookieNone, true},
+		{"too long", cookieQuery(client + hex.EncodeToString(make([]byte, 33))), "192.0.2.1", cookieNone, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, status, err := c.check(tt.msg, netip.MustParseAddr(tt.ip), now)
+			if (err != nil) != tt.err || status != tt.status {
+				t.Errorf("status = %v, error = %v, want %v", status, err, tt.status)
+			}
+			if responseCookie(tt.msg) != "" {
+				t.Errorf("cookie is not removed from the query")
+			}
+		})
+	}
+}
+
+func TestCookies_Rotate(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	c := newTestCookies(t, storage, false)
+	ip := netip.MustParseAddr("192.0.2.1")
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	now := time.Now()
+	cookie := hex.EncodeToString(client) + hex.EncodeToString(serverCookie(c.secrets[0], client, ip, now))
+
+	// instances sharing the storage accept the cookies of each other
+	c2 := newTestCookies(t, storage, false)
+	if _, status, _ := c2.check(cookieQuery(cookie), ip, now); status != cookieValid {
+		t.Fatalf("status = %v, want valid", status)
+	}
+
+	// the previous secret is accepted after a rotation
+	ctx := context.Background()
+	bb, err := storage.Load(ctx, cookieStorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := cookieStored{}
+	if err := json.Unmarshal(bb, &stored); err != nil {
+		t.Fatal(err)
+	}
+	stored.Secrets[0].NotBefore -= int64(2 * DefaultCookieSecretTTL / time.Second)
+	bb, _ = json.Marshal(stored)
+	if err := storage.Store(ctx, cookieStorageKey, bb); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.secrets) != 2 {
+		t.Fatalf("secrets = %d, want 2", len(c.secrets))
+	}
+	if _, status, _ := c.check(cookieQuery(cookie), ip, now); status != cookieValid {
+		t.Errorf("status after rotation = %v, want valid", status)
+	}
+}
+
+func TestPacket_Cookies(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := newTestCookies(t, &certmagic.FileStorage{Path: t.TempDir()}, true)
+	limit, err := (&RateLimit{Rate: 1, Action: RateLimitRefuse, ExemptCookies: true}).upstream(caddy.Context{}, echoUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Packet{Conn: conn, cookies: cookies, tr: newTracker(), up: limit, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	exchange := func(cookie string) *dns.Msg {
+		t.Helper()
+		bb, err := cookieQuery(cookie).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(bb); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// the first query only has a client cookie
+	msg := exchange("0102030405060708")
+	cookie := responseCookie(msg)
+	if msg.Rcode != dns.RcodeBadCookie || len(cookie) != 2*(clientCookieSize+serverCookieSize) || cookie[:16] != "0102030405060708" {
+		t.Fatalf("unexpected response %v", msg)
+	}
+
+	// clients with a valid cookie are answered and not rate limited
+	for i := 0; i < 3; i++ {
+		msg = exchange(cookie)
+		if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || responseCookie(msg) == "" {
+			t.Fatalf("query %d: unexpected response %v", i, msg)
+		}
+	}
+
+	if msg := exchange("01020304"); msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("malformed cookie: unexpected response %v", msg)
+	}
+}
+
+func TestPacket_CookiesACLRRL(t *testing.T) {
+	cookies := newTestCookies(t, &certmagic.FileStorage{Path: t.TempDir()}, true)
+	start := func(acl *ACL, l *rrl) net.Conn {
+		t.Helper()
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := acl.upstream(echoUpstream, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Packet{Conn: conn, acl: u, rrl: l, cookies: cookies, tr: newTracker(), up: u, lg: zap.NewNop()}
+		if u == nil {
+			s.up = echoUpstream
+		}
+		go s.Run()
+		t.Cleanup(func() { s.Close() })
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	exchange := func(client net.Conn, cookie string) (*dns.Msg, error) {
+		t.Helper()
+		bb, err := cookieQuery(cookie).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(bb); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg := &dns.Msg{}
+		return msg, msg.Unpack(buf[:n])
+	}
+
+	// denied clients are refused instead of being sent a cookie
+	client := start(&ACL{Deny: []string{"127.0.0.0/8"}}, nil)
+	for _, cookie := range []string{"0102030405060708", "01020304"} {
+		if msg, err := exchange(client, cookie); err != nil || msg.Rcode != dns.RcodeRefused {
+			t.Errorf("denied client with cookie %v: unexpected response %v, error: %v", cookie, msg, err)
+		}
+	}
+
+	// cookie errors are rate limited
+	for _, cookie := range []string{"0102030405060708", "01020304"} {
+		client := start(nil, newTestRRL(t, ResponseRateLimit{ResponsesPerSecond: 1, ErrorsPerSecond: 1, Slip: new(int)}))
+		if msg, err := exchange(client, cookie); err != nil || (msg.Rcode != dns.RcodeBadCookie && msg.Rcode != dns.RcodeFormatError) {
+			t.Fatalf("cookie %v: unexpected response %v, error: %v", cookie, msg, err)
+		}
+		if msg, err := exchange(client, cookie); err == nil {
+			t.Errorf("cookie %v: rate limited response %v is sent", cookie, msg)
+		}
+	}
+}
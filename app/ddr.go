@@ -0,0 +1,139 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DDRName is the special-use name queried by clients to discover the
+// encrypted endpoints of their resolver, RFC 9462.
+const DDRName = "_dns.resolver.arpa."
+
+// DDR is ...
+type DDR struct {
+	// Target is the authentication domain name of the encrypted resolver.
+	Target string `json:"target"`
+	// DoHPath is the URI template of the DoH endpoint, such as
+	// "/dns-query{?dns}". DoH is not advertised if it is empty.
+	DoHPath string `json:"doh_path,omitempty"`
+	// DoHPort is ...
+	DoHPort int `json:"doh_port,omitempty"`
+	// DoHALPN is ...
+	DoHALPN []string `json:"doh_alpn,omitempty"`
+	// IPHints is ...
+	IPHints []string `json:"ip_hints,omitempty"`
+	// TTL is ...
+	TTL uint32 `json:"ttl,omitempty"`
+
+	name    string
+	records []*dns.SVCB
+}
+
+// Provision is ...
+func (d *DDR) Provision(app *App) error {
+	if d.Target == "" {
+		return errors.New("ddr: no target")
+	}
+	if d.TTL == 0 {
+		d.TTL = 300
+	}
+	if len(d.DoHALPN) == 0 {
+		d.DoHALPN = []string{"h2", "h3"}
+	}
+	d.Target = dns.Fqdn(strings.ToLower(d.Target))
+	// clients knowing the resolver at a port other than 53 ask for the
+	// port prefixed name, RFC 9461
+	port := app.ListenUDP
+	if !slices.Contains(app.Servers, "udp") && slices.Contains(app.Servers, "tcp") {
+		port = app.ListenTCP
+	}
+	d.name = "_dns." + d.Target
+	if port != 0 && port != DefaultUDPPort {
+		d.name = "_" + strconv.Itoa(port) + "." + d.name
+	}
+
+	hints := []dns.SVCBKeyValue{}
+	v4, v6 := &dns.SVCBIPv4Hint{}, &dns.SVCBIPv6Hint{}
+	for _, v := range d.IPHints {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return errors.New("ddr: invalid ip hint " + v)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4.Hint = append(v4.Hint, ip4)
+		} else {
+			v6.Hint = append(v6.Hint, ip)
+		}
+	}
+	if len(v4.Hint) > 0 {
+		hints = append(hints, v4)
+	}
+	if len(v6.Hint) > 0 {
+		hints = append(hints, v6)
+	}
+
+	add := func(alpn []string, port, defaultPort int, params ...dns.SVCBKeyValue) {
+		value := []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: alpn}}
+		if port != 0 && port != defaultPort {
+			value = append(value, &dns.SVCBPort{Port: uint16(port)})
+		}
+		value = append(value, hints...)
+		value = append(value, params...)
+		d.records = append(d.records, &dns.SVCB{
+			Priority: uint16(len(d.records) + 1),
+			Target:   d.Target,
+			Value:    value,
+		})
+	}
+	if slices.Contains(app.Servers, "quic") {
+		add([]string{NextProtoDoQ}, app.ListenQuic, DefaultQuicPort)
+	}
+	if slices.Contains(app.Servers, "tls") {
+		add([]string{"dot"}, app.ListenTLS, DefaultTLSPort)
+	}
+	if d.DoHPath != "" {
+		add(d.DoHALPN, d.DoHPort, 443, &dns.SVCBDoHPath{Template: d.DoHPath})
+	}
+	if len(d.records) == 0 {
+		return errors.New("ddr: no encrypted server to advertise")
+	}
+	return nil
+}
+
+// Exchange answers queries for the designated resolver names. It returns
+// false if the query should be handled by the upstreams.
+func (d *DDR) Exchange(in *dns.Msg) (*dns.Msg, bool) {
+	if len(in.Question) != 1 {
+		return nil, false
+	}
+	q := in.Question[0]
+	name := strings.ToLower(q.Name)
+
+	switch {
+	case name == DDRName || name == d.name:
+		out := new(dns.Msg).SetReply(in)
+		if q.Qtype == dns.TypeSVCB {
+			for _, v := range d.records {
+				rr := *v
+				rr.Hdr = dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeSVCB,
+					Class:  dns.ClassINET,
+					Ttl:    d.TTL,
+				}
+				out.Answer = append(out.Answer, &rr)
+			}
+		}
+		return out, true
+	case dns.IsSubDomain("resolver.arpa.", name):
+		// resolver.arpa is answered locally and never forwarded
+		return new(dns.Msg).SetRcode(in, dns.RcodeNameError), true
+	default:
+		return nil, false
+	}
+}
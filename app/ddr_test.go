@@ -0,0 +1,100 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDDR_Exchange(t *testing.T) {
+	app := &App{
+		ListenTLS:  DefaultTLSPort,
+		ListenQuic: 8853,
+		Servers:    []string{"udp", "tls", "quic"},
+	}
+	d := &DDR{
+		Target:  "dns.example.net",
+		DoHPath: "/dns-query{?dns}",
+		IPHints: []string{"192.0.2.53", "2001:db8::53"},
+	}
+	if err := d.Provision(app); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		handled bool
+		rcode   int
+		answers int
+	}{
+		{"resolver.arpa", DDRName, dns.TypeSVCB, true, dns.RcodeSuccess, 3},
+		{"resolver.arpa case", "_DNS.Resolver.Arpa.", dns.TypeSVCB, true, dns.RcodeSuccess, 3},
+		{"designated name", "_dns.dns.example.net.", dns.TypeSVCB, true, dns.RcodeSuccess, 3},
+		{"resolver.arpa nodata", DDRName, dns.TypeA, true, dns.RcodeSuccess, 0},
+		{"resolver.arpa nxdomain", "foo.resolver.arpa.", dns.TypeSVCB, true, dns.RcodeNameError, 0},
+		{"other name", "example.com.", dns.TypeSVCB, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := new(dns.Msg).SetQuestion(tt.qname, tt.qtype)
+			out, ok := d.Exchange(in)
+			if ok != tt.handled {
+				t.Fatalf("handled = %v, want %v", ok, tt.handled)
+			}
+			if !ok {
+				return
+			}
+			if out.Rcode != tt.rcode || len(out.Answer) != tt.answers {
+				t.Errorf("rcode = %d, answers = %d, want %d and %d", out.Rcode, len(out.Answer), tt.rcode, tt.answers)
+			}
+		})
+	}
+
+	in := new(dns.Msg).SetQuestion(DDRName, dns.TypeSVCB)
+	out, _ := d.Exchange(in)
+	want := []string{
+		`_dns.resolver.arpa.	300	IN	SVCB	1 dns.example.net. alpn="doq" port="8853" ipv4hint="192.0.2.53" ipv6hint="2001:db8::53"`,
+		`_dns.resolver.arpa.	300	IN	SVCB	2 dns.example.net. alpn="dot" ipv4hint="192.0.2.53" ipv6hint="2001:db8::53"`,
+		`_dns.resolver.arpa.	300	IN	SVCB	3 dns.example.net. alpn="h2,h3" ipv4hint="192.0.2.53" ipv6hint="2001:db8::53" dohpath="/dns-query{?dns}"`,
+	}
+	for i, v := range out.Answer {
+		if got := v.String(); got != want[i] {
+			t.Errorf("answer %d = %s, want %s", i, got, want[i])
+		}
+	}
+	if _, err := out.Pack(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDDR_Name(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		udp     int
+		tcp     int
+		want    string
+	}{
+		{"default port", []string{"udp", "tcp", "tls"}, DefaultUDPPort, DefaultTCPPort, "_dns.dns.example.net."},
+		{"udp port", []string{"udp", "tcp", "tls"}, 5353, 5353, "_5353._dns.dns.example.net."},
+		{"tcp port", []string{"tcp", "tls"}, DefaultUDPPort, 5353, "_5353._dns.dns.example.net."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{ListenUDP: tt.udp, ListenTCP: tt.tcp, ListenTLS: DefaultTLSPort, Servers: tt.servers}
+			d := &DDR{Target: "dns.example.net"}
+			if err := d.Provision(app); err != nil {
+				t.Fatal(err)
+			}
+			if d.name != tt.want {
+				t.Errorf("name = %v, want %v", d.name, tt.want)
+			}
+			out, ok := d.Exchange(new(dns.Msg).SetQuestion(tt.want, dns.TypeSVCB))
+			if !ok || len(out.Answer) != 1 {
+				t.Errorf("query for %v is not answered", tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DefaultDNSCryptCertTTL is ...
+const DefaultDNSCryptCertTTL = 24 * time.Hour
+
+// dnscryptPrefix is the prefix of DNSCrypt v2 provider names.
+const dnscryptPrefix = "2.dnscrypt-cert."
+
+// DNSCrypt is the DNSCrypt v2 provider of the "dnscrypt" server. The
+// provider key and the short-term certificates are kept in Caddy storage,
+// so that all instances sharing the storage serve the same certificates.
+type DNSCrypt struct {
+	// ProviderName is the provider name, "2.dnscrypt-cert." is prepended
+	// when missing.
+	ProviderName string `json:"provider_name"`
+	// PrivateKey is the hex-encoded Ed25519 provider key, either the seed
+	// or the full private key. A key is generated and stored if it is empty.
+	PrivateKey string `json:"private_key,omitempty"`
+	// EsVersion is the encryption of the certificates, "xsalsa20poly1305"
+	// (default) or "xchacha20poly1305".
+	EsVersion string `json:"es_version,omitempty"`
+	// CertTTL is the validity of short-term certificates. A new certificate
+	// is issued when half of it has passed.
+	CertTTL caddy.Duration `json:"cert_ttl,omitempty"`
+
+	name      string
+	esVersion dnscrypt.CryptoConstruction
+	key       ed25519.PrivateKey
+	storage   certmagic.Storage
+	lg        *zap.Logger
+	cancel    context.CancelFunc
+
+	mu    sync.RWMutex
+	certs []*dnscrypt.Cert
+}
+
+type dnscryptStored struct {
+	PrivateKey []byte               `json:"private_key"`
+	Certs      []dnscryptStoredCert `json:"certs"`
+}
+
+type dnscryptStoredCert struct {
+	Serial    uint32                      `json:"serial"`
+	EsVersion dnscrypt.CryptoConstruction `json:"es_version"`
+	SecretKey []byte                      `json:"secret_key"`
+	NotBefore uint32                      `json:"not_before"`
+	NotAfter  uint32                      `json:"not_after"`
+}
+
+// Provision is ...
+func (d *DNSCrypt) Provision(app *App) error {
+	d.storage = app.ctx.Storage()
+	d.lg = app.Logger().Named("dnscrypt")
+	return d.start()
+}
+
+func (d *DNSCrypt) start() error {
+	if d.ProviderName == "" {
+		return errors.New("dnscrypt: no provider name")
+	}
+	d.name = dns.Fqdn(strings.ToLower(d.ProviderName))
+	if !strings.HasPrefix(d.name, dnscryptPrefix) {
+		d.name = dnscryptPrefix + d.name
+	}
+	switch strings.ToLower(d.EsVersion) {
+	case "", "xsalsa20poly1305":
+		d.esVersion = dnscrypt.XSalsa20Poly1305
+	case "xchacha20poly1305":
+		d.esVersion = dnscrypt.XChacha20Poly1305
+	default:
+		return errors.New("dnscrypt: invalid es_version " + d.EsVersion)
+	}
+	if d.CertTTL <= 0 {
+		d.CertTTL = caddy.Duration(DefaultDNSCryptCertTTL)
+	}
+	if d.PrivateKey != "" {
+		bb, err := dnscrypt.HexDecodeKey(d.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("dnscrypt: invalid private key: %w", err)
+		}
+		switch len(bb) {
+		case ed25519.SeedSize:
+			d.key = ed25519.NewKeyFromSeed(bb)
+		case ed25519.PrivateKeySize:
+			d.key = ed25519.PrivateKey(bb)
+		default:
+			return errors.New("dnscrypt: invalid private key size")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.rotate(ctx); err != nil {
+		cancel()
+		return err
+	}
+	d.cancel = cancel
+	d.lg.Info(fmt.Sprintf("dnscrypt provider %s public key %s", d.name, d.PublicKey()))
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(d.CertTTL) / 8)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := d.rotate(ctx); err != nil && ctx.Err() == nil {
+					d.lg.Error(fmt.Sprintf("dnscrypt error: rotate cert error: %v", err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Cleanup is ...
+func (d *DNSCrypt) Cleanup() error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return nil
+}
+
+// PublicKey returns the hex-encoded provider public key, which is needed by
+// clients to verify the certificates.
+func (d *DNSCrypt) PublicKey() string {
+	return dnscrypt.HexEncodeKey(d.key.Public().(ed25519.PublicKey))
+}
+
+func (d *DNSCrypt) storageKey() string {
+	return "dnsproxy/dnscrypt/" + strings.TrimSuffix(d.name, ".") + ".json"
+}
+
+// rotate loads the provider key and certificates from storage, dropping
+// expired certificates and issuing a new one when the newest is halfway
+// through its validity.
+func (d *DNSCrypt) rotate(ctx context.Context) error {
+	key := d.storageKey()
+	if err := d.storage.Lock(ctx, key); err != nil {
+		return err
+	}
+	defer d.storage.Unlock(ctx, key)
+
+	stored := dnscryptStored{}
+	bb, err := d.storage.Load(ctx, key)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bb, &stored); err != nil {
+			return err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return err
+	}
+
+	changed := false
+	switch {
+	case d.key != nil && !bytes.Equal(stored.PrivateKey, d.key.Seed()):
+		// certificates signed by another key are useless
+		stored = dnscryptStored{PrivateKey: d.key.Seed()}
+		changed = true
+	case len(stored.PrivateKey) == ed25519.SeedSize:
+		d.key = ed25519.NewKeyFromSeed(stored.PrivateKey)
+	default:
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		d.key = sk
+		stored = dnscryptStored{PrivateKey: sk.Seed()}
+		changed = true
+	}
+
+	now := time.Now()
+	certs := stored.Certs[:0]
+	for _, v := range stored.Certs {
+		if now.Before(time.Unix(int64(v.NotAfter), 0)) {
+			certs = append(certs, v)
+		} else {
+			changed = true
+		}
+	}
+	stored.Certs = certs
+
+	if n := len(certs); n == 0 || certs[n-1].EsVersion != d.esVersion ||
+		now.After(time.Unix(int64(certs[n-1].NotBefore), 0).Add(time.Duration(d.CertTTL)/2)) {
+		sk := make([]byte, 32)
+		if _, err := rand.Read(sk); err != nil {
+			return err
+		}
+		serial := uint32(now.Unix())
+		if n > 0 && serial <= certs[n-1].Serial {
+			serial = certs[n-1].Serial + 1
+		}
+		stored.Certs = append(stored.Certs, dnscryptStoredCert{
+			Serial:    serial,
+			EsVersion: d.esVersion,
+			SecretKey: sk,
+			NotBefore: uint32(now.Unix()),
+			NotAfter:  uint32(now.Add(time.Duration(d.CertTTL)).Unix()),
+		})
+		changed = true
+		d.lg.Info(fmt.Sprintf("issue dnscrypt cert %d", serial))
+	}
+
+	if changed {
+		bb, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := d.storage.Store(ctx, key, bb); err != nil {
+			return err
+		}
+	}
+
+	list := make([]*dnscrypt.Cert, 0, len(stored.Certs))
+	for _, v := range stored.Certs {
+		cert, err := d.newCert(v)
+		if err != nil {
+			return err
+		}
+		list = append(list, cert)
+	}
+
+	d.mu.Lock()
+	d.certs = list
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *DNSCrypt) newCert(v dnscryptStoredCert) (*dnscrypt.Cert, error) {
+	cert := &dnscrypt.Cert{
+		Serial:    v.Serial,
+		EsVersion: v.EsVersion,
+		NotBefore: v.NotBefore,
+		NotAfter:  v.NotAfter,
+	}
+	if len(v.SecretKey) != len(cert.ResolverSk) {
+		return nil, errors.New("dnscrypt: invalid stored secret key")
+	}
+	copy(cert.ResolverSk[:], v.SecretKey)
+	pk, err := curve25519.X25519(cert.ResolverSk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(cert.ResolverPk[:], pk)
+	// the client magic tells the certificates apart
+	copy(cert.ClientMagic[:], pk)
+	cert.Sign(d.key)
+	return cert, nil
+}
+
+// Certs returns the certificates which are currently valid.
+func (d *DNSCrypt) Certs() []*dnscrypt.Cert {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	certs := make([]*dnscrypt.Cert, 0, len(d.certs))
+	for _, v := range d.certs {
+		if v.VerifyDate() {
+			certs = append(certs, v)
+		}
+	}
+	return certs
+}
+
+// cert returns the certificate a query is encrypted with.
+func (d *DNSCrypt) cert(b []byte) *dnscrypt.Cert {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, v := range d.certs {
+		if bytes.HasPrefix(b, v.ClientMagic[:]) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Handshake answers the plain TXT query for the provider name with the
+// certificates. ok is false if the query is not a handshake.
+func (d *DNSCrypt) Handshake(in *dns.Msg) (out *dns.Msg, ok bool) {
+	if in.Response || len(in.Question) != 1 {
+		return nil, false
+	}
+	q := in.Question[0]
+	if q.Qtype != dns.TypeTXT || q.Qclass != dns.ClassINET || strings.ToLower(q.Name) != d.name {
+		return nil, false
+	}
+
+	out = new(dns.Msg).SetReply(in)
+	// required by old dnscrypt-proxy versions
+	out.Authoritative = true
+	out.RecursionAvailable = true
+	for _, v := range d.Certs() {
+		bb, err := v.Serialize()
+		if err != nil {
+			continue
+		}
+		out.Answer = append(out.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{escapeTXT(bb)},
+		})
+	}
+	return out, true
+}
+
+// escapeTXT escapes binary data in the presentation format used by
+// dns.TXT.
+func escapeTXT(bb []byte) string {
+	sb := strings.Builder{}
+	for _, b := range bb {
+		switch {
+		case b == '"' || b == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < ' ' || b > '~':
+			fmt.Fprintf(&sb, "\\%03d", b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// dnscryptSharedKey computes the key shared by the resolver and a client.
+func dnscryptSharedKey(es dnscrypt.CryptoConstruction, sk, pk *[32]byte) ([32]byte, error) {
+	switch es {
+	case dnscrypt.XChacha20Poly1305:
+		return xsecretbox.SharedKey(*sk, *pk)
+	case dnscrypt.XSalsa20Poly1305:
+		key := [32]byte{}
+		box.Precompute(&key, pk, sk)
+		return key, nil
+	default:
+		return [32]byte{}, dnscrypt.ErrEsVersion
+	}
+}
+
+// Decrypt decrypts a query, returning the state needed to encrypt the
+// response. ok is false if the query is not encrypted with any of the
+// certificates.
+func (d *DNSCrypt) Decrypt(b []byte) (query []byte, resp *DNSCryptResponse, ok bool, err error) {
+	cert := d.cert(b)
+	if cert == nil {
+		return nil, nil, false, nil
+	}
+	q := dnscrypt.EncryptedQuery{EsVersion: cert.EsVersion, ClientMagic: cert.ClientMagic}
+	query, err = q.Decrypt(b, cert.ResolverSk)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	key, err := dnscryptSharedKey(cert.EsVersion, &cert.ResolverSk, &q.ClientPk)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	return query, &DNSCryptResponse{es: cert.EsVersion, nonce: q.Nonce, key: key}, true, nil
+}
+
+// DNSCryptResponse is the state kept to encrypt the response to a query.
+type DNSCryptResponse struct {
+	es    dnscrypt.CryptoConstruction
+	nonce [24]byte
+	key   [32]byte
+}
+
+// Encrypt is ...
+func (r *DNSCryptResponse) Encrypt(packet []byte) ([]byte, error) {
+	resp := dnscrypt.EncryptedResponse{EsVersion: r.es, Nonce: r.nonce}
+	return resp.Encrypt(packet, r.key)
+}
+
+// dnscryptResponseSize is the size of an encrypted response: resolver
+// magic, nonce, tag and the padded message.
+func dnscryptResponseSize(n int) int {
+	padded := max(256, n+1+(64-(n+1)%64))
+	return 8 + 24 + xsecretbox.TagSize + padded
+}
+
+var _ caddy.CleanerUpper = (*DNSCrypt)(nil)
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// canonicalName returns a domain name in presentation format in the form
+// names and rules are compared in: lower case, without the trailing dot and
+// with escape sequences normalized, so that a dot within a label is never
+// taken for a label separator.
+func canonicalName(name string) string {
+	labels, err := splitLabels(name)
+	if err != nil {
+		// not a valid name, which is not expected from a parsed message
+		return strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	return joinLabels(labels)
+}
+
+// canonicalRule is canonicalName for a domain rule. Labels of a rule may be
+// the wildcards "*" or "**" and internationalized labels are converted to
+// punycode.
+func canonicalRule(rule string) (string, error) {
+	labels, err := splitLabels(rule)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", rule, err)
+	}
+	for i, v := range labels {
+		if utf8.Valid(v) && !isASCII(v) {
+			s, err := idna.Lookup.ToASCII(string(v))
+			if err != nil {
+				return "", fmt.Errorf("invalid domain %q: %w", rule, err)
+			}
+			labels[i] = []byte(s)
+		}
+	}
+	return joinLabels(labels), nil
+}
+
+// splitLabels splits a name in presentation format into the raw labels,
+// resolving the escape sequences \X and \DDD.
+func splitLabels(name string) ([][]byte, error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+
+	labels := [][]byte{}
+	label := []byte{}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '.':
+			if len(label) == 0 {
+				return nil, errors.New("empty label")
+			}
+			labels = append(labels, label)
+			label = []byte{}
+		case '\\':
+			if i+1 >= len(name) {
+				return nil, errors.New("incomplete escape")
+			}
+			if isDigit(name[i+1]) {
+				if i+3 >= len(name) || !isDigit(name[i+2]) || !isDigit(name[i+3]) {
+					return nil, errors.New("invalid escape")
+				}
+				n := int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+				if n > 255 {
+					return nil, errors.New("invalid escape")
+				}
+				label = append(label, byte(n))
+				i += 3
+				continue
+			}
+			label = append(label, name[i+1])
+			i++
+		default:
+			label = append(label, c)
+		}
+	}
+	// the name ends with a dot when the last label is empty
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// joinLabels joins raw labels in lower case, escaping the bytes which are
+// not printable and the dot and backslash as \DDD.
+func joinLabels(labels [][]byte) string {
+	sb := strings.Builder{}
+	for i, v := range labels {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		for _, c := range v {
+			switch {
+			case 'A' <= c && c <= 'Z':
+				sb.WriteByte(c + 'a' - 'A')
+			case c == '.' || c == '\\' || c <= ' ' || c >= 0x7f:
+				fmt.Fprintf(&sb, "\\%03d", c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
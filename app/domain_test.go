@@ -0,0 +1,51 @@
+package app
+
+import "testing"
+
+func TestCanonicalName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"example.com.", "example.com"},
+		{"WWW.Example.COM.", "www.example.com"},
+		{"wWw.eXaMpLe.CoM", "www.example.com"},
+		{".", ""},
+		{`a\.b.example.com.`, `a\046b.example.com`},
+		{`\065BC.example.com.`, "abc.example.com"},
+		{`a\\.example.com.`, `a\092.example.com`},
+		{`a\ b.example.com.`, `a\032b.example.com`},
+		{`\200.example.com.`, `\200.example.com`},
+		{`a\..`, `a\046`},
+	} {
+		if got := canonicalName(tt.name); got != tt.want {
+			t.Errorf("canonicalName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalRule(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		want string
+		err  bool
+	}{
+		{"Example.COM", "example.com", false},
+		{"**.Example.com.", "**.example.com", false},
+		{"*.example.*", "*.example.*", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"BÜCHER.example", "xn--bcher-kva.example", false},
+		{"*.münchen.de", "*.xn--mnchen-3ya.de", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", false},
+		{`a\.b.example.com`, `a\046b.example.com`, false},
+		{"a..example.com", "", true},
+		{`example.com\`, "", true},
+		{`\300.example.com`, "", true},
+		{`\12.example.com`, "", true},
+	} {
+		got, err := canonicalRule(tt.rule)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("canonicalRule(%q) = %q, %v, want %q", tt.rule, got, err, tt.want)
+		}
+	}
+}
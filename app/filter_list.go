@@ -0,0 +1,259 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// errUnsupportedRule is returned for the rules of filter lists which are
+// valid but do not apply to domain names alone, such as cosmetic rules and
+// rules for URLs.
+var errUnsupportedRule = errors.New("unsupported rule")
+
+// hostsLocalNames is the names of hosts files which are not blocked.
+var hostsLocalNames = map[string]bool{
+	"0.0.0.0":               true,
+	"broadcasthost":         true,
+	"ip6-allhosts":          true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-localhost":         true,
+	"ip6-localnet":          true,
+	"ip6-loopback":          true,
+	"ip6-mcastprefix":       true,
+	"local":                 true,
+	"localhost":             true,
+	"localhost.localdomain": true,
+}
+
+// filterRule is a rule of a filter list.
+type filterRule struct {
+	// text is the rule as written in the list.
+	text       string
+	allow      bool
+	important  bool
+	clients    []netip.Prefix
+	notClients []netip.Prefix
+	types      []uint16
+	notTypes   []uint16
+}
+
+// priority orders the rules which apply to a query, the one with the
+// highest priority decides whether the query is blocked.
+func (r *filterRule) priority() int {
+	p := 0
+	if r.allow {
+		p++
+	}
+	if r.important {
+		p += 2
+	}
+	return p
+}
+
+// applies tells whether the modifiers of the rule allow it to apply to a
+// query of qtype from ip, ip is the zero Addr when the client is not known.
+func (r *filterRule) applies(qtype uint16, ip netip.Addr) bool {
+	if len(r.types) > 0 && !slices.Contains(r.types, qtype) {
+		return false
+	}
+	if slices.Contains(r.notTypes, qtype) {
+		return false
+	}
+	if len(r.clients) > 0 && !prefixesContain(r.clients, ip) {
+		return false
+	}
+	return !prefixesContain(r.notClients, ip)
+}
+
+// parseModifiers parses the modifiers after the "$" of a rule.
+func (r *filterRule) parseModifiers(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(v, "=")
+		switch key {
+		case "important":
+			if value != "" {
+				return fmt.Errorf("invalid modifier %q", v)
+			}
+			r.important = true
+		case "client":
+			if value == "" {
+				return fmt.Errorf("invalid modifier %q", v)
+			}
+			for _, c := range strings.Split(value, "|") {
+				not := strings.HasPrefix(c, "~")
+				prefixes, err := parsePrefixes([]string{strings.TrimPrefix(c, "~")})
+				if err != nil {
+					// clients may also be given by name, which is not known
+					return fmt.Errorf("%w: client %q", errUnsupportedRule, c)
+				}
+				if not {
+					r.notClients = append(r.notClients, prefixes...)
+				} else {
+					r.clients = append(r.clients, prefixes...)
+				}
+			}
+		case "dnstype":
+			if value == "" {
+				return fmt.Errorf("invalid modifier %q", v)
+			}
+			for _, t := range strings.Split(value, "|") {
+				not := strings.HasPrefix(t, "~")
+				qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimPrefix(t, "~"))]
+				if !ok {
+					return fmt.Errorf("unknown dns type %q", t)
+				}
+				if not {
+					r.notTypes = append(r.notTypes, qtype)
+				} else {
+					r.types = append(r.types, qtype)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: modifier %q", errUnsupportedRule, key)
+		}
+	}
+	return nil
+}
+
+// filterList is the rules of filter lists in the AdGuard DNS filtering
+// syntax and the hosts format, indexed by domain name.
+type filterList struct {
+	// exact is the rules for a name.
+	exact map[string][]*filterRule
+	// sub is the rules for the subdomains of a name.
+	sub map[string][]*filterRule
+	// size is the number of rules.
+	size int
+}
+
+func newFilterList() *filterList {
+	return &filterList{
+		exact: map[string][]*filterRule{},
+		sub:   map[string][]*filterRule{},
+	}
+}
+
+// add adds the rule of a line, comments are skipped.
+func (l *filterList) add(line string) error {
+	if line = strings.TrimSpace(line); line == "" {
+		return nil
+	}
+	switch line[0] {
+	case '!', '#', '[':
+		// comments and headers such as [Adblock Plus 2.0]
+		return nil
+	}
+	if fields := strings.Fields(line); len(fields) > 1 {
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			return l.addHosts(line, fields[1:])
+		}
+	}
+	return l.addRule(line)
+}
+
+// addHosts adds the names of a line of a hosts file, which match exactly.
+func (l *filterList) addHosts(line string, fields []string) error {
+	names := []string{}
+	for _, v := range fields {
+		if strings.HasPrefix(v, "#") {
+			break
+		}
+		if hostsLocalNames[strings.ToLower(v)] {
+			continue
+		}
+		if strings.Contains(v, "*") {
+			return fmt.Errorf("invalid host %q", v)
+		}
+		name, err := canonicalRule(v)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	rule := &filterRule{text: line}
+	for _, v := range names {
+		l.exact[v] = append(l.exact[v], rule)
+	}
+	l.size++
+	return nil
+}
+
+// addRule adds a rule in the AdGuard DNS filtering syntax. The rules are
+// "||example.org^" for a domain and its subdomains, "||*.example.org^" for
+// the subdomains only and "|example.org^" for the domain only, and plain
+// domain names are taken as "||example.org^".
+func (l *filterList) addRule(line string) error {
+	rule := &filterRule{text: line}
+	pattern := line
+	if strings.HasPrefix(pattern, "@@") {
+		rule.allow = true
+		pattern = pattern[2:]
+	}
+	if i := strings.LastIndexByte(pattern, '$'); i >= 0 {
+		if err := rule.parseModifiers(pattern[i+1:]); err != nil {
+			return err
+		}
+		pattern = pattern[:i]
+	}
+
+	self, sub := true, true
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		pattern = pattern[2:]
+		if strings.HasPrefix(pattern, "*.") {
+			pattern, self = pattern[2:], false
+		}
+	case strings.HasPrefix(pattern, "|"):
+		pattern, sub = pattern[1:], false
+	}
+	pattern = strings.TrimSuffix(pattern, "|")
+	pattern = strings.TrimSuffix(pattern, "^")
+	if pattern == "" || strings.ContainsAny(pattern, "*/^|:?=&#$@ ") {
+		// regular expressions, URLs and cosmetic rules
+		return errUnsupportedRule
+	}
+	name, err := canonicalRule(pattern)
+	if err != nil {
+		return err
+	}
+
+	if self {
+		l.exact[name] = append(l.exact[name], rule)
+	}
+	if sub {
+		l.sub[name] = append(l.sub[name], rule)
+	}
+	l.size++
+	return nil
+}
+
+// match returns the rule deciding a query for name, which is in the form of
+// canonicalName, or nil when no rule applies.
+func (l *filterList) match(name string, qtype uint16, ip netip.Addr) *filterRule {
+	var best *filterRule
+	find := func(rules []*filterRule) {
+		for _, v := range rules {
+			if v.applies(qtype, ip) && (best == nil || v.priority() > best.priority()) {
+				best = v
+			}
+		}
+	}
+
+	find(l.exact[name])
+	for s := name; ; {
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+		find(l.sub[s])
+	}
+	return best
+}
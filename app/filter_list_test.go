@@ -0,0 +1,109 @@
+package app
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFilterList_Add(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		size int
+		err  string
+	}{
+		{"! comment", 0, ""},
+		{"# comment", 0, ""},
+		{"[Adblock Plus 2.0]", 0, ""},
+		{"||example.org^", 1, ""},
+		{"@@||example.org^$important,dnstype=~A|AAAA,client=192.0.2.0/24|~2001:db8::1", 1, ""},
+		{"0.0.0.0 ads.example tracker.example # comment", 1, ""},
+		{"127.0.0.1 localhost", 1, ""},
+		{"/ads[0-9]+\\.example/", 0, "unsupported"},
+		{"||example.org/path^", 0, "unsupported"},
+		{"example.org##.banner", 0, "unsupported"},
+		{"||ads*.example.org^", 0, "unsupported"},
+		{"||example.org^$client='laptop'", 0, "unsupported"},
+		{"||example.org^$dnsrewrite=192.0.2.1", 0, "unsupported"},
+		{"||example.org^$dnstype=NOPE", 0, "invalid"},
+		{"||example..org^", 0, "invalid"},
+		{"0.0.0.0 ads.*.example", 0, "invalid"},
+	} {
+		l := newFilterList()
+		err := l.add(tt.line)
+		got := ""
+		switch {
+		case errors.Is(err, errUnsupportedRule):
+			got = "unsupported"
+		case err != nil:
+			got = "invalid"
+		}
+		if got != tt.err || l.size != tt.size {
+			t.Errorf("add %q: size = %d, error = %v, want %d, %v", tt.line, l.size, err, tt.size, tt.err)
+		}
+	}
+}
+
+func TestFilterList_Match(t *testing.T) {
+	l := newFilterList()
+	for _, v := range []string{
+		"||ads.example^",
+		"@@||good.ads.example^",
+		"||*.sub.example^",
+		"|exact.example^",
+		"Tracker.Example",
+		"0.0.0.0 hosts.example other.example",
+		"||important.example^$important",
+		"@@||important.example^",
+		"@@||x.important.example^$important",
+		"||aaaa.example^$dnstype=AAAA",
+		"||client.example^$client=192.0.2.0/24",
+		"||notclient.example^$client=~192.0.2.1",
+		"||bücher.example^",
+	} {
+		if err := l.add(v); err != nil {
+			t.Fatalf("add %q: %v", v, err)
+		}
+	}
+
+	client := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("198.51.100.1")
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		ip    netip.Addr
+		want  string
+	}{
+		{"ads.example", dns.TypeA, client, "||ads.example^"},
+		{"x.y.ads.example", dns.TypeA, client, "||ads.example^"},
+		{"badads.example", dns.TypeA, client, ""},
+		{"good.ads.example", dns.TypeA, client, "@@||good.ads.example^"},
+		{"sub.example", dns.TypeA, client, ""},
+		{"a.sub.example", dns.TypeA, client, "||*.sub.example^"},
+		{"exact.example", dns.TypeA, client, "|exact.example^"},
+		{"www.exact.example", dns.TypeA, client, ""},
+		{"www.tracker.example", dns.TypeA, client, "Tracker.Example"},
+		{"other.example", dns.TypeA, client, "0.0.0.0 hosts.example other.example"},
+		{"www.other.example", dns.TypeA, client, ""},
+		{"important.example", dns.TypeA, client, "||important.example^$important"},
+		{"x.important.example", dns.TypeA, client, "@@||x.important.example^$important"},
+		{"aaaa.example", dns.TypeA, client, ""},
+		{"aaaa.example", dns.TypeAAAA, client, "||aaaa.example^$dnstype=AAAA"},
+		{"client.example", dns.TypeA, client, "||client.example^$client=192.0.2.0/24"},
+		{"client.example", dns.TypeA, other, ""},
+		{"client.example", dns.TypeA, netip.Addr{}, ""},
+		{"notclient.example", dns.TypeA, client, ""},
+		{"notclient.example", dns.TypeA, other, "||notclient.example^$client=~192.0.2.1"},
+		{"xn--bcher-kva.example", dns.TypeA, client, "||bücher.example^"},
+	} {
+		got := ""
+		if r := l.match(tt.name, tt.qtype, tt.ip); r != nil {
+			got = r.text
+		}
+		if got != tt.want {
+			t.Errorf("match %v %v from %v = %q, want %q", tt.name, dns.TypeToString[tt.qtype], tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ipSet is a set of IP addresses.
+type ipSet interface {
+	contains(netip.Addr) bool
+}
+
+// ipRange is the addresses from from to to.
+type ipRange struct {
+	from, to netip.Addr
+}
+
+// ipRanges is an ipSet of sorted ranges which do not overlap.
+type ipRanges []ipRange
+
+func newIPRanges(prefixes []netip.Prefix) ipRanges {
+	ranges := make(ipRanges, 0, len(prefixes))
+	for _, v := range prefixes {
+		v = v.Masked()
+		ranges = append(ranges, ipRange{from: v.Addr(), to: lastAddr(v)})
+	}
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.from.Compare(b.from) })
+
+	merged := ranges[:0]
+	for _, v := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].from.BitLen() == v.from.BitLen() &&
+			(v.from.Compare(merged[n-1].to) <= 0 || merged[n-1].to.Next() == v.from) {
+			if v.to.Compare(merged[n-1].to) > 0 {
+				merged[n-1].to = v.to
+			}
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return merged
+}
+
+func (r ipRanges) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	i, _ := slices.BinarySearchFunc(r, ip, func(v ipRange, ip netip.Addr) int {
+		switch {
+		case v.to.Compare(ip) < 0:
+			return -1
+		case v.from.Compare(ip) > 0:
+			return 1
+		}
+		return 0
+	})
+	return i < len(r) && r[i].from.Compare(ip) <= 0 && ip.Compare(r[i].to) <= 0
+}
+
+// lastAddr returns the last address of a masked prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// geoIPSet returns the set of the addresses of countries in a MaxMind DB or
+// a V2Ray geoip.dat file.
+func geoIPSet(data []byte, countries []string) (ipSet, error) {
+	if bytes.Contains(data, mmdbMetadataMarker) {
+		db, err := newMMDB(data)
+		if err != nil {
+			return nil, err
+		}
+		codes := map[string]bool{}
+		for _, v := range countries {
+			codes[strings.ToUpper(v)] = true
+		}
+		return &mmdbCountries{db: db, codes: codes}, nil
+	}
+	return geoIPRanges(data, countries)
+}
+
+// geoIPRanges returns the ranges of countries in a geoip.dat file.
+func geoIPRanges(data []byte, countries []string) (ipRanges, error) {
+	found := map[string]bool{}
+	for _, v := range countries {
+		found[strings.ToLower(strings.TrimPrefix(v, "geoip:"))] = false
+	}
+
+	prefixes := []netip.Prefix{}
+	err := protoFields(data, func(num protowire.Number, b []byte) error {
+		// GeoIPList.entry
+		if num != 1 {
+			return nil
+		}
+		code, cidrs := "", [][]byte{}
+		err := protoFields(b, func(num protowire.Number, b []byte) error {
+			switch num {
+			case 1:
+				code = strings.ToLower(string(b))
+			case 2:
+				cidrs = append(cidrs, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := found[code]; !ok {
+			return nil
+		}
+		found[code] = true
+
+		for _, v := range cidrs {
+			ip, bits := netip.Addr{}, uint64(0)
+			err := protoFields(v, func(num protowire.Number, b []byte) error {
+				switch num {
+				case 1:
+					ip, _ = netip.AddrFromSlice(b)
+				case 2:
+					bits, _ = protowire.ConsumeVarint(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			prefix, err := ip.Prefix(int(bits))
+			if err != nil || bits > uint64(ip.BitLen()) {
+				return fmt.Errorf("geoip %v: invalid cidr %v/%d", code, ip, bits)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range found {
+		if !v {
+			return nil, fmt.Errorf("geoip %q not found", k)
+		}
+	}
+	return newIPRanges(prefixes), nil
+}
+
+// mmdbMetadataMarker starts the metadata at the end of a MaxMind DB.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is a MaxMind DB, see https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node of IPv4 addresses in an IPv6 tree.
+	ipv4Start uint
+
+	// countries is the country codes by the offset of their record.
+	countries sync.Map
+}
+
+func newMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: no metadata")
+	}
+	v, _, err := decodeMMDB(b[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+	uintValue := func(key string) uint {
+		n, _ := meta[key].(uint64)
+		return uint(n)
+	}
+
+	db := &mmdb{
+		nodeCount:  uintValue("node_count"),
+		recordSize: uintValue("record_size"),
+		ipVersion:  uintValue("ip_version"),
+	}
+	switch {
+	case db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	case db.ipVersion != 4 && db.ipVersion != 6:
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", db.ipVersion)
+	}
+	// a node is two records
+	nodeSize := db.recordSize / 4
+	if db.nodeCount > uint(i)/nodeSize || nodeSize*db.nodeCount+16 > uint(i) {
+		return nil, errors.New("mmdb: invalid node count")
+	}
+	size := nodeSize * db.nodeCount
+	db.tree, db.data = b[:size], b[size+16:i]
+
+	// the records are checked once, so that lookups never leave the tree
+	// or the data section
+	for node := uint(0); node < db.nodeCount; node++ {
+		for bit := uint(0); bit < 2; bit++ {
+			if r := db.record(node, bit); r > db.nodeCount && (r < db.nodeCount+16 || r-db.nodeCount-16 >= uint(len(db.data))) {
+				return nil, fmt.Errorf("mmdb: invalid record %d of node %d", r, node)
+			}
+		}
+	}
+
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left or right record of a node.
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the offset of the record of ip in the data section.
+func (db *mmdb) lookup(ip netip.Addr) (int, bool) {
+	ip = ip.Unmap()
+	node := uint(0)
+	switch {
+	case ip.Is4() && db.ipVersion == 6:
+		node = db.ipv4Start
+	case ip.Is6() && db.ipVersion == 4:
+		return 0, false
+	}
+
+	b := ip.AsSlice()
+	for i := 0; i < len(b)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(b[i/8]>>(7-i%8))&1)
+	}
+	if node < db.nodeCount+16 || node-db.nodeCount-16 >= uint(len(db.data)) {
+		return 0, false
+	}
+	return int(node - db.nodeCount - 16), true
+}
+
+// country returns the ISO code of the country of ip, or the country it is
+// registered in, which is empty when it is not known.
+func (db *mmdb) country(ip netip.Addr) string {
+	offset, ok := db.lookup(ip)
+	if !ok {
+		return ""
+	}
+	if v, ok := db.countries.Load(offset); ok {
+		return v.(string)
+	}
+
+	code := ""
+	if v, _, err := decodeMMDB(db.data, offset, 0); err == nil {
+		record, _ := v.(map[string]any)
+		for _, key := range []string{"country", "registered_country"} {
+			if country, ok := record[key].(map[string]any); ok {
+				if s, ok := country["iso_code"].(string); ok {
+					code = s
+					break
+				}
+			}
+		}
+	}
+	db.countries.Store(offset, code)
+	return code
+}
+
+// mmdbCountries is the ipSet of the addresses of countries in a MaxMind DB.
+type mmdbCountries struct {
+	db    *mmdb
+	codes map[string]bool
+}
+
+func (s *mmdbCountries) contains(ip netip.Addr) bool {
+	return s.codes[s.db.country(ip)]
+}
+
+// the types of the data section of MaxMind DBs
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// mmdbMaxDepth limits the nesting of maps, arrays and pointers.
+const mmdbMaxDepth = 32
+
+var errMMDBData = errors.New("invalid data")
+
+// decodeMMDB decodes the value at offset of a data section and returns the
+// offset after it. Numbers are uint64, int64 or float64, and uint128 is
+// returned as bytes.
+func decodeMMDB(b []byte, offset, depth int) (any, int, error) {
+	if depth > mmdbMaxDepth || offset < 0 || offset >= len(b) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := b[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		n := int(ctrl>>3) & 0x3
+		if offset+n+1 > len(b) {
+			return nil, 0, errMMDBData
+		}
+		p := 0
+		switch n {
+		case 0:
+			p = int(ctrl&0x7)<<8 | int(b[offset])
+		case 1:
+			p = (int(ctrl&0x7)<<16 | int(b[offset])<<8 | int(b[offset+1])) + 2048
+		case 2:
+			p = (int(ctrl&0x7)<<24 | int(b[offset])<<16 | int(b[offset+1])<<8 | int(b[offset+2])) + 526336
+		default:
+			p = int(binary.BigEndian.Uint32(b[offset:]))
+		}
+		v, _, err := decodeMMDB(b, p, depth+1)
+		return v, offset + n + 1, err
+	}
+
+	if typ == mmdbExtended {
+		if offset >= len(b) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + int(b[offset])
+		offset++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(b) {
+			return nil, 0, errMMDBData
+		}
+		v := 0
+		for _, c := range b[offset : offset+n] {
+			v = v<<8 | int(c)
+		}
+		size = []int{29, 285, 65821}[n-1] + v
+		offset += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, next, err := decodeMMDB(b, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			v, next, err := decodeMMDB(b, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := decodeMMDB(b, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(b) {
+		return nil, 0, errMMDBData
+	}
+	v := b[offset : offset+size]
+	switch typ {
+	case mmdbString:
+		return string(v), offset + size, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), offset + size, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), offset + size, nil
+	case mmdbBytes, mmdbUint128:
+		return v, offset + size, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errMMDBData
+		}
+		n := uint64(0)
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset + size, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBData
+		}
+		n := uint32(0)
+		for _, c := range v {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset + size, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
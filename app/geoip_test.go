@@ -0,0 +1,415 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestIPRanges(t *testing.T) {
+	r := newIPRanges([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.128/25"),
+		netip.MustParsePrefix("192.0.2.0/25"),
+		netip.MustParsePrefix("192.0.2.64/26"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("0.0.0.0/32"),
+	})
+	if len(r) != 4 {
+		t.Errorf("ranges = %v, want 4 ranges", r)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.0", true},
+		{"192.0.2.255", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.3.0", false},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"0.0.0.0", true},
+		{"0.0.0.1", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::", false},
+		{"::", false},
+	} {
+		if got := r.contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("contains %v = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// testGeoIP encodes a GeoIPList.
+func testGeoIP(countries map[string][]string) []byte {
+	codes := []string{}
+	for k := range countries {
+		codes = append(codes, k)
+	}
+	sort.Strings(codes)
+
+	b := []byte{}
+	for _, code := range codes {
+		geoip := protowire.AppendTag(nil, 1, protowire.BytesType)
+		geoip = protowire.AppendString(geoip, code)
+		for _, v := range countries[code] {
+			p := netip.MustParsePrefix(v)
+			cidr := protowire.AppendTag(nil, 1, protowire.BytesType)
+			cidr = protowire.AppendBytes(cidr, p.Addr().AsSlice())
+			cidr = protowire.AppendTag(cidr, 2, protowire.VarintType)
+			cidr = protowire.AppendVarint(cidr, uint64(p.Bits()))
+			geoip = protowire.AppendTag(geoip, 2, protowire.BytesType)
+			geoip = protowire.AppendBytes(geoip, cidr)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, geoip)
+	}
+	return b
+}
+
+func TestGeoIPRanges(t *testing.T) {
+	data := testGeoIP(map[string][]string{
+		"CN":      {"1.0.1.0/24", "2001:db8::/32"},
+		"PRIVATE": {"10.0.0.0/8"},
+		"US":      {"8.8.8.0/24"},
+	})
+	set, err := geoIPSet(data, []string{"geoip:cn", "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.1.1", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", true},
+		{"8.8.8.8", false},
+	} {
+		if got := set.contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("contains %v = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := geoIPSet(data, []string{"jp"}); err == nil {
+		t.Errorf("missing country is accepted")
+	}
+}
+
+// mmdbTestPointer is a pointer to an offset of the data section.
+type mmdbTestPointer int
+
+// mmdbWriter encodes values of the data section of a MaxMind DB.
+type mmdbWriter struct {
+	bytes.Buffer
+}
+
+func (w *mmdbWriter) ctrl(typ, size int) {
+	t := typ
+	if typ > 7 {
+		t = mmdbExtended
+	}
+	extra := []byte{}
+	switch {
+	case size < 29:
+	case size < 285:
+		extra, size = []byte{byte(size - 29)}, 29
+	case size < 65821:
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+		size = 30
+	default:
+		extra = binary.BigEndian.AppendUint32(nil, uint32(size-65821))[1:]
+		size = 31
+	}
+	w.WriteByte(byte(t<<5 | size))
+	if typ > 7 {
+		w.WriteByte(byte(typ - 7))
+	}
+	w.Write(extra)
+}
+
+func (w *mmdbWriter) uint(typ int, n uint64) {
+	b := binary.BigEndian.AppendUint64(nil, n)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	w.ctrl(typ, len(b))
+	w.Write(b)
+}
+
+func (w *mmdbWriter) value(v any) {
+	switch v := v.(type) {
+	case string:
+		w.ctrl(mmdbString, len(v))
+		w.WriteString(v)
+	case []byte:
+		w.ctrl(mmdbBytes, len(v))
+		w.Write(v)
+	case uint16:
+		w.uint(mmdbUint16, uint64(v))
+	case uint32:
+		w.uint(mmdbUint32, uint64(v))
+	case uint64:
+		w.uint(mmdbUint64, v)
+	case int32:
+		w.ctrl(mmdbInt32, 4)
+		binary.Write(w, binary.BigEndian, v)
+	case float64:
+		w.ctrl(mmdbDouble, 8)
+		binary.Write(w, binary.BigEndian, math.Float64bits(v))
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		w.ctrl(mmdbBool, n)
+	case []any:
+		w.ctrl(mmdbArray, len(v))
+		for _, e := range v {
+			w.value(e)
+		}
+	case map[string]any:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.ctrl(mmdbMap, len(v))
+		for _, k := range keys {
+			w.value(k)
+			w.value(v[k])
+		}
+	case mmdbTestPointer:
+		switch {
+		case v < 2048:
+			w.Write([]byte{byte(mmdbPointer<<5 | int(v)>>8), byte(v)})
+		case v < 526336:
+			p := int(v) - 2048
+			w.Write([]byte{byte(mmdbPointer<<5 | 1<<3 | p>>16), byte(p >> 8), byte(p)})
+		default:
+			w.WriteByte(mmdbPointer<<5 | 3<<3)
+			binary.Write(w, binary.BigEndian, uint32(v))
+		}
+	}
+}
+
+func TestDecodeMMDB(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), 300))
+	value := map[string]any{
+		"string": "value",
+		"long":   long,
+		"bytes":  []byte{1, 2},
+		"uint16": uint16(443),
+		"uint32": uint32(1 << 20),
+		"uint64": uint64(1 << 40),
+		"int32":  int32(-5),
+		"double": 1.5,
+		"bool":   true,
+		"array":  []any{"a", uint32(0)},
+	}
+	want := map[string]any{
+		"string": "value",
+		"long":   long,
+		"bytes":  []byte{1, 2},
+		"uint16": uint64(443),
+		"uint32": uint64(1 << 20),
+		"uint64": uint64(1 << 40),
+		"int32":  int64(-5),
+		"double": 1.5,
+		"bool":   true,
+		"array":  []any{"a", uint64(0)},
+	}
+
+	w := &mmdbWriter{}
+	w.value(value)
+	// pointers to the value from far away
+	w.Write(make([]byte, 3000))
+	for _, p := range []mmdbTestPointer{0, 3000 + 100000} {
+		at := w.Len()
+		w.value(p)
+		if p > 0 {
+			w.Write(make([]byte, 100000+3000-w.Len()))
+			w.value(value)
+		}
+		got, next, err := decodeMMDB(w.Bytes(), at, 0)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("pointer %d: value = %v, %v", p, got, err)
+		}
+		if p == 0 && next != w.Len() {
+			t.Errorf("next = %d, want %d", next, w.Len())
+		}
+	}
+
+	for _, b := range [][]byte{
+		{},
+		{mmdbString<<5 | 5, 'a'},
+		{mmdbMap<<5 | 1, mmdbUint16<<5 | 1, 1, mmdbUint16<<5 | 1, 1},
+		{mmdbPointer << 5, 0},
+		{mmdbExtended<<5 | 2, 0x7f},
+	} {
+		if _, _, err := decodeMMDB(b, 0, 0); err == nil {
+			t.Errorf("invalid data %x is decoded", b)
+		}
+	}
+}
+
+// testMMDB writes an IPv6 MaxMind DB with 24 bit records, in which the
+// networks have the records at the offsets of their data section.
+func testMMDB(networks map[string]int, data []byte) []byte {
+	type node struct {
+		children [2]*node
+		data     [2]int
+	}
+	root := &node{data: [2]int{-1, -1}}
+	for k, offset := range networks {
+		p := netip.MustParsePrefix(k)
+		b, bits := p.Addr().As16(), p.Bits()
+		if p.Addr().Is4() {
+			b, bits = [16]byte{}, bits+96
+			copy(b[12:], p.Addr().AsSlice())
+		}
+		n := root
+		for i := 0; i < bits; i++ {
+			bit := b[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				n.data[bit] = offset
+				break
+			}
+			if n.children[bit] == nil {
+				n.children[bit] = &node{data: [2]int{-1, -1}}
+			}
+			n = n.children[bit]
+		}
+	}
+
+	nodes, index := []*node{root}, map[*node]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, c := range nodes[i].children {
+			if c != nil {
+				index[c] = len(nodes)
+				nodes = append(nodes, c)
+			}
+		}
+	}
+
+	b := []byte{}
+	for _, n := range nodes {
+		for bit := range 2 {
+			record := len(nodes)
+			switch {
+			case n.children[bit] != nil:
+				record = index[n.children[bit]]
+			case n.data[bit] >= 0:
+				record = len(nodes) + 16 + n.data[bit]
+			}
+			b = append(b, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+
+	w := &mmdbWriter{}
+	w.value(map[string]any{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(6),
+		"database_type":               "Test-Country",
+		"binary_format_major_version": uint16(2),
+	})
+	return append(b, w.Bytes()...)
+}
+
+func TestMMDB(t *testing.T) {
+	w := &mmdbWriter{}
+	country := w.Len()
+	w.value(map[string]any{"iso_code": "CN", "names": map[string]any{"en": "China"}})
+	cn := w.Len()
+	w.ctrl(mmdbMap, 2)
+	w.value("continent")
+	w.value(map[string]any{"code": "AS"})
+	w.value("country")
+	w.value(mmdbTestPointer(country))
+	us := w.Len()
+	w.value(map[string]any{"registered_country": map[string]any{"iso_code": "US"}})
+	none := w.Len()
+	w.value(map[string]any{})
+
+	db, err := newMMDB(testMMDB(map[string]int{
+		"1.0.1.0/24":    cn,
+		"8.8.8.0/24":    us,
+		"10.0.0.0/8":    none,
+		"2001:db8::/32": cn,
+	}, w.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.1.5", "CN"},
+		{"::ffff:1.0.1.5", "CN"},
+		{"8.8.8.8", "US"},
+		{"2001:db8::1", "CN"},
+		{"10.1.1.1", ""},
+		{"9.9.9.9", ""},
+		{"2001:db9::1", ""},
+	} {
+		for range 2 {
+			if got := db.country(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("country of %v = %q, want %q", tt.ip, got, tt.want)
+			}
+		}
+	}
+
+	set, err := geoIPSet(testMMDB(map[string]int{"1.0.1.0/24": cn}, w.Bytes()), []string{"cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.contains(netip.MustParseAddr("1.0.1.1")) || set.contains(netip.MustParseAddr("1.0.2.1")) {
+		t.Errorf("mmdb set does not contain the addresses of the country")
+	}
+
+	// records between the node count and the data section, or past the
+	// data section
+	valid := testMMDB(map[string]int{"1.0.1.0/24": cn}, w.Bytes())
+	corrupt := func(record uint) []byte {
+		b := append([]byte{}, valid...)
+		b[0], b[1], b[2] = byte(record>>16), byte(record>>8), byte(record)
+		return b
+	}
+	db, err = newMMDB(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := db.nodeCount
+
+	// a node count of which the tree size overflows
+	overflow := &mmdbWriter{}
+	overflow.value(map[string]any{
+		"node_count":  uint64(1) << 62,
+		"record_size": uint16(32),
+		"ip_version":  uint16(6),
+	})
+
+	for _, b := range [][]byte{
+		mmdbMetadataMarker,
+		append(append([]byte{}, mmdbMetadataMarker...), 0xe0),
+		valid[100:],
+		corrupt(nodes + 1),
+		corrupt(nodes + 15),
+		corrupt(nodes + 16 + uint(w.Len())),
+		append(append([]byte{}, mmdbMetadataMarker...), overflow.Bytes()...),
+	} {
+		if _, err := newMMDB(b); err == nil {
+			t.Errorf("invalid mmdb is accepted")
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// geoSiteRules returns the rules of the sites of a V2Ray geosite.dat file,
+// in the format of MatchDomain. A site is a country code such as "cn",
+// optionally followed by attributes such as "@ads", which the domains must
+// all have.
+func geoSiteRules(data []byte, sites []string) ([]string, error) {
+	type selector struct {
+		code  string
+		attrs []string
+	}
+	selectors := make([]selector, 0, len(sites))
+	found := map[string]bool{}
+	for _, v := range sites {
+		parts := strings.Split(strings.TrimPrefix(strings.ToLower(v), "geosite:"), "@")
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid site %q", v)
+		}
+		selectors = append(selectors, selector{code: parts[0], attrs: parts[1:]})
+		found[parts[0]] = false
+	}
+
+	rules := []string{}
+	err := protoFields(data, func(num protowire.Number, b []byte) error {
+		// GeoSiteList.entry
+		if num != 1 {
+			return nil
+		}
+		code, domains := "", [][]byte{}
+		err := protoFields(b, func(num protowire.Number, b []byte) error {
+			switch num {
+			case 1:
+				code = strings.ToLower(string(b))
+			case 2:
+				domains = append(domains, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := found[code]; !ok {
+			return nil
+		}
+		found[code] = true
+
+		for _, v := range domains {
+			d, err := parseGeoSiteDomain(v)
+			if err != nil {
+				return fmt.Errorf("site %v: %w", code, err)
+			}
+			for _, s := range selectors {
+				if s.code == code && d.has(s.attrs) {
+					rules = append(rules, d.rule)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range selectors {
+		if !found[v.code] {
+			return nil, fmt.Errorf("site %q not found", v.code)
+		}
+	}
+	return rules, nil
+}
+
+// geoSiteDomain is a domain of a site of a geosite.dat file.
+type geoSiteDomain struct {
+	rule  string
+	attrs []string
+}
+
+func (d *geoSiteDomain) has(attrs []string) bool {
+	for _, v := range attrs {
+		found := false
+		for _, a := range d.attrs {
+			if a == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parseGeoSiteDomain(b []byte) (*geoSiteDomain, error) {
+	d := &geoSiteDomain{}
+	typ, value := uint64(0), ""
+	err := protoFields(b, func(num protowire.Number, b []byte) error {
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			typ = v
+		case 2:
+			value = string(b)
+		case 3:
+			return protoFields(b, func(num protowire.Number, b []byte) error {
+				if num == 1 {
+					d.attrs = append(d.attrs, strings.ToLower(string(b)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case 0: // Plain
+		d.rule = "keyword:" + value
+	case 1: // Regex
+		d.rule = "regexp:" + value
+	case 2: // Domain
+		d.rule = "domain:" + value
+	case 3: // Full
+		d.rule = "full:" + value
+	default:
+		return nil, fmt.Errorf("unknown type %d of domain %q", typ, value)
+	}
+	return d, nil
+}
+
+// protoFields calls fn for the fields of a protobuf message, with the value
+// of varint fields encoded as a varint.
+func protoFields(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		value := []byte(nil)
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				value = b[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if value != nil {
+			if err := fn(num, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the items of rules of sing-box rule-sets
+const (
+	ruleSetItemQueryType = iota
+	ruleSetItemNetwork
+	ruleSetItemDomain
+	ruleSetItemDomainKeyword
+	ruleSetItemDomainRegex
+	ruleSetItemSourceIPCIDR
+	ruleSetItemIPCIDR
+	ruleSetItemSourcePort
+	ruleSetItemSourcePortRange
+	ruleSetItemPort
+	ruleSetItemPortRange
+	ruleSetItemProcessName
+	ruleSetItemProcessPath
+	ruleSetItemPackageName
+	ruleSetItemWIFISSID
+	ruleSetItemWIFIBSSID
+	ruleSetItemAdGuardDomain
+	ruleSetItemProcessPathRegex
+	ruleSetItemNetworkType
+	ruleSetItemNetworkIsExpensive
+	ruleSetItemNetworkIsConstrained
+	ruleSetItemFinal = 0xff
+)
+
+const (
+	// ruleSetVersion is the latest version of rule-sets which is known.
+	ruleSetVersion = 3
+	// ruleSetPrefixLabel and ruleSetRootLabel start the domains of
+	// rule-sets which match the subdomains only and the domain with its
+	// subdomains.
+	ruleSetPrefixLabel = '\r'
+	ruleSetRootLabel   = '\n'
+)
+
+var ruleSetMagic = []byte("SRS")
+
+// isRuleSet tells whether data is a sing-box binary rule-set.
+func isRuleSet(data []byte) bool {
+	return bytes.HasPrefix(data, ruleSetMagic)
+}
+
+// ruleSetRules returns the domain rules of a sing-box binary rule-set, in
+// the format of MatchDomain. Only the rules with nothing but domain items
+// are used, the others are counted in skipped.
+func ruleSetRules(data []byte) (rules []string, skipped int, err error) {
+	if !isRuleSet(data) {
+		return nil, 0, errors.New("not a rule-set")
+	}
+	if len(data) < 4 || data[3] == 0 || data[3] > ruleSetVersion {
+		return nil, 0, errors.New("unsupported rule-set version")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[4:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zr.Close()
+	r := bufio.NewReader(io.LimitReader(zr, MaxRuleListSize))
+
+	n, err := readRuleSetLength(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := 0; i < n; i++ {
+		rule, err := readRuleSetRule(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rule == nil {
+			skipped++
+			continue
+		}
+		rules = append(rules, rule...)
+	}
+	// the checksum is verified at the end of the stream
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, 0, err
+	}
+	return rules, skipped, nil
+}
+
+// readRuleSetRule returns the domain rules of a rule, which are nil for a
+// rule which can not be matched by the domain alone.
+func readRuleSetRule(r *bufio.Reader) ([]string, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case 0:
+		return readRuleSetDefaultRule(r)
+	case 1:
+		// logical rules are read but not used
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		n, err := readRuleSetLength(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			if _, err := readRuleSetRule(r); err != nil {
+				return nil, err
+			}
+		}
+		_, err = r.ReadByte()
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unknown rule type %d", typ)
+	}
+}
+
+func readRuleSetDefaultRule(r *bufio.Reader) ([]string, error) {
+	rules, other := []string{}, false
+	for {
+		item, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch item {
+		case ruleSetItemDomain:
+			domains, err := readRuleSetDomains(r)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, domains...)
+		case ruleSetItemDomainKeyword, ruleSetItemDomainRegex:
+			ss, err := readRuleSetStrings(r)
+			if err != nil {
+				return nil, err
+			}
+			prefix := "keyword:"
+			if item == ruleSetItemDomainRegex {
+				prefix = "regexp:"
+			}
+			for _, v := range ss {
+				rules = append(rules, prefix+v)
+			}
+		case ruleSetItemQueryType, ruleSetItemSourcePort, ruleSetItemPort:
+			n, err := readRuleSetLength(r)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := r.Discard(2 * n); err != nil {
+				return nil, err
+			}
+			other = true
+		case ruleSetItemNetwork, ruleSetItemSourcePortRange, ruleSetItemPortRange,
+			ruleSetItemProcessName, ruleSetItemProcessPath, ruleSetItemPackageName,
+			ruleSetItemWIFISSID, ruleSetItemWIFIBSSID, ruleSetItemProcessPathRegex:
+			if _, err := readRuleSetStrings(r); err != nil {
+				return nil, err
+			}
+			other = true
+		case ruleSetItemAdGuardDomain:
+			// adguard rules are a domain set of their own syntax
+			if err := skipRuleSetDomains(r); err != nil {
+				return nil, err
+			}
+			other = true
+		case ruleSetItemNetworkType:
+			if _, err := readRuleSetBytes(r); err != nil {
+				return nil, err
+			}
+			other = true
+		case ruleSetItemNetworkIsExpensive, ruleSetItemNetworkIsConstrained:
+			other = true
+		case ruleSetItemSourceIPCIDR, ruleSetItemIPCIDR:
+			if err := skipRuleSetIPSet(r); err != nil {
+				return nil, err
+			}
+			other = true
+		case ruleSetItemFinal:
+			invert, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if other || invert != 0 || len(rules) == 0 {
+				return nil, nil
+			}
+			return rules, nil
+		default:
+			return nil, fmt.Errorf("unsupported rule item %d", item)
+		}
+	}
+}
+
+// skipRuleSetDomains skips a succinct trie of domains.
+func skipRuleSetDomains(r *bufio.Reader) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != 1 {
+		return fmt.Errorf("unsupported domain set version %d", version)
+	}
+	for range 2 {
+		if _, err := readRuleSetUint64s(r); err != nil {
+			return err
+		}
+	}
+	_, err = readRuleSetBytes(r)
+	return err
+}
+
+// readRuleSetDomains reads the domains and domain suffixes of a rule, which
+// are stored in a succinct trie of the reversed names.
+func readRuleSetDomains(r *bufio.Reader) ([]string, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported domain set version %d", version)
+	}
+	leaves, err := readRuleSetUint64s(r)
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := readRuleSetUint64s(r)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := readRuleSetBytes(r)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := succinctKeys(leaves, bitmap, labels)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]string, 0, len(keys))
+	for _, v := range keys {
+		switch name := reverseRunes(v); {
+		case strings.HasPrefix(name, string(ruleSetPrefixLabel)+"."):
+			rules = append(rules, `regexp:\.`+regexp.QuoteMeta(strings.ToLower(name[2:]))+"$")
+		case strings.HasPrefix(name, string(ruleSetRootLabel)):
+			rules = append(rules, "domain:"+name[1:])
+		default:
+			rules = append(rules, "full:"+name)
+		}
+	}
+	return rules, nil
+}
+
+// succinctKeys returns the keys of a trie in the LOUDS encoding: the nodes
+// are in breadth-first order, with a 0 bit in bitmap for every child and a
+// 1 bit after the children of a node, and a bit in leaves for every node
+// which ends a key.
+func succinctKeys(leaves, bitmap []uint64, labels []byte) ([]string, error) {
+	bit := func(bm []uint64, i int) bool {
+		return i>>6 < len(bm) && bm[i>>6]>>(i&63)&1 != 0
+	}
+
+	parents, nodeLabels := []int{-1}, []byte{0}
+	for i, node := 0, 0; node < len(parents); i++ {
+		if i >= 64*len(bitmap) {
+			return nil, errors.New("invalid domain set")
+		}
+		if bit(bitmap, i) {
+			node++
+			continue
+		}
+		edge := len(parents) - 1
+		if edge >= len(labels) {
+			return nil, errors.New("invalid domain set")
+		}
+		parents = append(parents, node)
+		nodeLabels = append(nodeLabels, labels[edge])
+	}
+
+	keys := []string{}
+	for node := range parents {
+		if !bit(leaves, node) {
+			continue
+		}
+		key := []byte{}
+		for n := node; n > 0; n = parents[n] {
+			key = append(key, nodeLabels[n])
+		}
+		for i, j := 0, len(key)-1; i < j; i, j = i+1, j-1 {
+			key[i], key[j] = key[j], key[i]
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// reverseRunes reverses the runes of s.
+func reverseRunes(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		i += n
+		utf8.EncodeRune(b[len(s)-i:], r)
+	}
+	return string(b)
+}
+
+func readRuleSetLength(r *bufio.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if n > MaxRuleListSize {
+		return 0, errors.New("rule-set too large")
+	}
+	return int(n), nil
+}
+
+func readRuleSetBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := readRuleSetLength(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readRuleSetUint64s(r *bufio.Reader) ([]uint64, error) {
+	n, err := readRuleSetLength(r)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]uint64, n)
+	return v, binary.Read(r, binary.BigEndian, v)
+}
+
+func readRuleSetStrings(r *bufio.Reader) ([]string, error) {
+	n, err := readRuleSetLength(r)
+	if err != nil {
+		return nil, err
+	}
+	ss := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := readRuleSetBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, string(b))
+	}
+	return ss, nil
+}
+
+// skipRuleSetIPSet skips a set of IP ranges.
+func skipRuleSetIPSet(r *bufio.Reader) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != 1 {
+		return fmt.Errorf("unsupported ip set version %d", version)
+	}
+	n := uint64(0)
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if n > MaxRuleListSize {
+		return errors.New("rule-set too large")
+	}
+	// each range is the first and the last address
+	for i := uint64(0); i < 2*n; i++ {
+		if _, err := readRuleSetBytes(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package app
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// geoSiteType is the type of a domain of a geosite.dat file.
+type geoSiteType uint64
+
+const (
+	geoSiteTypePlain geoSiteType = iota
+	geoSiteTypeRegex
+	geoSiteTypeDomain
+	geoSiteTypeFull
+)
+
+type testGeoSiteDomain struct {
+	typ   geoSiteType
+	value string
+	attrs []string
+}
+
+// testGeoSite encodes a GeoSiteList.
+func testGeoSite(sites map[string][]testGeoSiteDomain) []byte {
+	codes := []string{}
+	for k := range sites {
+		codes = append(codes, k)
+	}
+	sort.Strings(codes)
+
+	b := []byte{}
+	for _, code := range codes {
+		site := protowire.AppendTag(nil, 1, protowire.BytesType)
+		site = protowire.AppendString(site, code)
+		for _, d := range sites[code] {
+			domain := protowire.AppendTag(nil, 1, protowire.VarintType)
+			domain = protowire.AppendVarint(domain, uint64(d.typ))
+			domain = protowire.AppendTag(domain, 2, protowire.BytesType)
+			domain = protowire.AppendString(domain, d.value)
+			for _, a := range d.attrs {
+				attr := protowire.AppendTag(nil, 1, protowire.BytesType)
+				attr = protowire.AppendString(attr, a)
+				attr = protowire.AppendTag(attr, 2, protowire.VarintType)
+				attr = protowire.AppendVarint(attr, 1)
+				domain = protowire.AppendTag(domain, 3, protowire.BytesType)
+				domain = protowire.AppendBytes(domain, attr)
+			}
+			site = protowire.AppendTag(site, 2, protowire.BytesType)
+			site = protowire.AppendBytes(site, domain)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, site)
+	}
+	return b
+}
+
+func TestGeoSiteRules(t *testing.T) {
+	data := testGeoSite(map[string][]testGeoSiteDomain{
+		"CN": {
+			{geoSiteTypeDomain, "example.cn", nil},
+			{geoSiteTypeFull, "www.example.com", nil},
+			{geoSiteTypePlain, "baidu", nil},
+			{geoSiteTypeRegex, `^cdn[0-9]+\.example\.net$`, nil},
+			{geoSiteTypeDomain, "ads.example.cn", []string{"ads"}},
+		},
+		"PRIVATE": {
+			{geoSiteTypeFull, "localhost", nil},
+		},
+	})
+
+	for _, tt := range []struct {
+		sites []string
+		want  []string
+		err   bool
+	}{
+		{[]string{"geosite:cn"}, []string{"domain:example.cn", "full:www.example.com", "keyword:baidu", `regexp:^cdn[0-9]+\.example\.net$`, "domain:ads.example.cn"}, false},
+		{[]string{"CN@ads"}, []string{"domain:ads.example.cn"}, false},
+		{[]string{"cn@ads", "private"}, []string{"domain:ads.example.cn", "full:localhost"}, false},
+		{[]string{"cn@cdn"}, []string{}, false},
+		{[]string{"us"}, nil, true},
+		{[]string{"@ads"}, nil, true},
+	} {
+		rules, err := geoSiteRules(data, tt.sites)
+		if (err != nil) != tt.err || (!tt.err && !reflect.DeepEqual(rules, tt.want)) {
+			t.Errorf("sites %q: rules = %q, error = %v, want %q", tt.sites, rules, err, tt.want)
+		}
+	}
+
+	if _, err := geoSiteRules([]byte{0x0a, 0xff}, []string{"cn"}); err == nil {
+		t.Errorf("truncated geosite is accepted")
+	}
+}
+
+// encodeSuccinctSet encodes sorted keys in a trie the way sing-box does.
+func encodeSuccinctSet(keys []string) (leaves, bitmap []uint64, labels []byte) {
+	setBit := func(bm *[]uint64, i int) {
+		for i>>6 >= len(*bm) {
+			*bm = append(*bm, 0)
+		}
+		(*bm)[i>>6] |= 1 << (i & 63)
+	}
+	type elt struct{ s, e, col int }
+	queue := []elt{{0, len(keys), 0}}
+	idx := 0
+	for i := 0; i < len(queue); i++ {
+		e := queue[i]
+		if e.col == len(keys[e.s]) {
+			e.s++
+			setBit(&leaves, i)
+		}
+		for j := e.s; j < e.e; {
+			from := j
+			for ; j < e.e && keys[j][e.col] == keys[from][e.col]; j++ {
+			}
+			queue = append(queue, elt{from, j, e.col + 1})
+			labels = append(labels, keys[from][e.col])
+			idx++
+		}
+		setBit(&bitmap, idx)
+		idx++
+	}
+	return leaves, bitmap, labels
+}
+
+// ruleSetWriter writes the uncompressed content of a rule-set.
+type ruleSetWriter struct {
+	bytes.Buffer
+}
+
+func (w *ruleSetWriter) uvarint(n int) {
+	w.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (w *ruleSetWriter) strings(item byte, ss ...string) {
+	w.WriteByte(item)
+	w.uvarint(len(ss))
+	for _, v := range ss {
+		w.uvarint(len(v))
+		w.WriteString(v)
+	}
+}
+
+func (w *ruleSetWriter) domains(exact, suffixes []string) {
+	keys := []string{}
+	for _, v := range exact {
+		keys = append(keys, reverseRunes(v))
+	}
+	for _, v := range suffixes {
+		if v[0] == '.' {
+			keys = append(keys, reverseRunes(string(ruleSetPrefixLabel)+v))
+		} else {
+			keys = append(keys, reverseRunes(string(ruleSetRootLabel)+v))
+		}
+	}
+	w.domainSet(ruleSetItemDomain, keys)
+}
+
+// domainSet writes the item of a domain set of keys.
+func (w *ruleSetWriter) domainSet(item byte, keys []string) {
+	sort.Strings(keys)
+	leaves, bitmap, labels := encodeSuccinctSet(keys)
+
+	w.WriteByte(item)
+	w.WriteByte(1)
+	for _, v := range [][]uint64{leaves, bitmap} {
+		w.uvarint(len(v))
+		binary.Write(w, binary.BigEndian, v)
+	}
+	w.uvarint(len(labels))
+	w.Write(labels)
+}
+
+func (w *ruleSetWriter) final(invert bool) {
+	w.WriteByte(ruleSetItemFinal)
+	if invert {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+// testRuleSet compresses the rules written by fn into a rule-set.
+func testRuleSet(n int, fn func(w *ruleSetWriter)) []byte {
+	w := &ruleSetWriter{}
+	w.uvarint(n)
+	fn(w)
+
+	b := &bytes.Buffer{}
+	b.Write(ruleSetMagic)
+	b.WriteByte(ruleSetVersion)
+	zw := zlib.NewWriter(b)
+	zw.Write(w.Bytes())
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestRuleSetRules(t *testing.T) {
+	data := testRuleSet(6, func(w *ruleSetWriter) {
+		// domain items only
+		w.WriteByte(0)
+		w.domains([]string{"www.example.com", "example.org"}, []string{"example.cn", ".example.net"})
+		w.strings(ruleSetItemDomainKeyword, "track")
+		w.strings(ruleSetItemDomainRegex, `^ad[0-9]+\.`)
+		w.final(false)
+
+		// with ports
+		w.WriteByte(0)
+		w.domains([]string{"port.example"}, nil)
+		w.WriteByte(ruleSetItemPort)
+		w.uvarint(1)
+		binary.Write(w, binary.BigEndian, uint16(443))
+		w.final(false)
+
+		// with ip ranges
+		w.WriteByte(0)
+		w.WriteByte(ruleSetItemIPCIDR)
+		w.WriteByte(1)
+		binary.Write(w, binary.BigEndian, uint64(1))
+		for _, v := range [][]byte{{192, 0, 2, 0}, {192, 0, 2, 255}} {
+			w.uvarint(len(v))
+			w.Write(v)
+		}
+		w.final(false)
+
+		// with the items of later versions
+		w.WriteByte(0)
+		w.domains([]string{"later.example"}, nil)
+		w.domainSet(ruleSetItemAdGuardDomain, []string{"^elpmaxe.sda||"})
+		w.strings(ruleSetItemProcessPathRegex, "^/usr/bin/")
+		w.WriteByte(ruleSetItemNetworkType)
+		w.uvarint(2)
+		w.Write([]byte{0, 1})
+		w.WriteByte(ruleSetItemNetworkIsExpensive)
+		w.WriteByte(ruleSetItemNetworkIsConstrained)
+		w.final(false)
+
+		// inverted
+		w.WriteByte(0)
+		w.strings(ruleSetItemDomainKeyword, "invert")
+		w.final(true)
+
+		// logical
+		w.WriteByte(1)
+		w.WriteByte(0)
+		w.uvarint(1)
+		w.WriteByte(0)
+		w.strings(ruleSetItemDomainKeyword, "logical")
+		w.final(false)
+		w.WriteByte(0)
+	})
+
+	rules, skipped, err := ruleSetRules(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(rules)
+	want := []string{"domain:example.cn", "full:example.org", "full:www.example.com", "keyword:track", `regexp:\.example\.net$`, `regexp:^ad[0-9]+\.`}
+	if !reflect.DeepEqual(rules, want) || skipped != 5 {
+		t.Errorf("rules = %q, skipped %d, want %q, 5", rules, skipped, want)
+	}
+
+	for _, b := range [][]byte{
+		[]byte("SRS"),
+		append([]byte("SRS\x09"), data[4:]...),
+		data[:len(data)-4],
+	} {
+		if _, _, err := ruleSetRules(b); err == nil {
+			t.Errorf("invalid rule-set %x is accepted", b)
+		}
+	}
+}
+
+func TestMatchGeoSite(t *testing.T) {
+	dir := t.TempDir()
+	geosite := filepath.Join(dir, "geosite.dat")
+	err := os.WriteFile(geosite, testGeoSite(map[string][]testGeoSiteDomain{
+		"CN":               {{geoSiteTypeDomain, "example.cn", nil}, {geoSiteTypePlain, "baidu", nil}},
+		"CATEGORY-ADS-ALL": {{geoSiteTypeDomain, "ads.example", []string{"ads"}}, {geoSiteTypeFull, "tracker.example", nil}},
+	}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleSet := filepath.Join(dir, "rules.srs")
+	err = os.WriteFile(ruleSet, testRuleSet(1, func(w *ruleSetWriter) {
+		w.WriteByte(0)
+		w.domains([]string{"full.example"}, []string{".sub.example"})
+		w.final(false)
+	}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &MatchGeoSite{GeoSite: geosite, Sites: []string{"geosite:cn", "geosite:category-ads-all@ads"}, RuleSets: []string{ruleSet}, lg: zap.NewNop()}
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"www.Example.CN.", true},
+		{"news.baidu.com.", true},
+		{"x.ads.example.", true},
+		{"tracker.example.", false},
+		{"full.example.", true},
+		{"www.full.example.", false},
+		{"sub.example.", false},
+		{"a.sub.example.", true},
+		{"example.com.", false},
+	} {
+		if got := m.Match(new(dns.Msg).SetQuestion(tt.name, dns.TypeA)); got != tt.want {
+			t.Errorf("match %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, m := range []*MatchGeoSite{
+		{},
+		{GeoSite: geosite},
+		{Sites: []string{"cn"}, RuleSets: []string{ruleSet}},
+		{GeoSite: geosite, Sites: []string{"us"}},
+		{RuleSets: []string{geosite}},
+	} {
+		m.lg = zap.NewNop()
+		if err := m.load(); err == nil {
+			t.Errorf("%+v is accepted", m)
+		}
+	}
+}
@@ -1,9 +1,45 @@
 package app
 
-import "github.com/miekg/dns"
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/multierr"
+)
 
 // Matcher is ...
 type Matcher interface {
 	// Match is ...
 	Match(*dns.Msg) bool
 }
+
+// ClientMatcher is a Matcher which also looks at the client of a query.
+type ClientMatcher interface {
+	Matcher
+	// MatchClient is Match for a query from c, c is nil when the client is
+	// not known.
+	MatchClient(c *Client, in *dns.Msg) bool
+}
+
+// MatchClient tells whether m matches a query from c.
+func MatchClient(m Matcher, c *Client, in *dns.Msg) bool {
+	if cm, ok := m.(ClientMatcher); ok {
+		return cm.MatchClient(c, in)
+	}
+	return m.Match(in)
+}
+
+// cleanupMatchers cleans up the matchers which need it. The caddy.Context
+// which loaded a matcher from the config cleans it up as well, so Cleanup
+// of matchers is called twice and must be idempotent. Combinators still
+// clean up their matchers for the ones which were not loaded by a context.
+func cleanupMatchers(matchers ...Matcher) error {
+	errs := []error{}
+	for _, v := range matchers {
+		if cu, ok := v.(caddy.CleanerUpper); ok {
+			if err := cu.Cleanup(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return multierr.Combine(errs...)
+}
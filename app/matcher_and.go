@@ -2,6 +2,7 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/caddyserver/caddy/v2"
 
@@ -12,8 +13,9 @@ func init() {
 	caddy.RegisterModule(MatchAnd{})
 }
 
-// MatchAnd is ...
+// MatchAnd matches the queries which all of the inner matchers match.
 type MatchAnd struct {
+	// MatchersRaw is the inner matchers, there must be at least one.
 	MatchersRaw []json.RawMessage `json:"match" caddy:"namespace=dnsproxy.matchers inline_key=matcher"`
 
 	matchers []Matcher
@@ -29,6 +31,9 @@ func (MatchAnd) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (m *MatchAnd) Provision(ctx caddy.Context) error {
+	if len(m.MatchersRaw) == 0 {
+		return errors.New("and: no matchers")
+	}
 	mods, err := ctx.LoadModule(m, "MatchersRaw")
 	if err != nil {
 		return err
@@ -41,12 +46,26 @@ func (m *MatchAnd) Provision(ctx caddy.Context) error {
 
 // Match is ...
 func (m *MatchAnd) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchAnd) MatchClient(c *Client, in *dns.Msg) bool {
 	for _, v := range m.matchers {
-		if !v.Match(in) {
+		if !MatchClient(v, c, in) {
 			return false
 		}
 	}
 	return true
 }
 
-var _ Matcher = (*MatchAnd)(nil)
+// Cleanup is ...
+func (m *MatchAnd) Cleanup() error {
+	return cleanupMatchers(m.matchers...)
+}
+
+var (
+	_ ClientMatcher      = (*MatchAnd)(nil)
+	_ caddy.CleanerUpper = (*MatchAnd)(nil)
+	_ caddy.Provisioner  = (*MatchAnd)(nil)
+)
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(MatchClientSubnet{})
+}
+
+// MatchClientSubnet matches the queries with an EDNS Client Subnet option
+// of which the address is in the ranges.
+type MatchClientSubnet struct {
+	// Ranges is the addresses and CIDRs of the matcher.
+	Ranges []string `json:"ranges,omitempty"`
+
+	prefixes []netip.Prefix
+}
+
+// CaddyModule is ...
+func (MatchClientSubnet) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.client_subnet",
+		New: func() caddy.Module { return new(MatchClientSubnet) },
+	}
+}
+
+// Provision is ...
+func (m *MatchClientSubnet) Provision(ctx caddy.Context) error {
+	if len(m.Ranges) == 0 {
+		return errors.New("client_subnet: no ranges")
+	}
+	prefixes, err := parsePrefixes(m.Ranges)
+	if err != nil {
+		return fmt.Errorf("client_subnet: %w", err)
+	}
+	m.prefixes = prefixes
+	return nil
+}
+
+// Match is ...
+func (m *MatchClientSubnet) Match(in *dns.Msg) bool {
+	ecs := ecsOption(in)
+	if ecs == nil {
+		return false
+	}
+	prefix, ok := ecsPrefix(ecs)
+	return ok && prefixesContain(m.prefixes, prefix.Addr())
+}
+
+// ecsOption returns the EDNS Client Subnet option of a message, or nil.
+func ecsOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, v := range opt.Option {
+			if ecs, ok := v.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
+
+// ecsPrefix returns the source prefix of an EDNS Client Subnet option.
+func ecsPrefix(ecs *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ecs.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	switch ecs.Family {
+	case 1:
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			return netip.Prefix{}, false
+		}
+	case 2:
+		addr = netip.AddrFrom16(addr.As16())
+	default:
+		return netip.Prefix{}, false
+	}
+	prefix, err := addr.Prefix(int(ecs.SourceNetmask))
+	return prefix, err == nil
+}
+
+var (
+	_ caddy.Provisioner = (*MatchClientSubnet)(nil)
+	_ Matcher           = (*MatchClientSubnet)(nil)
+)
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// ecsQuery is a query with an EDNS Client Subnet option of family, source
+// prefix length and address, or without one when address is empty.
+func ecsQuery(family uint16, bits uint8, address string) *dns.Msg {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	if address != "" {
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: bits,
+			Address:       net.ParseIP(address),
+		})
+	}
+	return msg
+}
+
+func TestMatchClientSubnet(t *testing.T) {
+	m := &MatchClientSubnet{Ranges: []string{"192.0.2.0/24", "2001:db8::/32"}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		msg  *dns.Msg
+		want bool
+	}{
+		{"no edns", new(dns.Msg).SetQuestion("example.com.", dns.TypeA), false},
+		{"no subnet", ecsQuery(0, 0, ""), false},
+		{"ipv4", ecsQuery(1, 24, "192.0.2.0"), true},
+		{"ipv4 outside", ecsQuery(1, 24, "198.51.100.0"), false},
+		{"ipv6", ecsQuery(2, 56, "2001:db8:1::"), true},
+		{"ipv6 outside", ecsQuery(2, 56, "2001:db9::"), false},
+		{"family mismatch", ecsQuery(2, 24, "192.0.2.0"), false},
+		{"unknown family", ecsQuery(3, 24, "192.0.2.0"), false},
+	} {
+		if got := m.Match(tt.msg); got != tt.want {
+			t.Errorf("%v: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, m := range []*MatchClientSubnet{{}, {Ranges: []string{"192.0.2.0/33"}}} {
+		if err := m.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%+v is accepted", m.Ranges)
+		}
+	}
+}
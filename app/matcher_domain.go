@@ -1,9 +1,17 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/caddyserver/caddy/v2"
 
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 
 	"github.com/imgk/caddy-dnsproxy/pkg/suffixtree"
 )
@@ -14,10 +22,33 @@ func init() {
 
 // MatchDomain is ...
 type MatchDomain struct {
-	// Domains is ...
+	// Domains is the rules of the matcher, they are matched regardless of
+	// case and internationalized domains may be given in Unicode. Rules
+	// may start with the type of the rule:
+	//
+	//   - "full:example.com" matches example.com only.
+	//   - "domain:example.com" matches example.com and its subdomains.
+	//   - "keyword:example" matches the names containing example.
+	//   - "regexp:^ad[0-9]+\." matches the names which the regular
+	//     expression matches, as in the "domain_regexp" matcher.
+	//
+	// Rules without a type are matched with the wildcard "*" for a label
+	// and "**" for any number of labels.
 	Domains []string `json:"domains,omitempty"`
+	// Files is the paths of lists of rules, with one rule per line. Lines
+	// starting with "#" are comments.
+	Files []string `json:"files,omitempty"`
+	// URLs is the HTTP(S) URLs of lists of rules, in the format of Files.
+	URLs []string `json:"urls,omitempty"`
+	// Refresh is how often Files and URLs are reloaded, they are only
+	// loaded once by default. The rules in use are kept when a reload
+	// fails.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
 
-	node *suffixtree.Node
+	rules  *atomic.Pointer[domainRules]
+	list   *ruleList
+	lg     *zap.Logger
+	cancel context.CancelFunc
 }
 
 // CaddyModule is ...
@@ -30,21 +61,168 @@ func (MatchDomain) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (m *MatchDomain) Provision(ctx caddy.Context) error {
-	m.node = suffixtree.NewNodeFromRules(m.Domains...)
+	m.lg = ctx.Logger(m)
+	return m.start()
+}
+
+func (m *MatchDomain) start() error {
+	// inline rules must be valid
+	rules := newDomainRules()
+	for _, v := range m.Domains {
+		if err := rules.add(v); err != nil {
+			return err
+		}
+	}
+
+	m.rules = &atomic.Pointer[domainRules]{}
+	m.list = newRuleList(m.Files, m.URLs)
+	if err := m.reload(context.Background()); err != nil {
+		return err
+	}
+	if m.Refresh > 0 && !m.list.empty() {
+		m.cancel = refreshLoop(time.Duration(m.Refresh), func(ctx context.Context) {
+			if err := m.reload(ctx); err != nil && ctx.Err() == nil {
+				m.lg.Error(fmt.Sprintf("matcher error: reload domain lists error: %v", err))
+			}
+		})
+	}
+	return nil
+}
+
+// reload loads the lists and swaps the rules when they changed.
+func (m *MatchDomain) reload(ctx context.Context) error {
+	data, changed, err := m.list.load(ctx)
+	if err != nil {
+		return err
+	}
+	if !changed && m.rules.Load() != nil {
+		return nil
+	}
+
+	rules := newDomainRules()
+	for _, v := range m.Domains {
+		rules.add(v)
+	}
+	invalid := 0
+	for _, v := range data {
+		ruleLines(v, func(line string) {
+			if err := rules.add(line); err != nil {
+				invalid++
+			}
+		})
+	}
+	rules.build()
+	m.rules.Store(rules)
+
+	if !m.list.empty() {
+		m.lg.Info(fmt.Sprintf("load %d domain rules", rules.size))
+	}
+	if invalid > 0 {
+		m.lg.Warn(fmt.Sprintf("skip %d invalid domain rules", invalid))
+	}
+	return nil
+}
+
+// Cleanup is ...
+func (m *MatchDomain) Cleanup() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
 	return nil
 }
 
 // Match is ...
 func (m *MatchDomain) Match(in *dns.Msg) bool {
+	rules := m.rules.Load()
 	for _, v := range in.Question {
-		if m.node.Match(v.Name) {
+		if rules.match(canonicalName(v.Name)) {
 			return true
 		}
 	}
 	return false
 }
 
+// domainRules is the rules of a domain matcher, with each type of rules in
+// an index of its own.
+type domainRules struct {
+	// full is the names of "full:" rules.
+	full map[string]struct{}
+	// wildcards is the "domain:" rules and the rules without a type, until
+	// they are built into node.
+	wildcards []string
+	node      *suffixtree.Node
+	// index is the "keyword:" and "regexp:" rules.
+	index *domainRegexp
+	// size is the number of rules.
+	size int
+}
+
+func newDomainRules() *domainRules {
+	return &domainRules{
+		full:  map[string]struct{}{},
+		index: &domainRegexp{index: map[string][]regexpLiteral{}},
+	}
+}
+
+// add adds a rule.
+func (r *domainRules) add(rule string) error {
+	typ, value, ok := strings.Cut(rule, ":")
+	if !ok {
+		typ, value = "", rule
+	}
+	switch typ {
+	case "full", "domain":
+		name, err := canonicalRule(value)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(name, "*") {
+			return fmt.Errorf("invalid domain %q: wildcard in %v rule", value, typ)
+		}
+		if typ == "full" {
+			r.full[name] = struct{}{}
+		} else {
+			r.wildcards = append(r.wildcards, "**."+name)
+		}
+	case "keyword":
+		if value == "" {
+			return errors.New("empty keyword")
+		}
+		r.index.addKeyword(strings.ToLower(value))
+	case "regexp":
+		if err := r.index.add(value); err != nil {
+			return err
+		}
+	case "":
+		name, err := canonicalRule(value)
+		if err != nil {
+			return err
+		}
+		r.wildcards = append(r.wildcards, name)
+	default:
+		return fmt.Errorf("unknown type of rule %q", rule)
+	}
+	r.size++
+	return nil
+}
+
+// build builds the index of wildcards after the rules are added.
+func (r *domainRules) build() {
+	r.node = suffixtree.NewNodeFromRules(r.wildcards...)
+	r.wildcards = nil
+}
+
+// match tells whether one of the rules matches name, which is in the form
+// of canonicalName.
+func (r *domainRules) match(name string) bool {
+	if _, ok := r.full[name]; ok {
+		return true
+	}
+	return r.node.Match(name) || r.index.match(name)
+}
+
 var (
-	_ caddy.Provisioner = (*MatchDomain)(nil)
-	_ Matcher           = (*MatchDomain)(nil)
+	_ caddy.CleanerUpper = (*MatchDomain)(nil)
+	_ caddy.Provisioner  = (*MatchDomain)(nil)
+	_ Matcher            = (*MatchDomain)(nil)
 )
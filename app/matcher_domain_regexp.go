@@ -0,0 +1,177 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(MatchDomainRegexp{})
+}
+
+// MatchDomainRegexp matches the queries for the names which one of the
+// regular expressions matches.
+type MatchDomainRegexp struct {
+	// Patterns is the regular expressions in the RE2 syntax, they are
+	// matched against the names in lower case without the trailing dot,
+	// such as "www.example.com", and are not anchored.
+	Patterns []string `json:"patterns,omitempty"`
+
+	re *domainRegexp
+}
+
+// CaddyModule is ...
+func (MatchDomainRegexp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.domain_regexp",
+		New: func() caddy.Module { return new(MatchDomainRegexp) },
+	}
+}
+
+// Provision is ...
+func (m *MatchDomainRegexp) Provision(ctx caddy.Context) error {
+	if len(m.Patterns) == 0 {
+		return errors.New("domain_regexp: no patterns")
+	}
+	re, err := newDomainRegexp(m.Patterns)
+	if err != nil {
+		return fmt.Errorf("domain_regexp: %w", err)
+	}
+	m.re = re
+	return nil
+}
+
+// Match is ...
+func (m *MatchDomainRegexp) Match(in *dns.Msg) bool {
+	for _, v := range in.Question {
+		if m.re.match(canonicalName(v.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainRegexpKey is the length of the keys of the literals of patterns.
+const domainRegexpKey = 3
+
+// domainRegexp matches names against many regular expressions at once. The
+// patterns are indexed by a literal which all their matches contain, so
+// that only the patterns whose literal is in a name are run. It is much
+// faster than one alternation of all the patterns, which the NFA of package
+// regexp runs in time proportional to the number of patterns. Keywords,
+// which match the names containing them, are indexed the same way.
+type domainRegexp struct {
+	// index is the patterns by the first bytes of their literal.
+	index map[string][]regexpLiteral
+	// others is the patterns without a literal.
+	others []*regexp.Regexp
+}
+
+// regexpLiteral is a pattern and a literal which all its matches contain,
+// the pattern is nil for a keyword.
+type regexpLiteral struct {
+	literal string
+	re      *regexp.Regexp
+}
+
+func newDomainRegexp(patterns []string) (*domainRegexp, error) {
+	d := &domainRegexp{index: map[string][]regexpLiteral{}}
+	for _, v := range patterns {
+		if err := d.add(v); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// add adds a pattern.
+func (d *domainRegexp) add(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	tree, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	literal := requiredLiteral(tree.Simplify())
+	if literal == "" {
+		d.others = append(d.others, re)
+		return nil
+	}
+	d.insert(regexpLiteral{literal: literal, re: re})
+	return nil
+}
+
+// addKeyword adds a keyword, which is not empty and in lower case.
+func (d *domainRegexp) addKeyword(keyword string) {
+	d.insert(regexpLiteral{literal: keyword})
+}
+
+func (d *domainRegexp) insert(v regexpLiteral) {
+	key := v.literal[:min(len(v.literal), domainRegexpKey)]
+	d.index[key] = append(d.index[key], v)
+}
+
+// match tells whether one of the patterns matches name.
+func (d *domainRegexp) match(name string) bool {
+	for i := range name {
+		for k := 1; k <= domainRegexpKey && i+k <= len(name); k++ {
+			for _, v := range d.index[name[i:i+k]] {
+				if strings.HasPrefix(name[i:], v.literal) && (v.re == nil || v.re.MatchString(name)) {
+					return true
+				}
+			}
+		}
+	}
+	for _, re := range d.others {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredLiteral returns the longest literal found which all the matches
+// of re contain, or an empty string.
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		s := string(re.Rune)
+		if re.Flags&syntax.FoldCase != 0 {
+			// names are in lower case
+			if !isASCII([]byte(s)) {
+				return ""
+			}
+			s = strings.ToLower(s)
+		}
+		return s
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		literal := ""
+		for _, v := range re.Sub {
+			if s := requiredLiteral(v); len(s) > len(literal) {
+				literal = s
+			}
+		}
+		return literal
+	}
+	return ""
+}
+
+var (
+	_ caddy.Provisioner = (*MatchDomainRegexp)(nil)
+	_ Matcher           = (*MatchDomainRegexp)(nil)
+)
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+func TestMatchDomainRegexp(t *testing.T) {
+	m := &MatchDomainRegexp{Patterns: []string{`^ad[0-9]+\.`, `(^|\.)track(ing)?\.`, `^[a-z]+\.example\.org$`, `(?i)^Metrics-`, `^[0-9]+$`}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"ad1.example.com.", true},
+		{"AD42.example.com.", true},
+		{"ad.example.com.", false},
+		{"bad1.example.com.", false},
+		{"tracking.example.com.", true},
+		{"a.track.example.com.", true},
+		{"sidetrack.example.com.", false},
+		{"www.example.org.", true},
+		{"www.example.org.uk.", false},
+		{"a.www.example.org.", false},
+		{"w1.example.org.", false},
+		{"metrics-eu.example.net.", true},
+		{"12345.", true},
+		{"12345.example.", false},
+	} {
+		if got := m.Match(new(dns.Msg).SetQuestion(tt.name, dns.TypeA)); got != tt.want {
+			t.Errorf("match %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, patterns := range [][]string{nil, {`a(`}, {`a`, `)b(`}} {
+		if err := (&MatchDomainRegexp{Patterns: patterns}).Provision(caddy.Context{}); err == nil {
+			t.Errorf("patterns %q are accepted", patterns)
+		}
+	}
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		want    string
+	}{
+		{`^ad[0-9]+\.`, "ad"},
+		{`(^|\.)tracking\.`, "tracking."},
+		{`^[a-z]+\.example\.org$`, ".example.org"},
+		{`(?i)^Metrics`, "metrics"},
+		{`(?:ab){2,}`, "ab"},
+		{`(ab)*c`, "c"},
+		{`ads|track`, ""},
+		{`.*`, ""},
+	} {
+		tree, err := syntax.Parse(tt.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requiredLiteral(tree.Simplify()); got != tt.want {
+			t.Errorf("literal of %v = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// benchmarkPatterns returns n patterns in the style of tracking blocklists.
+func benchmarkPatterns(n int) []string {
+	patterns := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf(`^ad[0-9]+\.site%d\.example$`, i))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf(`(^|\.)track%d\.`, i))
+		case 2:
+			patterns = append(patterns, fmt.Sprintf(`^metrics-[a-z]+\.cdn%d\.example\.net$`, i))
+		default:
+			patterns = append(patterns, fmt.Sprintf(`^(pixel|beacon)%d[a-z]*\.`, i))
+		}
+	}
+	return patterns
+}
+
+func BenchmarkMatchDomainRegexp(b *testing.B) {
+	names := []string{"www.example.com", "ad12.site0.example", "a.b.track1.example.org", "metrics-eu.cdn2.example.net", "beacon3x.example.com"}
+	for _, n := range []int{10, 100, 1000} {
+		patterns := benchmarkPatterns(n)
+
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			d, err := newDomainRegexp(patterns)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.match(names[i%len(names)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("alternation/%d", n), func(b *testing.B) {
+			re := regexp.MustCompile("(?:" + strings.Join(patterns, ")|(?:") + ")")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				re.MatchString(names[i%len(names)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("separate/%d", n), func(b *testing.B) {
+			res := make([]*regexp.Regexp, 0, n)
+			for _, v := range patterns {
+				res = append(res, regexp.MustCompile(v))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				name := names[i%len(names)]
+				for _, re := range res {
+					if re.MatchString(name) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestMatchDomain(t *testing.T) {
+	m := &MatchDomain{Domains: []string{"Example.COM", "**.bücher.example", `a\.b.example.org`}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com.", true},
+		{"EXAMPLE.com.", true},
+		{"eXaMpLe.CoM.", true},
+		{"www.example.com.", false},
+		{"xn--bcher-kva.example.", true},
+		{"WWW.XN--BCHER-KVA.example.", true},
+		{"bucher.example.", false},
+		{`a\.b.example.org.`, true},
+		{`A\046B.example.org.`, true},
+		{"a.b.example.org.", false},
+	} {
+		if got := m.Match(new(dns.Msg).SetQuestion(tt.name, dns.TypeA)); got != tt.want {
+			t.Errorf("match %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if err := (&MatchDomain{Domains: []string{"a..example.com"}}).Provision(caddy.Context{}); err == nil {
+		t.Errorf("invalid domain is accepted")
+	}
+}
+
+func TestMatchDomain_Lists(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "rules.txt")
+	writeRuleFile(t, name, "# blocked\n**.example.com\ninvalid..rule\n", time.Now().Add(-time.Hour))
+	s, url := newRuleServer(t, "example.org\n")
+	m := &MatchDomain{Domains: []string{"example.net"}, Files: []string{name}, URLs: []string{url}, lg: zap.NewNop()}
+	if err := m.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	match := func(want map[string]bool) {
+		t.Helper()
+		for name, v := range want {
+			if got := m.Match(new(dns.Msg).SetQuestion(name, dns.TypeA)); got != v {
+				t.Errorf("match %v = %v, want %v", name, got, v)
+			}
+		}
+	}
+	match(map[string]bool{"example.net.": true, "www.example.com.": true, "example.org.": true, "example.edu.": false})
+
+	// the rules are swapped when a list changes
+	ctx := context.Background()
+	s.set("example.edu\n", http.StatusOK)
+	if err := m.reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	match(map[string]bool{"example.net.": true, "www.example.com.": true, "example.org.": false, "example.edu.": true})
+
+	// and kept when a reload fails
+	s.set("", http.StatusNotFound)
+	if err := m.reload(ctx); err == nil {
+		t.Errorf("failed reload is not an error")
+	}
+	match(map[string]bool{"example.net.": true, "www.example.com.": true, "example.edu.": true})
+
+	// a list which can not be loaded fails provisioning
+	if err := (&MatchDomain{Files: []string{name + ".missing"}, lg: zap.NewNop()}).start(); err == nil {
+		t.Errorf("missing list is accepted")
+	}
+}
+
+func TestMatchDomain_Refresh(t *testing.T) {
+	s, url := newRuleServer(t, "example.org\n")
+	m := &MatchDomain{URLs: []string{url}, Refresh: caddy.Duration(10 * time.Millisecond), lg: zap.NewNop()}
+	if err := m.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	s.set("example.com\n", http.StatusOK)
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	for deadline := time.Now().Add(5 * time.Second); !m.Match(msg); {
+		if time.Now().After(deadline) {
+			t.Fatal("rules are not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMatchDomain_Types(t *testing.T) {
+	m := &MatchDomain{Domains: []string{
+		"full:Full.example",
+		"domain:suffix.example",
+		"keyword:Track",
+		`regexp:^ad[0-9]+\.`,
+		"*.wild.example",
+	}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"full.example.", true},
+		{"www.full.example.", false},
+		{"suffix.example.", true},
+		{"a.b.suffix.example.", true},
+		{"notsuffix.example.", false},
+		{"tracker.example.com.", true},
+		{"a.sidetrack.example.", true},
+		{"ad1.example.com.", true},
+		{"bad1.example.com.", false},
+		{"www.wild.example.", true},
+		{"wild.example.", false},
+		{"example.com.", false},
+	} {
+		if got := m.Match(new(dns.Msg).SetQuestion(tt.name, dns.TypeA)); got != tt.want {
+			t.Errorf("match %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, rule := range []string{"keyword:", "regexp:a(", "full:*.example.com", "domain:a..b", "geoip:cn"} {
+		if err := (&MatchDomain{Domains: []string{rule}}).Provision(caddy.Context{}); err == nil {
+			t.Errorf("rule %q is accepted", rule)
+		}
+	}
+}
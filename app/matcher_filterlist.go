@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MatchFilterList{})
+}
+
+// MatchFilterList matches the queries blocked by filter lists in the
+// AdGuard DNS filtering syntax or the hosts format, so that community
+// blocklists can be used as they are.
+//
+// The rules "||example.org^", "||*.example.org^" and "|example.org^" match
+// a domain with its subdomains, the subdomains only and the domain only.
+// Exceptions start with "@@", and the modifiers $important, $client with
+// addresses and CIDRs and $dnstype are supported. Hosts lines such as
+// "0.0.0.0 ads.example" match the names exactly, whatever the address.
+// Other rules are skipped.
+type MatchFilterList struct {
+	// Rules is the rules of the matcher.
+	Rules []string `json:"rules,omitempty"`
+	// Files is the paths of filter lists.
+	Files []string `json:"files,omitempty"`
+	// URLs is the HTTP(S) URLs of filter lists.
+	URLs []string `json:"urls,omitempty"`
+	// Refresh is how often Files and URLs are reloaded, they are only
+	// loaded once by default. The rules in use are kept when a reload
+	// fails.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+	// Log logs the queries decided by a rule, with the rule.
+	Log bool `json:"log,omitempty"`
+
+	filters *atomic.Pointer[filterList]
+	list    *ruleList
+	lg      *zap.Logger
+	cancel  context.CancelFunc
+}
+
+// CaddyModule is ...
+func (MatchFilterList) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.filterlist",
+		New: func() caddy.Module { return new(MatchFilterList) },
+	}
+}
+
+// Provision is ...
+func (m *MatchFilterList) Provision(ctx caddy.Context) error {
+	m.lg = ctx.Logger(m)
+	return m.start()
+}
+
+func (m *MatchFilterList) start() error {
+	// inline rules must be supported
+	l := newFilterList()
+	for _, v := range m.Rules {
+		if err := l.add(v); err != nil {
+			return fmt.Errorf("filterlist: rule %q: %w", v, err)
+		}
+	}
+
+	m.filters = &atomic.Pointer[filterList]{}
+	m.list = newRuleList(m.Files, m.URLs)
+	if err := m.reload(context.Background()); err != nil {
+		return err
+	}
+	if m.Refresh > 0 && !m.list.empty() {
+		m.cancel = refreshLoop(time.Duration(m.Refresh), func(ctx context.Context) {
+			if err := m.reload(ctx); err != nil && ctx.Err() == nil {
+				m.lg.Error(fmt.Sprintf("matcher error: reload filter lists error: %v", err))
+			}
+		})
+	}
+	return nil
+}
+
+// reload loads the lists and swaps the rules when they changed.
+func (m *MatchFilterList) reload(ctx context.Context) error {
+	data, changed, err := m.list.load(ctx)
+	if err != nil {
+		return err
+	}
+	if !changed && m.filters.Load() != nil {
+		return nil
+	}
+
+	l := newFilterList()
+	for _, v := range m.Rules {
+		l.add(v)
+	}
+	skipped := 0
+	for _, v := range data {
+		listLines(v, func(line string) {
+			if err := l.add(line); err != nil {
+				skipped++
+			}
+		})
+	}
+	m.filters.Store(l)
+
+	if !m.list.empty() {
+		m.lg.Info(fmt.Sprintf("load %d filter rules", l.size))
+	}
+	if skipped > 0 {
+		m.lg.Warn(fmt.Sprintf("skip %d unsupported filter rules", skipped))
+	}
+	return nil
+}
+
+// Cleanup is ...
+func (m *MatchFilterList) Cleanup() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	return nil
+}
+
+// Match is ...
+func (m *MatchFilterList) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchFilterList) MatchClient(c *Client, in *dns.Msg) bool {
+	rule, blocked := m.MatchRule(c, in)
+	if m.Log && rule != "" {
+		name, addr := in.Question[0].Name, net.Addr(nil)
+		if c != nil {
+			addr = c.Addr
+		}
+		action := "allowed"
+		if blocked {
+			action = "blocked"
+		}
+		m.lg.Info(fmt.Sprintf("filterlist: query %v from %v %v by rule %q", name, addr, action, rule))
+	}
+	return blocked
+}
+
+// MatchRule returns the rule deciding a query from c, which is an exception
+// when the query is not blocked, and rule is empty when no rule applies.
+func (m *MatchFilterList) MatchRule(c *Client, in *dns.Msg) (rule string, blocked bool) {
+	ip := netip.Addr{}
+	if c != nil && c.Addr != nil {
+		ip = addrIP(c.Addr)
+	}
+	l := m.filters.Load()
+	for _, v := range in.Question {
+		r := l.match(canonicalName(v.Name), v.Qtype, ip)
+		switch {
+		case r == nil:
+		case !r.allow:
+			return r.text, true
+		case rule == "":
+			rule = r.text
+		}
+	}
+	return rule, false
+}
+
+var (
+	_ ClientMatcher      = (*MatchFilterList)(nil)
+	_ caddy.CleanerUpper = (*MatchFilterList)(nil)
+	_ caddy.Provisioner  = (*MatchFilterList)(nil)
+)
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestMatchFilterList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "filter.txt")
+	list := "! Title: test\n||ads.example^\n@@||good.ads.example^\n0.0.0.0 hosts.example\nexample.org##.banner\n"
+	if err := os.WriteFile(name, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &MatchFilterList{Rules: []string{"||lan.example^$client=192.168.0.0/16"}, Files: []string{name}, lg: zap.NewNop()}
+	if err := m.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	lan := &Client{Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 53}}
+	for _, tt := range []struct {
+		name    string
+		client  *Client
+		rule    string
+		blocked bool
+	}{
+		{"www.ads.example.", nil, "||ads.example^", true},
+		{"GOOD.ads.example.", nil, "@@||good.ads.example^", false},
+		{"hosts.example.", nil, "0.0.0.0 hosts.example", true},
+		{"example.org.", nil, "", false},
+		{"lan.example.", nil, "", false},
+		{"lan.example.", lan, "||lan.example^$client=192.168.0.0/16", true},
+	} {
+		msg := new(dns.Msg).SetQuestion(tt.name, dns.TypeA)
+		if rule, blocked := m.MatchRule(tt.client, msg); rule != tt.rule || blocked != tt.blocked {
+			t.Errorf("match %v = %q, %v, want %q, %v", tt.name, rule, blocked, tt.rule, tt.blocked)
+		}
+	}
+
+	// the client is passed through the combinators
+	not := &MatchNot{matcher: &MatchAnd{matchers: []Matcher{m}}}
+	msg := new(dns.Msg).SetQuestion("lan.example.", dns.TypeA)
+	if !not.Match(msg) || MatchClient(not, lan, msg) {
+		t.Errorf("client is not passed to the filter list")
+	}
+
+	if err := (&MatchFilterList{Rules: []string{"||example.org^$redirect"}, lg: zap.NewNop()}).start(); err == nil {
+		t.Errorf("unsupported rule is accepted")
+	}
+}
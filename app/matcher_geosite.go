@@ -0,0 +1,117 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MatchGeoSite{})
+}
+
+// MatchGeoSite matches the queries for the domains of sites of a V2Ray
+// geosite.dat file or of sing-box binary rule-sets.
+type MatchGeoSite struct {
+	// GeoSite is the path of a geosite.dat file.
+	GeoSite string `json:"geosite,omitempty"`
+	// Sites is the sites of GeoSite to match, such as "geosite:cn", or
+	// "geosite:category-ads-all@ads" for the domains of a site with the
+	// attribute "ads". The prefix "geosite:" is optional.
+	Sites []string `json:"sites,omitempty"`
+	// RuleSets is the paths of .srs rule-sets, of which the rules with
+	// domain items only are matched.
+	RuleSets []string `json:"rule_sets,omitempty"`
+
+	rules *domainRules
+	lg    *zap.Logger
+}
+
+// CaddyModule is ...
+func (MatchGeoSite) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.geosite",
+		New: func() caddy.Module { return new(MatchGeoSite) },
+	}
+}
+
+// Provision is ...
+func (m *MatchGeoSite) Provision(ctx caddy.Context) error {
+	m.lg = ctx.Logger(m)
+	return m.load()
+}
+
+func (m *MatchGeoSite) load() error {
+	switch {
+	case m.GeoSite == "" && len(m.RuleSets) == 0:
+		return errors.New("geosite: no geosite or rule_sets")
+	case m.GeoSite == "" && len(m.Sites) > 0:
+		return errors.New("geosite: sites without geosite")
+	case m.GeoSite != "" && len(m.Sites) == 0:
+		return errors.New("geosite: no sites")
+	}
+
+	all := []string{}
+	if m.GeoSite != "" {
+		data, err := os.ReadFile(m.GeoSite)
+		if err != nil {
+			return fmt.Errorf("geosite: %w", err)
+		}
+		rules, err := geoSiteRules(data, m.Sites)
+		if err != nil {
+			return fmt.Errorf("geosite: load %v: %w", m.GeoSite, err)
+		}
+		all = append(all, rules...)
+	}
+	skipped := 0
+	for _, v := range m.RuleSets {
+		data, err := os.ReadFile(v)
+		if err != nil {
+			return fmt.Errorf("geosite: %w", err)
+		}
+		rules, n, err := ruleSetRules(data)
+		if err != nil {
+			return fmt.Errorf("geosite: load %v: %w", v, err)
+		}
+		all = append(all, rules...)
+		skipped += n
+	}
+
+	m.rules = newDomainRules()
+	invalid := 0
+	for _, v := range all {
+		if err := m.rules.add(v); err != nil {
+			invalid++
+		}
+	}
+	m.rules.build()
+
+	m.lg.Info(fmt.Sprintf("load %d domain rules", m.rules.size))
+	if skipped > 0 {
+		m.lg.Warn(fmt.Sprintf("skip %d rule-set rules which are not for domains only", skipped))
+	}
+	if invalid > 0 {
+		m.lg.Warn(fmt.Sprintf("skip %d invalid domain rules", invalid))
+	}
+	return nil
+}
+
+// Match is ...
+func (m *MatchGeoSite) Match(in *dns.Msg) bool {
+	for _, v := range in.Question {
+		if m.rules.match(canonicalName(v.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ caddy.Provisioner = (*MatchGeoSite)(nil)
+	_ Matcher           = (*MatchGeoSite)(nil)
+)
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(MatchListener{})
+}
+
+// MatchListener matches the queries which arrived on one of the listeners,
+// named by the name of the server options, which is the server type by
+// default, or by the name of the DoH handler, which is the name of the
+// http server by default.
+type MatchListener struct {
+	// Listeners is the listener names of the matcher.
+	Listeners []string `json:"listeners,omitempty"`
+}
+
+// CaddyModule is ...
+func (MatchListener) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.listener",
+		New: func() caddy.Module { return new(MatchListener) },
+	}
+}
+
+// Provision is ...
+func (m *MatchListener) Provision(ctx caddy.Context) error {
+	if len(m.Listeners) == 0 {
+		return errors.New("listener: no listeners")
+	}
+	return nil
+}
+
+// Match is ...
+func (m *MatchListener) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchListener) MatchClient(c *Client, in *dns.Msg) bool {
+	return c != nil && c.Listener != "" && slices.Contains(m.Listeners, c.Listener)
+}
+
+var (
+	_ caddy.Provisioner = (*MatchListener)(nil)
+	_ ClientMatcher     = (*MatchListener)(nil)
+)
@@ -2,6 +2,7 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/caddyserver/caddy/v2"
 
@@ -12,8 +13,9 @@ func init() {
 	caddy.RegisterModule(MatchNot{})
 }
 
-// MatchNot is ...
+// MatchNot matches the queries which the inner matcher does not match.
 type MatchNot struct {
+	// MatcherRaw is the inner matcher.
 	MatcherRaw json.RawMessage `json:"match" caddy:"namespace=dnsproxy.matchers inline_key=matcher"`
 
 	matcher Matcher
@@ -29,6 +31,9 @@ func (MatchNot) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (m *MatchNot) Provision(ctx caddy.Context) error {
+	if len(m.MatcherRaw) == 0 {
+		return errors.New("not: no matcher")
+	}
 	mod, err := ctx.LoadModule(m, "MatcherRaw")
 	if err != nil {
 		return err
@@ -38,8 +43,22 @@ func (m *MatchNot) Provision(ctx caddy.Context) error {
 }
 
 // Match is ...
-func (*MatchNot) Match(_ *dns.Msg) bool {
-	return true
+func (m *MatchNot) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchNot) MatchClient(c *Client, in *dns.Msg) bool {
+	return !MatchClient(m.matcher, c, in)
 }
 
-var _ Matcher = (*MatchNot)(nil)
+// Cleanup is ...
+func (m *MatchNot) Cleanup() error {
+	return cleanupMatchers(m.matcher)
+}
+
+var (
+	_ ClientMatcher      = (*MatchNot)(nil)
+	_ caddy.CleanerUpper = (*MatchNot)(nil)
+	_ caddy.Provisioner  = (*MatchNot)(nil)
+)
@@ -2,6 +2,7 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/caddyserver/caddy/v2"
 
@@ -12,8 +13,9 @@ func init() {
 	caddy.RegisterModule(MatchOr{})
 }
 
-// MatchOr is ...
+// MatchOr matches the queries which any of the inner matchers matches.
 type MatchOr struct {
+	// MatchersRaw is the inner matchers, there must be at least one.
 	MatchersRaw []json.RawMessage `json:"match" caddy:"namespace=dnsproxy.matchers inline_key=matcher"`
 
 	matchers []Matcher
@@ -29,6 +31,9 @@ func (MatchOr) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (m *MatchOr) Provision(ctx caddy.Context) error {
+	if len(m.MatchersRaw) == 0 {
+		return errors.New("or: no matchers")
+	}
 	mods, err := ctx.LoadModule(m, "MatchersRaw")
 	if err != nil {
 		return err
@@ -41,12 +46,26 @@ func (m *MatchOr) Provision(ctx caddy.Context) error {
 
 // Match is ...
 func (m *MatchOr) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchOr) MatchClient(c *Client, in *dns.Msg) bool {
 	for _, v := range m.matchers {
-		if v.Match(in) {
+		if MatchClient(v, c, in) {
 			return true
 		}
 	}
 	return false
 }
 
-var _ Matcher = (*MatchOr)(nil)
+// Cleanup is ...
+func (m *MatchOr) Cleanup() error {
+	return cleanupMatchers(m.matchers...)
+}
+
+var (
+	_ ClientMatcher      = (*MatchOr)(nil)
+	_ caddy.CleanerUpper = (*MatchOr)(nil)
+	_ caddy.Provisioner  = (*MatchOr)(nil)
+)
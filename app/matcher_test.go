@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+func TestMatcherCombinators(t *testing.T) {
+	domain := &MatchDomain{Domains: []string{"**.example.com"}}
+	typeA := &MatchType{Types: []string{"A"}}
+	for _, m := range []caddy.Provisioner{domain, typeA} {
+		if err := m.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	not := func(m Matcher) Matcher { return &MatchNot{matcher: m} }
+	and := func(ms ...Matcher) Matcher { return &MatchAnd{matchers: ms} }
+	or := func(ms ...Matcher) Matcher { return &MatchOr{matchers: ms} }
+
+	queries := []*dns.Msg{
+		new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("www.example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("example.org.", dns.TypeA),
+		new(dns.Msg).SetQuestion("example.org.", dns.TypeAAAA),
+	}
+	for _, tt := range []struct {
+		name    string
+		matcher Matcher
+		want    []bool
+	}{
+		{"domain", domain, []bool{true, true, false, false}},
+		{"not", not(domain), []bool{false, false, true, true}},
+		{"not all", not(&MatchAll{}), []bool{false, false, false, false}},
+		{"not not", not(not(domain)), []bool{true, true, false, false}},
+		{"and", and(domain, typeA), []bool{true, false, false, false}},
+		{"and single", and(typeA), []bool{true, false, true, false}},
+		{"or", or(domain, typeA), []bool{true, true, true, false}},
+		{"or single", or(domain), []bool{true, true, false, false}},
+		{"not and", not(and(domain, typeA)), []bool{false, true, true, true}},
+		{"not or", not(or(domain, typeA)), []bool{false, false, false, true}},
+		{"and not", and(not(domain), typeA), []bool{false, false, true, false}},
+		{"or and not", or(and(domain, not(typeA)), and(not(domain), typeA)), []bool{false, true, true, false}},
+		{"and or not", and(or(domain, typeA), not(and(domain, typeA))), []bool{false, true, true, false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, q := range queries {
+				if got := tt.matcher.Match(q); got != tt.want[i] {
+					t.Errorf("match %v %v = %v, want %v", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype], got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMatcherCombinators_Provision(t *testing.T) {
+	for _, m := range []caddy.Provisioner{
+		&MatchNot{},
+		&MatchAnd{},
+		&MatchAnd{MatchersRaw: []json.RawMessage{}},
+		&MatchOr{},
+		&MatchOr{MatchersRaw: []json.RawMessage{}},
+	} {
+		if err := m.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%T without matchers is accepted", m)
+		}
+	}
+}
+
+// cleanupMatcher counts its cleanups.
+type cleanupMatcher struct {
+	n   *int
+	err error
+}
+
+func (m cleanupMatcher) Match(*dns.Msg) bool { return true }
+
+func (m cleanupMatcher) Cleanup() error {
+	*m.n++
+	return m.err
+}
+
+func TestMatcherCombinators_Cleanup(t *testing.T) {
+	n := 0
+	errCleanup := errors.New("cleanup error")
+	m := &MatchNot{matcher: &MatchAnd{matchers: []Matcher{
+		cleanupMatcher{n: &n},
+		&MatchAll{},
+		&MatchOr{matchers: []Matcher{cleanupMatcher{n: &n, err: errCleanup}, cleanupMatcher{n: &n}}},
+	}}}
+	if err := m.Cleanup(); !errors.Is(err, errCleanup) {
+		t.Errorf("error = %v, want %v", err, errCleanup)
+	}
+	if n != 3 {
+		t.Errorf("cleanups = %d, want 3", n)
+	}
+}
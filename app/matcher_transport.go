@@ -0,0 +1,63 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(MatchTransport{})
+}
+
+// transports are the transports of Client.
+var transports = []string{"udp", "tcp", "tls", "quic", "dnscrypt", "https"}
+
+// MatchTransport matches the queries which arrived over one of the
+// transports: "udp", "tcp", "tls" (DNS over TLS), "quic" (DNS over QUIC),
+// "dnscrypt" or "https" (DNS over HTTPS). Queries from unknown clients
+// are not matched.
+type MatchTransport struct {
+	// Transports is the transports of the matcher.
+	Transports []string `json:"transports,omitempty"`
+}
+
+// CaddyModule is ...
+func (MatchTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.matchers.transport",
+		New: func() caddy.Module { return new(MatchTransport) },
+	}
+}
+
+// Provision is ...
+func (m *MatchTransport) Provision(ctx caddy.Context) error {
+	if len(m.Transports) == 0 {
+		return errors.New("transport: no transports")
+	}
+	for _, v := range m.Transports {
+		if !slices.Contains(transports, v) {
+			return fmt.Errorf("transport: unknown transport %q", v)
+		}
+	}
+	return nil
+}
+
+// Match is ...
+func (m *MatchTransport) Match(in *dns.Msg) bool {
+	return m.MatchClient(nil, in)
+}
+
+// MatchClient is Match for a query from c.
+func (m *MatchTransport) MatchClient(c *Client, in *dns.Msg) bool {
+	return c != nil && slices.Contains(m.Transports, c.Transport)
+}
+
+var (
+	_ caddy.Provisioner = (*MatchTransport)(nil)
+	_ ClientMatcher     = (*MatchTransport)(nil)
+)
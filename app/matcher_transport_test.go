@@ -0,0 +1,84 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+func TestMatchTransport(t *testing.T) {
+	transport := &MatchTransport{Transports: []string{"tls", "quic", "https"}}
+	listener := &MatchListener{Listeners: []string{"udp", "srv0"}}
+	for _, m := range []caddy.Provisioner{transport, listener} {
+		if err := m.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	for _, tt := range []struct {
+		name      string
+		c         *Client
+		transport bool
+		listener  bool
+	}{
+		{"unknown client", nil, false, false},
+		{"udp", &Client{Transport: "udp", Listener: "udp", UDP: true}, false, true},
+		{"tcp", &Client{Transport: "tcp", Listener: "tcp"}, false, false},
+		{"tls", &Client{Transport: "tls", Listener: "tls"}, true, false},
+		{"quic", &Client{Transport: "quic", Listener: "quic"}, true, false},
+		{"https", &Client{Transport: "https", Listener: "srv0"}, true, true},
+		{"no listener", &Client{Transport: "dnscrypt"}, false, false},
+	} {
+		if got := MatchClient(transport, tt.c, q); got != tt.transport {
+			t.Errorf("%v: transport match = %v, want %v", tt.name, got, tt.transport)
+		}
+		if got := MatchClient(listener, tt.c, q); got != tt.listener {
+			t.Errorf("%v: listener match = %v, want %v", tt.name, got, tt.listener)
+		}
+	}
+
+	for _, m := range []caddy.Provisioner{
+		&MatchTransport{},
+		&MatchTransport{Transports: []string{"doh"}},
+		&MatchListener{},
+	} {
+		if err := m.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%+v is accepted", m)
+		}
+	}
+}
+
+func TestApp_ExchangeTransport(t *testing.T) {
+	refuse := upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		return new(dns.Msg).SetRcode(in, dns.RcodeRefused), nil
+	})
+	app := &App{handlers: []Handler{
+		{
+			Upstream: refuse,
+			Matchers: []Matcher{&MatchAnd{matchers: []Matcher{
+				&MatchTransport{Transports: []string{"udp"}},
+				&MatchType{typeList: []uint16{dns.TypeANY}},
+			}}},
+		},
+		{Upstream: echoUpstream, Matchers: []Matcher{&MatchAll{}}},
+	}}
+	for _, tt := range []struct {
+		transport string
+		qtype     uint16
+		want      int
+	}{
+		{"udp", dns.TypeANY, dns.RcodeRefused},
+		{"udp", dns.TypeA, dns.RcodeSuccess},
+		{"tcp", dns.TypeANY, dns.RcodeSuccess},
+	} {
+		out, err := app.ExchangeClient(&Client{Transport: tt.transport}, new(dns.Msg).SetQuestion("example.com.", tt.qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Rcode != tt.want {
+			t.Errorf("%v %v: rcode = %v, want %v", tt.transport, dns.TypeToString[tt.qtype], dns.RcodeToString[out.Rcode], dns.RcodeToString[tt.want])
+		}
+	}
+}
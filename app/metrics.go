@@ -0,0 +1,51 @@
+package app
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "dnsproxy"
+)
+
+// registerCounterVec registers a counter in the metrics registry of ctx, or
+// returns the one registered before by another module.
+func registerCounterVec(ctx caddy.Context, c *prometheus.CounterVec) *prometheus.CounterVec {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return c
+	}
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(*prometheus.CounterVec); ok {
+				return existing
+			}
+		}
+	}
+	return c
+}
+
+// rateLimitedQueries counts the queries over a rate limit.
+func rateLimitedQueries(ctx caddy.Context) *prometheus.CounterVec {
+	return registerCounterVec(ctx, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "rate_limited_queries_total",
+		Help:      "Number of queries over a rate limit.",
+	}, []string{"transport", "action"}))
+}
+
+// rrlResponses counts the responses over a response rate limit.
+func rrlResponses(ctx caddy.Context) *prometheus.CounterVec {
+	return registerCounterVec(ctx, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "rrl_responses_total",
+		Help:      "Number of responses over a response rate limit.",
+	}, []string{"action"}))
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	caddy.RegisterModule(RateLimiter{})
+}
+
+// Actions of RateLimit.
+const (
+	// RateLimitDrop does not answer queries over the limit.
+	RateLimitDrop = "drop"
+	// RateLimitRefuse answers queries over the limit with REFUSED.
+	RateLimitRefuse = "refuse"
+	// RateLimitTruncate answers queries over the limit with an empty
+	// truncated response, so that the client retries over TCP. Queries
+	// which do not arrive over UDP are refused.
+	RateLimitTruncate = "truncate"
+)
+
+// rateLimitSweep is how often buckets of clients which are back to the
+// burst size are removed.
+const rateLimitSweep = time.Minute
+
+// RateLimit limits the queries of every client with a token bucket.
+type RateLimit struct {
+	// Rate is the number of queries per second of a client.
+	Rate float64 `json:"rate,omitempty"`
+	// Burst is the number of queries a client can send at once, Rate by
+	// default.
+	Burst int `json:"burst,omitempty"`
+	// IPv4Prefix is the prefix length clients are grouped by, such as 24
+	// to limit /24 networks as a whole. It is 32 by default.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by, such as
+	// 56. It is 128 by default.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// Action is "drop", "refuse" or "truncate", "drop" by default.
+	Action string `json:"action,omitempty"`
+	// ExemptCookies does not limit clients presenting a valid server
+	// cookie.
+	ExemptCookies bool `json:"exempt_cookies,omitempty"`
+}
+
+// RateLimiter limits the queries to the next upstream.
+type RateLimiter struct {
+	RateLimit
+	// UpstreamRaw is the upstream asked when the client is within the
+	// limit.
+	UpstreamRaw json.RawMessage `json:"next" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+
+	upstream Upstream
+	limited  *prometheus.CounterVec
+	buckets  *buckets
+}
+
+// CaddyModule is ...
+func (RateLimiter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.upstreams.rate_limit",
+		New: func() caddy.Module { return new(RateLimiter) },
+	}
+}
+
+// Provision is ...
+func (m *RateLimiter) Provision(ctx caddy.Context) error {
+	mod, err := ctx.LoadModule(m, "UpstreamRaw")
+	if err != nil {
+		return err
+	}
+	m.upstream = mod.(Upstream)
+	return m.provision(ctx)
+}
+
+// upstream limits the queries to up, it is up itself without limit.
+func (r *RateLimit) upstream(ctx caddy.Context, up Upstream) (Upstream, error) {
+	if r == nil {
+		return up, nil
+	}
+	m := &RateLimiter{RateLimit: *r, upstream: up}
+	if err := m.provision(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *RateLimiter) provision(ctx caddy.Context) error {
+	if m.Rate <= 0 {
+		return errors.New("rate_limit: rate must be positive")
+	}
+	if m.Burst <= 0 {
+		m.Burst = max(int(m.Rate), 1)
+	}
+	if m.IPv4Prefix == 0 {
+		m.IPv4Prefix = 32
+	}
+	if m.IPv6Prefix == 0 {
+		m.IPv6Prefix = 128
+	}
+	if m.IPv4Prefix < 0 || m.IPv4Prefix > 32 || m.IPv6Prefix < 0 || m.IPv6Prefix > 128 {
+		return fmt.Errorf("rate_limit: invalid prefix length %d or %d", m.IPv4Prefix, m.IPv6Prefix)
+	}
+	switch m.Action {
+	case "":
+		m.Action = RateLimitDrop
+	case RateLimitDrop, RateLimitRefuse, RateLimitTruncate:
+	default:
+		return fmt.Errorf("rate_limit: unknown action %q", m.Action)
+	}
+
+	m.limited = rateLimitedQueries(ctx)
+	m.buckets = &buckets{m: map[netip.Prefix]*bucket{}}
+	return nil
+}
+
+// Exchange is ...
+func (m *RateLimiter) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return m.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c. Queries of unknown clients
+// are not limited.
+func (m *RateLimiter) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	if c == nil || c.Addr == nil || (c.Cookie && m.ExemptCookies) || m.allow(addrIP(c.Addr), time.Now()) {
+		return ExchangeClient(m.upstream, c, in)
+	}
+
+	action := m.Action
+	if action == RateLimitTruncate && !c.UDP {
+		action = RateLimitRefuse
+	}
+	m.limited.WithLabelValues(c.Transport, action).Inc()
+
+	switch action {
+	case RateLimitRefuse:
+		return new(dns.Msg).SetRcode(in, dns.RcodeRefused), nil
+	case RateLimitTruncate:
+		out := new(dns.Msg).SetReply(in)
+		out.Truncated = true
+		return out, nil
+	default:
+		return nil, ErrDropped
+	}
+}
+
+// allow takes a token from the bucket of the client.
+func (m *RateLimiter) allow(ip netip.Addr, now time.Time) bool {
+	if !ip.IsValid() {
+		return true
+	}
+	bits := m.IPv4Prefix
+	if ip.Is6() {
+		bits = m.IPv6Prefix
+	}
+	key, _ := ip.Prefix(bits)
+
+	m.buckets.mu.Lock()
+	defer m.buckets.mu.Unlock()
+
+	if now.Sub(m.buckets.sweep) > rateLimitSweep {
+		for k, b := range m.buckets.m {
+			if b.refill(now, m.Rate, m.Burst) == float64(m.Burst) {
+				delete(m.buckets.m, k)
+			}
+		}
+		m.buckets.sweep = now
+	}
+
+	b, ok := m.buckets.m[key]
+	if !ok {
+		b = &bucket{tokens: float64(m.Burst), last: now}
+		m.buckets.m[key] = b
+	}
+	if b.refill(now, m.Rate, m.Burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// buckets is the token buckets of clients by prefix.
+type buckets struct {
+	mu    sync.Mutex
+	m     map[netip.Prefix]*bucket
+	sweep time.Time
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) float64 {
+	if now.After(b.last) {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(burst))
+		b.last = now
+	}
+	return b.tokens
+}
+
+var (
+	_ ClientUpstream    = (*RateLimiter)(nil)
+	_ caddy.Provisioner = (*RateLimiter)(nil)
+)
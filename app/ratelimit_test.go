@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func newTestRateLimiter(t *testing.T, r RateLimit) *RateLimiter {
+	up, err := r.upstream(caddy.Context{}, echoUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return up.(*RateLimiter)
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		limit   RateLimit
+		clients []string
+		after   time.Duration
+		want    []bool
+	}{
+		{"burst", RateLimit{Rate: 1, Burst: 2}, []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, 0, []bool{true, true, false}},
+		{"refill", RateLimit{Rate: 1}, []string{"192.0.2.1", "192.0.2.1"}, time.Second, []bool{true, true}},
+		{"partial refill", RateLimit{Rate: 1}, []string{"192.0.2.1", "192.0.2.1"}, 500 * time.Millisecond, []bool{true, false}},
+		{"clients", RateLimit{Rate: 1}, []string{"192.0.2.1", "192.0.2.2"}, 0, []bool{true, true}},
+		{"ipv4 prefix", RateLimit{Rate: 1, IPv4Prefix: 24}, []string{"192.0.2.1", "192.0.2.2", "198.51.100.1"}, 0, []bool{true, false, true}},
+		{"ipv6 prefix", RateLimit{Rate: 1, IPv6Prefix: 56}, []string{"2001:db8:0:1::1", "2001:db8:0:ff::1", "2001:db8:0:100::1"}, 0, []bool{true, false, true}},
+		{"mapped ipv4", RateLimit{Rate: 1}, []string{"192.0.2.1", "::ffff:192.0.2.1"}, 0, []bool{true, false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestRateLimiter(t, tt.limit)
+			for i, client := range tt.clients {
+				ip := netip.MustParseAddr(client).Unmap()
+				if got := m.allow(ip, now.Add(time.Duration(i)*tt.after)); got != tt.want[i] {
+					t.Errorf("query %d from %v: allow = %v, want %v", i, client, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	m := newTestRateLimiter(t, RateLimit{Rate: 1})
+	now := time.Now()
+	m.allow(netip.MustParseAddr("192.0.2.1"), now)
+	m.allow(netip.MustParseAddr("192.0.2.2"), now.Add(2*rateLimitSweep))
+	if n := len(m.buckets.m); n != 1 {
+		t.Errorf("buckets = %d, want 1", n)
+	}
+}
+
+func TestRateLimiter_Action(t *testing.T) {
+	for _, tt := range []struct {
+		action string
+		udp    bool
+		rcode  int
+		tc     bool
+		err    error
+	}{
+		{RateLimitDrop, true, 0, false, ErrDropped},
+		{RateLimitRefuse, true, dns.RcodeRefused, false, nil},
+		{RateLimitTruncate, true, dns.RcodeSuccess, true, nil},
+		{RateLimitTruncate, false, dns.RcodeRefused, false, nil},
+	} {
+		m := newTestRateLimiter(t, RateLimit{Rate: 1, Action: tt.action})
+		c := &Client{Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, Transport: "udp", UDP: tt.udp}
+		in := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+		if out, err := m.ExchangeClient(c, in); err != nil || len(out.Answer) != 1 {
+			t.Fatalf("%v: first query: %v, error: %v", tt.action, out, err)
+		}
+		out, err := m.ExchangeClient(c, in)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%v: error = %v, want %v", tt.action, err, tt.err)
+		}
+		if err != nil {
+			continue
+		}
+		if out.Rcode != tt.rcode || out.Truncated != tt.tc || len(out.Answer) != 0 {
+			t.Errorf("%v over udp %v: unexpected response %v", tt.action, tt.udp, out)
+		}
+	}
+}
+
+func TestRateLimiter_UnknownClient(t *testing.T) {
+	m := newTestRateLimiter(t, RateLimit{Rate: 1})
+	in := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if _, err := m.Exchange(in); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+}
+
+func TestRateLimit_Provision(t *testing.T) {
+	for _, tt := range []struct {
+		limit RateLimit
+		err   bool
+	}{
+		{RateLimit{Rate: 10}, false},
+		{RateLimit{}, true},
+		{RateLimit{Rate: 1, IPv4Prefix: 33}, true},
+		{RateLimit{Rate: 1, IPv6Prefix: -1}, true},
+		{RateLimit{Rate: 1, Action: "reject"}, true},
+	} {
+		if _, err := tt.limit.upstream(caddy.Context{}, echoUpstream); (err != nil) != tt.err {
+			t.Errorf("%+v: error = %v", tt.limit, err)
+		}
+	}
+}
+
+func TestPacket_RateLimit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := (&RateLimit{Rate: 1, Action: RateLimitTruncate}).upstream(caddy.Context{}, echoUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Packet{Conn: conn, tr: newTracker(), up: up, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i, tc := range []bool{false, true} {
+		bb, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(bb); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Truncated != tc {
+			t.Errorf("query %d: truncated = %v, want %v", i, msg.Truncated, tc)
+		}
+	}
+}
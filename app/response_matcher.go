@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseMatcher is a matcher of the responses of upstreams, in the
+// namespace dnsproxy.response_matchers.
+type ResponseMatcher interface {
+	// MatchResponse tells whether it matches the response out to in.
+	MatchResponse(in, out *dns.Msg) bool
+}
+
+func init() {
+	caddy.RegisterModule(MatchResponseIP{})
+}
+
+// MatchResponseIP matches the responses with an address in the answers
+// which is in the ranges, such as private addresses from a public resolver
+// or the addresses of the bogus NXDOMAIN responses of an ISP.
+type MatchResponseIP struct {
+	// Ranges is the addresses and CIDRs of the matcher.
+	Ranges []string `json:"ranges,omitempty"`
+	// Files is the paths of lists of addresses and CIDRs, with one per line
+	// and comments starting with "#". Lines such as "bogus-nxdomain=IP" of
+	// dnsmasq configurations are also accepted.
+	Files []string `json:"files,omitempty"`
+
+	set ipRanges
+}
+
+// CaddyModule is ...
+func (MatchResponseIP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.response_matchers.ip_cidr",
+		New: func() caddy.Module { return new(MatchResponseIP) },
+	}
+}
+
+// Provision is ...
+func (m *MatchResponseIP) Provision(ctx caddy.Context) error {
+	ranges := append([]string{}, m.Ranges...)
+	data, _, err := newRuleList(m.Files, nil).load(context.Background())
+	if err != nil {
+		return fmt.Errorf("ip_cidr: %w", err)
+	}
+	for _, v := range data {
+		ruleLines(v, func(line string) {
+			ranges = append(ranges, strings.TrimPrefix(line, "bogus-nxdomain="))
+		})
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("ip_cidr: no ranges")
+	}
+
+	prefixes, err := parsePrefixes(ranges)
+	if err != nil {
+		return fmt.Errorf("ip_cidr: %w", err)
+	}
+	m.set = newIPRanges(prefixes)
+	return nil
+}
+
+// MatchResponse is ...
+func (m *MatchResponseIP) MatchResponse(in, out *dns.Msg) bool {
+	for _, rr := range out.Answer {
+		if ip, ok := rrAddr(rr); ok && m.set.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ ResponseMatcher   = (*MatchResponseIP)(nil)
+	_ caddy.Provisioner = (*MatchResponseIP)(nil)
+)
@@ -0,0 +1,284 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRRLWindow is the window of ResponseRateLimit in seconds.
+	DefaultRRLWindow = 15
+	// DefaultRRLSlip is the slip of ResponseRateLimit.
+	DefaultRRLSlip = 2
+)
+
+// ResponseRateLimit limits identical responses sent to a client network
+// over UDP, like the rate-limit option of BIND, so that the server is not
+// of use to amplification attacks with spoofed sources.
+type ResponseRateLimit struct {
+	// ResponsesPerSecond is the number of identical answers, with the same
+	// name and type, sent to a client network per second.
+	ResponsesPerSecond int `json:"responses_per_second,omitempty"`
+	// NXDomainsPerSecond is the number of NXDOMAIN responses for the same
+	// zone per second, ResponsesPerSecond by default.
+	NXDomainsPerSecond int `json:"nxdomains_per_second,omitempty"`
+	// ErrorsPerSecond is the number of error responses, such as SERVFAIL
+	// or REFUSED, per second, ResponsesPerSecond by default.
+	ErrorsPerSecond int `json:"errors_per_second,omitempty"`
+	// Window is the number of seconds over which a client which exceeds
+	// the limits is accounted, it stays limited until it slows down for
+	// that long. It is 15 by default.
+	Window int `json:"window,omitempty"`
+	// Slip sends a truncated response, so that legitimate clients retry
+	// over TCP, instead of every Slip-th dropped response. It is 2 by
+	// default, and 0 drops all of them.
+	Slip *int `json:"slip,omitempty"`
+	// IPv4Prefix is the prefix length IPv4 clients are grouped by, 24 by
+	// default.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by, 56 by
+	// default.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// LogOnly logs the responses which would be limited, without dropping
+	// them.
+	LogOnly bool `json:"log_only,omitempty"`
+	// ExemptCookies does not limit responses to clients presenting a valid
+	// server cookie.
+	ExemptCookies bool `json:"exempt_cookies,omitempty"`
+}
+
+// limiter returns the limiter of responses, it is nil without limit.
+func (r *ResponseRateLimit) limiter(ctx caddy.Context, lg *zap.Logger) (*rrl, error) {
+	if r == nil {
+		return nil, nil
+	}
+	if r.ResponsesPerSecond <= 0 {
+		return nil, errors.New("rrl: responses_per_second must be positive")
+	}
+	if r.NXDomainsPerSecond < 0 || r.ErrorsPerSecond < 0 || r.Window < 0 {
+		return nil, errors.New("rrl: negative limit")
+	}
+	if r.Slip != nil && *r.Slip < 0 {
+		return nil, errors.New("rrl: negative slip")
+	}
+	if r.IPv4Prefix < 0 || r.IPv4Prefix > 32 || r.IPv6Prefix < 0 || r.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("rrl: invalid prefix length %d or %d", r.IPv4Prefix, r.IPv6Prefix)
+	}
+
+	l := &rrl{
+		rates:   [3]float64{float64(r.ResponsesPerSecond), float64(r.NXDomainsPerSecond), float64(r.ErrorsPerSecond)},
+		window:  float64(r.Window),
+		slip:    DefaultRRLSlip,
+		ipv4:    r.IPv4Prefix,
+		ipv6:    r.IPv6Prefix,
+		logOnly: r.LogOnly,
+		cookies: r.ExemptCookies,
+		limited: rrlResponses(ctx),
+		lg:      lg,
+		entries: map[rrlKey]*rrlEntry{},
+	}
+	for i := range l.rates {
+		if l.rates[i] == 0 {
+			l.rates[i] = l.rates[rrlAnswer]
+		}
+	}
+	if l.window == 0 {
+		l.window = DefaultRRLWindow
+	}
+	if r.Slip != nil {
+		l.slip = *r.Slip
+	}
+	if l.ipv4 == 0 {
+		l.ipv4 = 24
+	}
+	if l.ipv6 == 0 {
+		l.ipv6 = 56
+	}
+	return l, nil
+}
+
+// rrlClass is the kind of a response, each has its own limit.
+type rrlClass uint8
+
+const (
+	rrlAnswer rrlClass = iota
+	rrlNXDomain
+	rrlError
+)
+
+func (c rrlClass) String() string {
+	switch c {
+	case rrlAnswer:
+		return "responses"
+	case rrlNXDomain:
+		return "nxdomains"
+	default:
+		return "errors"
+	}
+}
+
+// rrlAction is what to do with a response.
+type rrlAction uint8
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// rrlKey identifies identical responses to a client network.
+type rrlKey struct {
+	prefix netip.Prefix
+	class  rrlClass
+	qtype  uint16
+	name   string
+}
+
+// rrlEntry is the account of identical responses, the balance is the
+// number of responses which can be sent right now.
+type rrlEntry struct {
+	balance float64
+	last    time.Time
+	drops   int
+	limited bool
+}
+
+// rrl limits the responses of a server.
+type rrl struct {
+	rates   [3]float64
+	window  float64
+	slip    int
+	ipv4    int
+	ipv6    int
+	logOnly bool
+	cookies bool
+	limited *prometheus.CounterVec
+	lg      *zap.Logger
+
+	mu      sync.Mutex
+	entries map[rrlKey]*rrlEntry
+	sweep   time.Time
+}
+
+// check accounts a response to c and tells whether to send it, responses
+// are always sent by a nil limiter.
+func (l *rrl) check(c *Client, out *dns.Msg, now time.Time) rrlAction {
+	if l == nil || c.Addr == nil || (c.Cookie && l.cookies) {
+		return rrlSend
+	}
+	ip := addrIP(c.Addr)
+	if !ip.IsValid() {
+		return rrlSend
+	}
+	bits := l.ipv4
+	if ip.Is6() {
+		bits = l.ipv6
+	}
+	key := rrlKey{class: rrlError}
+	key.prefix, _ = ip.Prefix(bits)
+	switch out.Rcode {
+	case dns.RcodeSuccess:
+		key.class = rrlAnswer
+		if len(out.Question) > 0 {
+			key.name = strings.ToLower(out.Question[0].Name)
+			key.qtype = out.Question[0].Qtype
+		}
+	case dns.RcodeNameError:
+		// NXDOMAIN responses of random names are limited by zone
+		key.class = rrlNXDomain
+		key.name = nxdomainZone(out)
+	}
+	rate := l.rates[key.class]
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.sweep) > time.Duration(l.window)*time.Second {
+		for k, e := range l.entries {
+			if now.Sub(e.last) > time.Duration(l.window)*time.Second {
+				delete(l.entries, k)
+			}
+		}
+		l.sweep = now
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &rrlEntry{balance: rate, last: now}
+		l.entries[key] = e
+	}
+	if now.After(e.last) {
+		e.balance = min(e.balance+now.Sub(e.last).Seconds()*rate, rate)
+		e.last = now
+	}
+	e.balance = max(e.balance-1, -l.window*rate)
+
+	if e.balance >= 0 {
+		if e.limited {
+			e.limited = false
+			l.lg.Info(fmt.Sprintf("rrl: stop limiting %v to %v", key.describe(), key.prefix))
+		}
+		return rrlSend
+	}
+	if !e.limited {
+		e.limited = true
+		if l.logOnly {
+			l.lg.Info(fmt.Sprintf("rrl: would limit %v to %v", key.describe(), key.prefix))
+		} else {
+			l.lg.Info(fmt.Sprintf("rrl: limit %v to %v", key.describe(), key.prefix))
+		}
+	}
+
+	if l.logOnly {
+		l.limited.WithLabelValues("log_only").Inc()
+		return rrlSend
+	}
+	e.drops++
+	if l.slip > 0 && e.drops%l.slip == 0 {
+		l.limited.WithLabelValues("slip").Inc()
+		return rrlSlip
+	}
+	l.limited.WithLabelValues("drop").Inc()
+	return rrlDrop
+}
+
+func (k rrlKey) describe() string {
+	switch k.class {
+	case rrlAnswer:
+		return fmt.Sprintf("%v %v %v", k.class, k.name, dns.Type(k.qtype))
+	case rrlNXDomain:
+		return fmt.Sprintf("%v %v", k.class, k.name)
+	default:
+		return k.class.String()
+	}
+}
+
+// nxdomainZone returns the zone of a NXDOMAIN response, the owner of the
+// SOA record in the authority section, or the query name without it.
+func nxdomainZone(out *dns.Msg) string {
+	for _, rr := range out.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name)
+		}
+	}
+	if len(out.Question) > 0 {
+		return strings.ToLower(out.Question[0].Name)
+	}
+	return ""
+}
+
+// slipResponse is the truncated response sent instead of a limited one.
+func slipResponse(in *dns.Msg) *dns.Msg {
+	out := new(dns.Msg).SetReply(in)
+	out.Truncated = true
+	return out
+}
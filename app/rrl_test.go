@@ -0,0 +1,228 @@
+package app
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func newTestRRL(t *testing.T, r ResponseRateLimit) *rrl {
+	l, err := r.limiter(caddy.Context{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// testResponse is a response to a query for name with rcode.
+func testResponse(name string, qtype uint16, rcode int) *dns.Msg {
+	return new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion(name, qtype), rcode)
+}
+
+func TestRRL_Check(t *testing.T) {
+	slip := func(n int) *int { return &n }
+	nx := func(name string) *dns.Msg {
+		out := testResponse(name, dns.TypeA, dns.RcodeNameError)
+		out.Ns = append(out.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}})
+		return out
+	}
+	type response struct {
+		client string
+		out    *dns.Msg
+		cookie bool
+	}
+	for _, tt := range []struct {
+		name      string
+		limit     ResponseRateLimit
+		responses []response
+		want      []rrlAction
+	}{
+		{
+			"slip",
+			ResponseRateLimit{ResponsesPerSecond: 1},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlDrop, rrlSlip, rrlDrop},
+		},
+		{
+			"no slip",
+			ResponseRateLimit{ResponsesPerSecond: 1, Slip: slip(0)},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlDrop, rrlDrop},
+		},
+		{
+			"identical responses",
+			ResponseRateLimit{ResponsesPerSecond: 1, Slip: slip(1)},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("EXAMPLE.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeAAAA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.org.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlSlip, rrlSend, rrlSend},
+		},
+		{
+			"client prefix",
+			ResponseRateLimit{ResponsesPerSecond: 1, Slip: slip(0)},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.200", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"198.51.100.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"2001:db8:0:1::1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"2001:db8:0:2::1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlDrop, rrlSend, rrlSend, rrlDrop},
+		},
+		{
+			"nxdomain by zone",
+			ResponseRateLimit{ResponsesPerSecond: 10, NXDomainsPerSecond: 1, Slip: slip(0)},
+			[]response{
+				{"192.0.2.1", nx("a.example.com."), false},
+				{"192.0.2.1", nx("b.example.com."), false},
+				{"192.0.2.1", testResponse("a.example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlDrop, rrlSend},
+		},
+		{
+			"errors",
+			ResponseRateLimit{ResponsesPerSecond: 10, ErrorsPerSecond: 1, Slip: slip(0)},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeServerFailure), false},
+				{"192.0.2.1", testResponse("example.org.", dns.TypeA, dns.RcodeRefused), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlDrop, rrlSend},
+		},
+		{
+			"exempt cookies",
+			ResponseRateLimit{ResponsesPerSecond: 1, Slip: slip(0), ExemptCookies: true},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), true},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlSend, rrlDrop},
+		},
+		{
+			"log only",
+			ResponseRateLimit{ResponsesPerSecond: 1, LogOnly: true},
+			[]response{
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+				{"192.0.2.1", testResponse("example.com.", dns.TypeA, dns.RcodeSuccess), false},
+			},
+			[]rrlAction{rrlSend, rrlSend, rrlSend},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestRRL(t, tt.limit)
+			now := time.Now()
+			for i, r := range tt.responses {
+				c := &Client{Addr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(r.client), 53)), Cookie: r.cookie}
+				if got := l.check(c, r.out, now); got != tt.want[i] {
+					t.Errorf("response %d to %v: action = %v, want %v", i, r.client, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRRL_Window(t *testing.T) {
+	l := newTestRRL(t, ResponseRateLimit{ResponsesPerSecond: 1, Window: 5, Slip: new(int)})
+	c := &Client{Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}}
+	out := testResponse("example.com.", dns.TypeA, dns.RcodeSuccess)
+	now := time.Now()
+
+	// flooding accounts for up to a window of responses
+	for i := 0; i < 100; i++ {
+		l.check(c, out, now)
+	}
+	if got := l.check(c, out, now.Add(4*time.Second)); got != rrlDrop {
+		t.Errorf("action within the window = %v, want drop", got)
+	}
+	if got := l.check(c, out, now.Add(15*time.Second)); got != rrlSend {
+		t.Errorf("action after the window = %v, want send", got)
+	}
+
+	// idle entries are removed
+	l.check(&Client{Addr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}}, out, now.Add(time.Minute))
+	if n := len(l.entries); n != 1 {
+		t.Errorf("entries = %d, want 1", n)
+	}
+}
+
+func TestRRL_Limiter(t *testing.T) {
+	negative := -1
+	for _, tt := range []struct {
+		limit ResponseRateLimit
+		err   bool
+	}{
+		{ResponseRateLimit{ResponsesPerSecond: 5}, false},
+		{ResponseRateLimit{}, true},
+		{ResponseRateLimit{ResponsesPerSecond: 5, ErrorsPerSecond: -1}, true},
+		{ResponseRateLimit{ResponsesPerSecond: 5, Slip: &negative}, true},
+		{ResponseRateLimit{ResponsesPerSecond: 5, IPv4Prefix: 40}, true},
+	} {
+		if _, err := tt.limit.limiter(caddy.Context{}, zap.NewNop()); (err != nil) != tt.err {
+			t.Errorf("%+v: error = %v", tt.limit, err)
+		}
+	}
+	var r *ResponseRateLimit
+	if l, err := r.limiter(caddy.Context{}, zap.NewNop()); err != nil || l.check(&Client{}, new(dns.Msg), time.Now()) != rrlSend {
+		t.Errorf("nil limiter limits responses")
+	}
+}
+
+func TestPacket_RRL(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slip := 1
+	l := newTestRRL(t, ResponseRateLimit{ResponsesPerSecond: 1, Slip: &slip})
+	s := &Packet{Conn: conn, rrl: l, tr: newTracker(), up: echoUpstream, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i, tc := range []bool{false, true} {
+		bb, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(bb); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Truncated != tc || (tc && len(msg.Answer) != 0) {
+			t.Errorf("query %d: unexpected response %v", i, msg)
+		}
+	}
+}
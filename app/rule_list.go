@@ -0,0 +1,191 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxRuleListSize is the size limit of a rule list.
+	MaxRuleListSize = 64 << 20
+	// ruleListTimeout is how long downloading a rule list may take.
+	ruleListTimeout = time.Minute
+)
+
+// ruleList loads rule lists from files and HTTP(S) URLs, remembering what
+// was loaded so that lists which did not change are not read again.
+type ruleList struct {
+	files   []string
+	urls    []string
+	client  *http.Client
+	sources map[string]*ruleSource
+}
+
+// ruleSource is the last version of a list.
+type ruleSource struct {
+	modTime      time.Time
+	size         int64
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+func newRuleList(files, urls []string) *ruleList {
+	return &ruleList{
+		files:   files,
+		urls:    urls,
+		client:  &http.Client{Timeout: ruleListTimeout},
+		sources: map[string]*ruleSource{},
+	}
+}
+
+// empty tells whether there are no lists.
+func (l *ruleList) empty() bool {
+	return len(l.files) == 0 && len(l.urls) == 0
+}
+
+// load returns the content of all lists, changed is false when none of them
+// changed since the last load. No list is updated when an error is returned.
+func (l *ruleList) load(ctx context.Context) (data [][]byte, changed bool, err error) {
+	sources := make(map[string]*ruleSource, len(l.files)+len(l.urls))
+	for _, v := range l.files {
+		src, err := l.loadFile(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("load %v: %w", v, err)
+		}
+		sources[v] = src
+	}
+	for _, v := range l.urls {
+		src, err := l.loadURL(ctx, v)
+		if err != nil {
+			return nil, false, fmt.Errorf("load %v: %w", v, err)
+		}
+		sources[v] = src
+	}
+
+	for _, v := range append(append([]string{}, l.files...), l.urls...) {
+		if old := l.sources[v]; old != sources[v] && (old == nil || !bytes.Equal(old.data, sources[v].data)) {
+			changed = true
+		}
+		data = append(data, sources[v].data)
+	}
+	l.sources = sources
+	return data, changed, nil
+}
+
+func (l *ruleList) loadFile(name string) (*ruleSource, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if src, ok := l.sources[name]; ok && fi.ModTime().Equal(src.modTime) && fi.Size() == src.size {
+		return src, nil
+	}
+	if fi.Size() > MaxRuleListSize {
+		return nil, errors.New("rule list too large")
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleSource{modTime: fi.ModTime(), size: fi.Size(), data: data}, nil
+}
+
+func (l *ruleList) loadURL(ctx context.Context, url string) (*ruleSource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	src, ok := l.sources[url]
+	if ok {
+		if src.etag != "" {
+			req.Header.Set("If-None-Match", src.etag)
+		}
+		if src.lastModified != "" {
+			req.Header.Set("If-Modified-Since", src.lastModified)
+		}
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		return src, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxRuleListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxRuleListSize {
+		return nil, errors.New("rule list too large")
+	}
+	// the validators of src are kept until the whole load succeeds
+	return &ruleSource{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		data:         data,
+	}, nil
+}
+
+// ruleLines calls fn for every rule of a list, which has one rule per line.
+// Empty lines and comments are skipped, a comment starts with "#" at the
+// start of a line or after a space, so that rules such as regular
+// expressions may contain "#".
+func ruleLines(data []byte, fn func(string)) {
+	listLines(data, func(line string) {
+		for i := 0; i < len(line); i++ {
+			if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+				line = line[:i]
+				break
+			}
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			fn(line)
+		}
+	})
+}
+
+// listLines calls fn for every line of a list which is not empty, without
+// the leading and trailing spaces.
+func listLines(data []byte, fn func(string)) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, MaxRuleListSize)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			fn(line)
+		}
+	}
+}
+
+// refreshLoop calls fn every interval until the returned function is
+// called.
+func refreshLoop(interval time.Duration, fn func(context.Context)) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+	return cancel
+}
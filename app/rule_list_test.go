@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ruleServer serves a rule list with an ETag, which is the body unless
+// etag is set.
+type ruleServer struct {
+	mu          sync.Mutex
+	body        string
+	etag        string
+	status      int
+	requests    int
+	modified    int
+	ifNoneMatch string
+}
+
+func (s *ruleServer) set(body string, status int) {
+	s.mu.Lock()
+	s.body, s.status = body, status
+	s.mu.Unlock()
+}
+
+func (s *ruleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.ifNoneMatch = r.Header.Get("If-None-Match")
+	if s.status != http.StatusOK {
+		w.WriteHeader(s.status)
+		return
+	}
+	etag := `"` + s.body + `"`
+	if s.etag != "" {
+		etag = s.etag
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.modified++
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(s.body))
+}
+
+func newRuleServer(t *testing.T, body string) (*ruleServer, string) {
+	t.Helper()
+
+	s := &ruleServer{body: body, status: http.StatusOK}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func writeRuleFile(t *testing.T, name, body string, mtime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(name, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuleLines(t *testing.T) {
+	got := []string{}
+	ruleLines([]byte("# comment\nexample.com\n\n  example.org  # trailing\r\n#\n**.example.net\nregexp:^a[#b]\\.example$\t# tab"), func(s string) {
+		got = append(got, s)
+	})
+	if want := []string{"example.com", "example.org", "**.example.net", `regexp:^a[#b]\.example$`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+}
+
+func TestRuleList_Load(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "rules.txt")
+	mtime := time.Now().Add(-time.Hour)
+	writeRuleFile(t, name, "example.com", mtime)
+	s, url := newRuleServer(t, "example.org")
+	l := newRuleList([]string{name}, []string{url})
+	ctx := context.Background()
+
+	load := func(changed bool, want ...string) {
+		t.Helper()
+		data, ok, err := l.load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, v := range data {
+			got = append(got, string(v))
+		}
+		if ok != changed || !reflect.DeepEqual(got, want) {
+			t.Errorf("load = %q, %v, want %q, %v", got, ok, want, changed)
+		}
+	}
+
+	load(true, "example.com", "example.org")
+	load(false, "example.com", "example.org")
+	if s.requests != 2 || s.modified != 1 {
+		t.Errorf("requests = %d, modified = %d, want 2, 1", s.requests, s.modified)
+	}
+
+	writeRuleFile(t, name, "example.net", mtime.Add(time.Minute))
+	load(true, "example.net", "example.org")
+
+	s.set("example.edu", http.StatusOK)
+	load(true, "example.net", "example.edu")
+
+	// a failed load keeps the lists loaded before
+	s.set("", http.StatusInternalServerError)
+	if _, _, err := l.load(ctx); err == nil {
+		t.Errorf("failed request is not an error")
+	}
+	os.Remove(name)
+	if _, _, err := l.load(ctx); err == nil {
+		t.Errorf("missing file is not an error")
+	}
+	writeRuleFile(t, name, "example.net", mtime.Add(time.Minute))
+	s.set("example.edu", http.StatusOK)
+	load(false, "example.net", "example.edu")
+}
+
+func TestRuleList_LoadValidators(t *testing.T) {
+	a, urlA := newRuleServer(t, "example.org")
+	a.etag = `"v1"`
+	b, urlB := newRuleServer(t, "example.net")
+	l := newRuleList(nil, []string{urlA, urlB})
+	ctx := context.Background()
+
+	if _, _, err := l.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new ETag for the same list is not kept when the load fails
+	a.mu.Lock()
+	a.etag = `"v2"`
+	a.mu.Unlock()
+	b.set("", http.StatusInternalServerError)
+	if _, _, err := l.load(ctx); err == nil {
+		t.Fatal("failed request is not an error")
+	}
+	b.set("example.net", http.StatusOK)
+	_, changed, err := l.load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ifNoneMatch != `"v1"` || changed {
+		t.Errorf("If-None-Match = %v, changed = %v, want \"v1\", false", a.ifNoneMatch, changed)
+	}
+
+	// and is kept when it succeeds
+	if _, _, err := l.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.ifNoneMatch != `"v2"` || a.modified != 3 {
+		t.Errorf("If-None-Match = %v, modified = %d, want \"v2\", 3", a.ifNoneMatch, a.modified)
+	}
+}
@@ -1,11 +1,13 @@
 package app
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"strconv"
-	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddytls"
@@ -19,32 +21,82 @@ type Server interface {
 	Run()
 	// Close is ...
 	io.Closer
+	// Shutdown stops accepting queries and waits for those in flight until
+	// ctx is done, then closes the server.
+	Shutdown(ctx context.Context) error
 }
 
 // NewServer is ...
 func NewServer(app *App, ctx caddy.Context, t string) (Server, error) {
+	opts := app.ServerOptions[t]
+	if opts.Name == "" {
+		opts.Name = t
+	}
+	up, err := opts.RateLimit.upstream(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	// denied clients are refused before they are limited
+	acl, err := opts.ACL.upstream(up, app.Logger().Named(t))
+	if err != nil {
+		return nil, err
+	}
+	if acl != nil {
+		up = acl
+	}
+
+	if opts.RRL != nil && t != "udp" {
+		return nil, fmt.Errorf("rrl is not supported by %v server", t)
+	}
+
 	switch t {
 	case "udp":
-		conn, err := caddy.ListenPacket("udp", ":"+strconv.Itoa(app.ListenUDP))
+		proxies, err := opts.ProxyProtocol.proxies()
+		if err != nil {
+			return nil, err
+		}
+		lg := app.Logger().Named("udp")
+		rrl, err := opts.RRL.limiter(ctx, lg)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := listenPacket(ctx, app.ListenUDP)
 		if err != nil {
 			return nil, err
 		}
 		s := &Packet{
-			Conn: conn,
-			up:   app,
-			lg:   app.Logger().Named("udp"),
+			Conn:    conn,
+			proxies: proxies,
+			acl:     acl,
+			rrl:     rrl,
+			cookies: app.Cookies,
+			opts:    opts,
+			tr:      newTracker(),
+			up:      up,
+			lg:      lg,
 		}
 		s.lg.Info("start server")
 		return s, nil
 	case "tcp":
-		ln, err := caddy.Listen("tcp", ":"+strconv.Itoa(app.ListenTCP))
+		ln, err := listen(ctx, app.ListenTCP)
+		if err != nil {
+			return nil, err
+		}
+		// the header comes first on the connection
+		pln, err := opts.ProxyProtocol.listener(ln)
 		if err != nil {
+			ln.Close()
 			return nil, err
 		}
+		ln = pln
 		s := &Stream{
-			Listener: ln,
-			up:       app,
-			lg:       app.Logger().Named("tcp"),
+			Listener:  ln,
+			transport: t,
+			opts:      opts,
+			limiter:   opts.limiter(),
+			tr:        newTracker(),
+			up:        up,
+			lg:        app.Logger().Named("tcp"),
 		}
 		s.lg.Info("start server")
 		return s, nil
@@ -54,22 +106,36 @@ func NewServer(app *App, ctx caddy.Context, t string) (Server, error) {
 		if err := connPolicies.Provision(ctx); err != nil {
 			return nil, err
 		}
-		ln, err := caddy.Listen("tcp", ":"+strconv.Itoa(app.ListenTLS))
+		ln, err := listen(ctx, app.ListenTLS)
+		if err != nil {
+			return nil, err
+		}
+		// the header is sent before the TLS handshake
+		pln, err := opts.ProxyProtocol.listener(ln)
 		if err != nil {
+			ln.Close()
 			return nil, err
 		}
+		ln = pln
 		// create tls.Config
 		tlsConfig := connPolicies.TLSConfig(ctx)
 		ln = tls.NewListener(ln, tlsConfig)
 		s := &Stream{
-			Listener: ln,
-			up:       app,
-			lg:       app.Logger().Named("tls"),
+			Listener:  ln,
+			transport: t,
+			opts:      opts,
+			limiter:   opts.limiter(),
+			tr:        newTracker(),
+			up:        up,
+			lg:        app.Logger().Named("tls"),
 		}
 		s.lg.Info("start server")
 		return s, nil
 	case "quic":
-		conn, err := caddy.ListenPacket("udp", ":"+strconv.Itoa(app.ListenQuic))
+		if opts.ProxyProtocol != nil {
+			return nil, errors.New("proxy_protocol is not supported by quic server")
+		}
+		conn, err := listenPacket(ctx, app.ListenQuic)
 		if err != nil {
 			return nil, err
 		}
@@ -80,17 +146,47 @@ func NewServer(app *App, ctx caddy.Context, t string) (Server, error) {
 		}
 		// create tls.Config
 		tlsConfig := connPolicies.TLSConfig(ctx)
-		tlsConfig.NextProtos = []string{NextProtoDQ, "doq-i00", "dq", "doq"}
-		ln, err := quic.Listen(conn, tlsConfig, &quic.Config{
-			MaxIdleTimeout: 5 * time.Minute,
-		})
+		tr, ln, err := ListenQuic(conn, tlsConfig, opts)
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 		s := &Quic{
+			Listener:  ln,
+			Transport: tr,
+			opts:      opts,
+			limiter:   opts.limiter(),
+			tr:        newTracker(),
+			up:        up,
+			lg:        app.Logger().Named("quic"),
+		}
+		s.lg.Info("start server")
+		return s, nil
+	case "dnscrypt":
+		if app.DNSCrypt == nil {
+			return nil, errors.New("dnscrypt: no provider")
+		}
+		if opts.ProxyProtocol != nil {
+			return nil, errors.New("proxy_protocol is not supported by dnscrypt server")
+		}
+		conn, err := listenPacket(ctx, app.ListenDNSCrypt)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := listen(ctx, app.ListenDNSCrypt)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		s := &DNSCryptServer{
+			Conn:     conn,
 			Listener: ln,
-			up:       app,
-			lg:       app.Logger().Named("quic"),
+			provider: app.DNSCrypt,
+			opts:     opts,
+			limiter:  opts.limiter(),
+			tr:       newTracker(),
+			up:       up,
+			lg:       app.Logger().Named("dnscrypt"),
 		}
 		s.lg.Info("start server")
 		return s, nil
@@ -99,7 +195,58 @@ func NewServer(app *App, ctx caddy.Context, t string) (Server, error) {
 	}
 }
 
+func listen(ctx caddy.Context, port int) (net.Listener, error) {
+	addr, err := caddy.ParseNetworkAddress("tcp/:" + strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	ln, err := addr.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := ln.(net.Listener); ok {
+		return l, nil
+	}
+	return nil, fmt.Errorf("unexpected listener type: %T", ln)
+}
+
+func listenPacket(ctx caddy.Context, port int) (net.PacketConn, error) {
+	addr, err := caddy.ParseNetworkAddress("udp/:" + strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	ln, err := addr.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if conn, ok := ln.(net.PacketConn); ok {
+		return conn, nil
+	}
+	return nil, fmt.Errorf("unexpected listener type: %T", ln)
+}
+
+// ListenQuic is ...
+func ListenQuic(conn net.PacketConn, tlsConfig *tls.Config, opts ServerOptions) (*quic.Transport, *quic.EarlyListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{NextProtoDoQ}
+	if opts.DraftALPN {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, draftNextProtos...)
+	}
+	// closing a listener from quic.ListenEarly also stops reading packets
+	// of its connections, a separate transport lets them finish
+	tr := &quic.Transport{Conn: conn}
+	ln, err := tr.ListenEarly(tlsConfig, &quic.Config{
+		MaxIdleTimeout: opts.idleTimeout(DefaultIdleTimeout),
+		Allow0RTT:      opts.Allow0RTT,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tr, ln, nil
+}
+
 var (
+	_ Server = (*DNSCryptServer)(nil)
 	_ Server = (*Packet)(nil)
 	_ Server = (*Quic)(nil)
 	_ Server = (*Stream)(nil)
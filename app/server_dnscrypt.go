@@ -0,0 +1,262 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"github.com/imgk/memory-go"
+)
+
+// DNSCryptServer serves DNSCrypt v2 over UDP and TCP on the same port.
+type DNSCryptServer struct {
+	// Conn is ...
+	Conn net.PacketConn
+	// Listener is ...
+	Listener net.Listener
+
+	provider *DNSCrypt
+	opts     ServerOptions
+	limiter  *connLimiter
+	tr       *tracker
+	up       Upstream
+	lg       *zap.Logger
+}
+
+// Run is ...
+func (s *DNSCryptServer) Run() {
+	if !s.tr.track(s.Conn) {
+		return
+	}
+	defer s.tr.untrack(s.Conn)
+
+	if s.tr.enter() {
+		go func() {
+			defer s.tr.leave()
+			s.runStream()
+		}()
+	}
+
+	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
+	defer memory.Free(ptr)
+
+	for {
+		// read message
+		n, addr, err := s.Conn.ReadFrom(buf)
+		if err != nil {
+			if s.tr.closed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.lg.Error(fmt.Sprintf("server error: read packet error: %v", err))
+			return
+		}
+
+		bb, err := s.handle(addr, buf[:n], true)
+		if err != nil {
+			s.lg.Error(fmt.Sprintf("server error: %v", err))
+			continue
+		}
+		if bb == nil {
+			continue
+		}
+
+		// write message
+		if _, err := s.Conn.WriteTo(bb, addr); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: write back error: %v", err))
+			continue
+		}
+	}
+}
+
+func (s *DNSCryptServer) runStream() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.lg.Error(fmt.Sprintf("server error: accept error: %v", err))
+			return
+		}
+		if !s.limiter.acquire(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		if !s.tr.track(conn) {
+			s.limiter.release(conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.tr.untrack(conn)
+			defer s.limiter.release(conn.RemoteAddr())
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *DNSCryptServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
+	defer memory.Free(ptr)
+
+	for queries := 0; s.opts.MaxQueries <= 0 || queries < s.opts.MaxQueries; queries++ {
+		if err := s.tr.setReadDeadline(conn, s.opts.idleTimeout(DefaultIdleTimeout)); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: net.Conn.SetReadDeadline error: %v", err))
+			return
+		}
+
+		// read prefix
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			if ne, ok := err.(net.Error); errors.Is(err, io.EOF) || (ok && ne.Timeout()) || s.tr.closed() {
+				return
+			}
+			s.lg.Error(fmt.Sprintf("server error: read length error: %v", err))
+			return
+		}
+
+		// read message
+		n := int(buf[0])<<8 | int(buf[1])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			if s.tr.closed() {
+				return
+			}
+			s.lg.Error(fmt.Sprintf("server error: read message error: %v", err))
+			return
+		}
+
+		bb, err := s.handle(conn.RemoteAddr(), buf[:n], false)
+		if err != nil {
+			s.lg.Error(fmt.Sprintf("server error: %v", err))
+			return
+		}
+		if bb == nil {
+			return
+		}
+
+		// write prefix and message
+		if err := conn.SetWriteDeadline(time.Now().Add(s.opts.writeTimeout())); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: net.Conn.SetWriteDeadline error: %v", err))
+			return
+		}
+		if _, err := (&net.Buffers{{byte(len(bb) >> 8), byte(len(bb))}, bb}).WriteTo(conn); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: write message error: %v", err))
+			return
+		}
+	}
+}
+
+// handle answers a DNSCrypt query or a plain certificate query. It returns
+// nil for messages which are silently dropped.
+func (s *DNSCryptServer) handle(addr net.Addr, b []byte, udp bool) ([]byte, error) {
+	query, resp, ok, err := s.provider.Decrypt(b)
+	if !ok {
+		// not encrypted, it can only be a certificate request
+		msg := &dns.Msg{}
+		if err := msg.Unpack(b); err != nil {
+			return nil, nil
+		}
+		out, ok := s.provider.Handshake(msg)
+		if !ok {
+			return nil, nil
+		}
+		bb, err := out.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("pack error: %w", err)
+		}
+		// the same limit as for encrypted responses, clients pad
+		// certificate queries or ask over TCP
+		if udp && len(bb) > len(b) {
+			return packTruncated(msg)
+		}
+		return bb, nil
+	}
+	if err != nil {
+		// undecryptable queries are dropped like the reference server does
+		return nil, nil
+	}
+
+	msg := &dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return nil, fmt.Errorf("unpack error: %w", err)
+	}
+	if msg.Response || len(msg.Question) != 1 {
+		return nil, nil
+	}
+
+	// request response
+	id := msg.Id
+	out, err := s.tr.exchange(s.up, &Client{Addr: addr, Transport: "dnscrypt", Listener: s.opts.Name, UDP: udp}, msg, s.opts.queryTimeout())
+	if errors.Is(err, ErrDropped) {
+		return nil, nil
+	}
+	if err != nil {
+		s.lg.Error(fmt.Sprintf("server error: exchange error for %v: %v", addr, err))
+		out = new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure)
+	}
+	out.Id = id
+	bb, err := out.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack error: %w", err)
+	}
+
+	// responses over UDP must not be larger than the query to prevent
+	// amplification, clients retry with larger padding or over TCP
+	if udp && dnscryptResponseSize(len(bb)) > len(b) {
+		if bb, err = packTruncated(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	bb, err = resp.Encrypt(bb)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt error: %w", err)
+	}
+	return bb, nil
+}
+
+// packTruncated packs an empty response to in with TC set.
+func packTruncated(in *dns.Msg) ([]byte, error) {
+	tc := new(dns.Msg).SetReply(in)
+	tc.Truncated = true
+	bb, err := tc.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack error: %w", err)
+	}
+	return bb, nil
+}
+
+// Close is ...
+func (s *DNSCryptServer) Close() error {
+	return multierr.Combine(s.Conn.Close(), s.Listener.Close())
+}
+
+// Shutdown stops accepting queries and waits for those in flight until ctx
+// is done.
+func (s *DNSCryptServer) Shutdown(ctx context.Context) error {
+	errs := []error{}
+	if err := s.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, err)
+	}
+	if err := s.tr.shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, err)
+	}
+	return multierr.Combine(errs...)
+}
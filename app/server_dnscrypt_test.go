@@ -0,0 +1,269 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func newTestDNSCrypt(t *testing.T, storage certmagic.Storage) *DNSCrypt {
+	t.Helper()
+
+	d := &DNSCrypt{ProviderName: "example.com", storage: storage, lg: zap.NewNop()}
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Cleanup() })
+	return d
+}
+
+func newTestDNSCryptServer(t *testing.T, d *DNSCrypt, up Upstream) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	s := &DNSCryptServer{
+		Conn:     conn,
+		Listener: ln,
+		provider: d,
+		opts:     ServerOptions{IdleTimeout: caddy.Duration(time.Second)},
+		tr:       newTracker(),
+		up:       up,
+		lg:       zap.NewNop(),
+	}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func dialTestDNSCrypt(t *testing.T, c *dnscrypt.Client, d *DNSCrypt, addr string) *dnscrypt.ResolverInfo {
+	t.Helper()
+
+	pk, err := dnscrypt.HexDecodeKey(d.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client does not pad certificate queries, which are truncated
+	// over UDP
+	tcp := &dnscrypt.Client{Net: "tcp", Timeout: c.Timeout}
+	info, err := tcp.DialStamp(dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+		ProviderName:  d.name,
+		ServerPk:      pk,
+		ServerAddrStr: addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestDNSCrypt_Exchange(t *testing.T) {
+	d := newTestDNSCrypt(t, &certmagic.FileStorage{Path: t.TempDir()})
+
+	// answers with many records do not fit in a padded udp query
+	large := upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		out, err := echoUpstream(in)
+		for i := 0; err == nil && i < 32; i++ {
+			out.Answer = append(out.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: in.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i+2)),
+			})
+		}
+		return out, err
+	})
+
+	tests := []struct {
+		name      string
+		net       string
+		up        Upstream
+		answers   int
+		truncated bool
+	}{
+		{name: "udp", net: "udp", up: echoUpstream, answers: 1},
+		{name: "tcp", net: "tcp", up: echoUpstream, answers: 1},
+		{name: "udp truncated", net: "udp", up: large, truncated: true},
+		{name: "tcp large", net: "tcp", up: large, answers: 33},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := newTestDNSCryptServer(t, d, tt.up)
+			c := &dnscrypt.Client{Net: tt.net, Timeout: 2 * time.Second}
+			info := dialTestDNSCrypt(t, c, d, addr)
+
+			msg := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+			out, err := c.Exchange(msg, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Id != msg.Id {
+				t.Errorf("id = %d, want %d", out.Id, msg.Id)
+			}
+			if out.Truncated != tt.truncated || len(out.Answer) != tt.answers {
+				t.Errorf("truncated = %v, answers = %d, want %v, %d", out.Truncated, len(out.Answer), tt.truncated, tt.answers)
+			}
+		})
+	}
+}
+
+func TestDNSCrypt_CertOverUDP(t *testing.T) {
+	d := newTestDNSCrypt(t, &certmagic.FileStorage{Path: t.TempDir()})
+	addr := newTestDNSCryptServer(t, d, echoUpstream)
+	c := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+
+	for _, tt := range []struct {
+		name      string
+		padding   int
+		truncated bool
+	}{
+		{name: "unpadded", truncated: true},
+		{name: "padded", padding: 512},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg).SetQuestion(d.name, dns.TypeTXT)
+			if tt.padding > 0 {
+				msg.SetEdns0(dns.DefaultMsgSize, false)
+				opt := msg.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, tt.padding)})
+			}
+			out, _, err := c.Exchange(msg, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Truncated != tt.truncated || (len(out.Answer) == 0) != tt.truncated {
+				t.Errorf("truncated = %v, answers = %d, want truncated %v", out.Truncated, len(out.Answer), tt.truncated)
+			}
+		})
+	}
+}
+
+func TestDNSCrypt_Rotate(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	d := newTestDNSCrypt(t, storage)
+	addr := newTestDNSCryptServer(t, d, echoUpstream)
+
+	c := &dnscrypt.Client{Net: "udp", Timeout: 2 * time.Second}
+	old := dialTestDNSCrypt(t, c, d, addr)
+
+	// another instance shares the provider key and certificates
+	if d2 := newTestDNSCrypt(t, storage); d2.PublicKey() != d.PublicKey() || len(d2.Certs()) != 1 {
+		t.Fatal("provider key is not shared")
+	}
+
+	// move the certificate halfway through its validity
+	ctx := context.Background()
+	bb, err := storage.Load(ctx, d.storageKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := dnscryptStored{}
+	if err := json.Unmarshal(bb, &stored); err != nil {
+		t.Fatal(err)
+	}
+	stored.Certs[0].NotBefore -= uint32(time.Duration(d.CertTTL).Seconds()) / 2
+	stored.Certs[0].NotAfter -= uint32(time.Duration(d.CertTTL).Seconds()) / 2
+	if bb, err = json.Marshal(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, d.storageKey(), bb); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.Certs()); n != 2 {
+		t.Fatalf("certs = %d, want 2", n)
+	}
+
+	// new clients use the new certificate, existing ones keep working
+	info := dialTestDNSCrypt(t, c, d, addr)
+	if info.ResolverCert.Serial <= old.ResolverCert.Serial {
+		t.Errorf("serial = %d, want > %d", info.ResolverCert.Serial, old.ResolverCert.Serial)
+	}
+	for _, v := range []*dnscrypt.ResolverInfo{old, info} {
+		if _, err := c.Exchange(new(dns.Msg).SetQuestion("example.org.", dns.TypeA), v); err != nil {
+			t.Errorf("exchange with cert %d: %v", v.ResolverCert.Serial, err)
+		}
+	}
+
+	// expired certificates are dropped
+	stored.Certs[0].NotAfter = uint32(time.Now().Add(-time.Minute).Unix())
+	bb, _ = storage.Load(ctx, d.storageKey())
+	latest := dnscryptStored{}
+	if err := json.Unmarshal(bb, &latest); err != nil {
+		t.Fatal(err)
+	}
+	latest.Certs[0] = stored.Certs[0]
+	if bb, err = json.Marshal(latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, d.storageKey(), bb); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if certs := d.Certs(); len(certs) != 1 || certs[0].Serial != info.ResolverCert.Serial {
+		t.Errorf("certs after expiry = %d, want only %d", len(certs), info.ResolverCert.Serial)
+	}
+}
+
+func TestDNSCrypt_PrivateKey(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	d1 := newTestDNSCrypt(t, storage)
+
+	// a configured key replaces the stored one
+	d2 := &DNSCrypt{
+		ProviderName: "2.dnscrypt-cert.example.com.",
+		PrivateKey:   "0101010101010101010101010101010101010101010101010101010101010101",
+		EsVersion:    "xchacha20poly1305",
+		storage:      storage,
+		lg:           zap.NewNop(),
+	}
+	if err := d2.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Cleanup()
+	if d2.PublicKey() == d1.PublicKey() {
+		t.Fatal("configured key is not used")
+	}
+	certs := d2.Certs()
+	if len(certs) != 1 || certs[0].EsVersion != dnscrypt.XChacha20Poly1305 {
+		t.Fatalf("unexpected certs %v", certs)
+	}
+
+	addr := newTestDNSCryptServer(t, d2, echoUpstream)
+	c := &dnscrypt.Client{Net: "udp", Timeout: 2 * time.Second}
+	info := dialTestDNSCrypt(t, c, d2, addr)
+	if _, err := c.Exchange(new(dns.Msg).SetQuestion("example.org.", dns.TypeA), info); err != nil {
+		t.Error(err)
+	}
+
+	for _, v := range []*DNSCrypt{
+		{ProviderName: ""},
+		{ProviderName: "example.com", EsVersion: "aes"},
+		{ProviderName: "example.com", PrivateKey: "0102"},
+	} {
+		v.storage, v.lg = storage, zap.NewNop()
+		if err := v.start(); err == nil {
+			v.Cleanup()
+			t.Errorf("start() with %+v succeeded", v)
+		}
+	}
+}
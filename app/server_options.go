@@ -0,0 +1,197 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultIdleTimeout is the idle timeout of QUIC and DNSCrypt
+	// connections.
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultStreamIdleTimeout is the idle timeout of TCP and TLS
+	// connections.
+	DefaultStreamIdleTimeout = time.Minute
+	// DefaultWriteTimeout is how long writing a response may take.
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultQueryTimeout is how long the upstream may take to answer a
+	// query.
+	DefaultQueryTimeout = 10 * time.Second
+)
+
+// ServerOptions is the per-listener configuration, keyed by server type
+// in App.ServerOptions.
+type ServerOptions struct {
+	// Name is the listener name of the queries arriving on the server, the
+	// server type by default.
+	Name string `json:"name,omitempty"`
+	// IdleTimeout is how long an idle connection is kept open.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+	// QueryTimeout is how long the upstream may take to answer a query
+	// before SERVFAIL is returned, DefaultQueryTimeout by default.
+	QueryTimeout caddy.Duration `json:"query_timeout,omitempty"`
+	// WriteTimeout is how long writing a response may take.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+	// MaxConns is the number of concurrent connections of the listener,
+	// connections over the limit are closed right away.
+	MaxConns int `json:"max_conns,omitempty"`
+	// MaxConnsPerIP is the number of concurrent connections from one
+	// client address.
+	MaxConnsPerIP int `json:"max_conns_per_ip,omitempty"`
+	// MaxQueries is the number of queries answered on one connection
+	// before it is closed.
+	MaxQueries int `json:"max_queries,omitempty"`
+	// TCPKeepalive answers TCP and TLS clients sending the
+	// edns-tcp-keepalive option with the idle timeout, RFC 7828.
+	TCPKeepalive bool `json:"edns_tcp_keepalive,omitempty"`
+	// Allow0RTT accepts DNS-over-QUIC queries sent in 0-RTT data. Queries
+	// which are not safe to replay are held until the handshake completes.
+	Allow0RTT bool `json:"allow_0rtt,omitempty"`
+	// DraftALPN additionally offers the pre-RFC 9250 ALPN tokens and their
+	// unprefixed message framing to DNS-over-QUIC clients.
+	DraftALPN bool `json:"draft_alpn,omitempty"`
+	// MaxInFlight is the number of pipelined queries on one TCP or TLS
+	// connection which are answered concurrently.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	// ProxyProtocol accepts the PROXY protocol from load balancers on tcp,
+	// tls and udp listeners.
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol,omitempty"`
+	// RateLimit limits the queries of every client of the listener.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// ACL restricts the clients of the listener.
+	ACL *ACL `json:"acl,omitempty"`
+	// RRL limits the responses of the udp listener against amplification
+	// attacks.
+	RRL *ResponseRateLimit `json:"rrl,omitempty"`
+}
+
+func (o *ServerOptions) idleTimeout(def time.Duration) time.Duration {
+	if o.IdleTimeout > 0 {
+		return time.Duration(o.IdleTimeout)
+	}
+	return def
+}
+
+func (o *ServerOptions) writeTimeout() time.Duration {
+	if o.WriteTimeout > 0 {
+		return time.Duration(o.WriteTimeout)
+	}
+	return DefaultWriteTimeout
+}
+
+func (o *ServerOptions) queryTimeout() time.Duration {
+	if o.QueryTimeout > 0 {
+		return time.Duration(o.QueryTimeout)
+	}
+	return DefaultQueryTimeout
+}
+
+func (o *ServerOptions) maxInFlight() int {
+	if o.MaxInFlight > 0 {
+		return o.MaxInFlight
+	}
+	return DefaultMaxInFlight
+}
+
+// limiter returns the connection limiter of the options.
+func (o *ServerOptions) limiter() *connLimiter {
+	return &connLimiter{max: o.MaxConns, maxPerIP: o.MaxConnsPerIP, perIP: map[string]int{}}
+}
+
+// errQueryTimeout is returned when the upstream is slower than the query
+// timeout.
+var errQueryTimeout = errors.New("query timeout")
+
+// connLimiter limits the number of concurrent connections, zero means no
+// limit. A nil connLimiter allows every connection.
+type connLimiter struct {
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func connIP(addr net.Addr) string {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP.String()
+	case *net.UDPAddr:
+		return v.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire reports whether a new connection from addr is allowed, it must
+// be followed by release when true.
+func (l *connLimiter) acquire(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip := connIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimiter) release(addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip := connIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// tcpKeepalive returns the edns-tcp-keepalive option of a query.
+func tcpKeepalive(msg *dns.Msg) *dns.EDNS0_TCP_KEEPALIVE {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, v := range opt.Option {
+		if ka, ok := v.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return ka
+		}
+	}
+	return nil
+}
+
+// setTCPKeepalive advertises the idle timeout to the client in units of
+// 100 milliseconds, RFC 7828 Section 3.3.2.
+func setTCPKeepalive(msg *dns.Msg, timeout time.Duration) {
+	removeTCPKeepalive(msg)
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(min(timeout/(100*time.Millisecond), 0xffff)),
+	})
+}
@@ -0,0 +1,41 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	a1 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	a2 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2}
+	b1 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}
+	c1 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 1}
+
+	l := (&ServerOptions{MaxConns: 2, MaxConnsPerIP: 1}).limiter()
+	for _, v := range []struct {
+		addr    net.Addr
+		release bool
+		want    bool
+	}{
+		{a1, false, true},
+		{a2, false, false}, // per address limit
+		{b1, false, true},
+		{c1, false, false}, // global limit
+		{a1, true, false},
+		{a2, false, true},
+		{c1, false, false},
+		{b1, true, false},
+		{c1, false, true},
+	} {
+		if v.release {
+			l.release(v.addr)
+			continue
+		}
+		if got := l.acquire(v.addr); got != v.want {
+			t.Errorf("acquire(%v) = %v, want %v", v.addr, got, v.want)
+		}
+	}
+	if l.total != 2 || len(l.perIP) != 2 {
+		t.Errorf("total = %d, addresses = %d, want 2 and 2", l.total, len(l.perIP))
+	}
+}
@@ -1,12 +1,16 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 
 	"github.com/imgk/memory-go"
 	"github.com/miekg/dns"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
@@ -15,12 +19,23 @@ type Packet struct {
 	// Conn is ...
 	Conn net.PacketConn
 
-	up Upstream
-	lg *zap.Logger
+	proxies []netip.Prefix
+	acl     *aclUpstream
+	rrl     *rrl
+	cookies *Cookies
+	opts    ServerOptions
+	tr      *tracker
+	up      Upstream
+	lg      *zap.Logger
 }
 
 // Run is ..
 func (s *Packet) Run() {
+	if !s.tr.track(s.Conn) {
+		return
+	}
+	defer s.tr.untrack(s.Conn)
+
 	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
 	defer memory.Free(ptr)
 
@@ -30,6 +45,9 @@ func (s *Packet) Run() {
 		// read message
 		n, addr, err := s.Conn.ReadFrom(buf)
 		if err != nil {
+			if s.tr.closed() {
+				return
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				continue
 			}
@@ -39,18 +57,25 @@ func (s *Packet) Run() {
 			s.lg.Error(fmt.Sprintf("server error: read packet error: %v", err))
 			return
 		}
-		if err := msg.Unpack(buf[:n]); err != nil {
+		client, b, err := proxyClient(s.proxies, addr, buf[:n])
+		if err != nil {
+			s.lg.Error(fmt.Sprintf("server error: proxy protocol error: %v", err))
+			continue
+		}
+		if err := msg.Unpack(b); err != nil {
 			s.lg.Error(fmt.Sprintf("server error: unpack error: %v", err))
 			continue
 		}
 
-		// request response
-		msg, err = s.up.Exchange(msg)
+		c := &Client{Addr: client, Transport: "udp", Listener: s.opts.Name, UDP: true}
+		out, err := s.answer(c, msg)
 		if err != nil {
-			s.lg.Error(fmt.Sprintf("server error: exchange error: %v", err))
+			if !errors.Is(err, ErrDropped) {
+				s.lg.Error(fmt.Sprintf("server error: exchange error for %v: %v", client, err))
+			}
 			continue
 		}
-		bb, err := msg.PackBuffer(buf)
+		bb, err := out.PackBuffer(buf)
 		if err != nil {
 			s.lg.Error(fmt.Sprintf("server error: pack error: %v", err))
 			continue
@@ -64,7 +89,64 @@ func (s *Packet) Run() {
 	}
 }
 
+// answer requests the response of a query, checking the cookie of the query
+// and the response rate limit. Denied clients are refused without looking
+// at their cookies.
+func (s *Packet) answer(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	if s.cookies == nil || !s.acl.allowed(c) {
+		return s.exchange(c, in)
+	}
+
+	now := time.Now()
+	ip := addrIP(c.Addr)
+	cookie, status, err := s.cookies.check(in, ip, now)
+	switch {
+	case err != nil:
+		return s.limit(c, in, new(dns.Msg).SetRcode(in, dns.RcodeFormatError))
+	case status == cookieNone:
+		return s.exchange(c, in)
+	case status != cookieValid && s.cookies.Require:
+		return s.limit(c, in, s.cookies.reply(new(dns.Msg).SetRcode(in, dns.RcodeBadCookie), cookie, ip, now))
+	}
+	c.Cookie = status == cookieValid
+
+	out, err := s.exchange(c, in)
+	if err != nil {
+		return nil, err
+	}
+	return s.cookies.reply(out, cookie, ip, now), nil
+}
+
+func (s *Packet) exchange(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	out, err := s.tr.exchange(s.up, c, in, s.opts.queryTimeout())
+	if err != nil {
+		return nil, err
+	}
+	return s.limit(c, in, out)
+}
+
+// limit applies the response rate limit to the response out of in.
+func (s *Packet) limit(c *Client, in, out *dns.Msg) (*dns.Msg, error) {
+	switch s.rrl.check(c, out, time.Now()) {
+	case rrlDrop:
+		return nil, ErrDropped
+	case rrlSlip:
+		return slipResponse(in), nil
+	}
+	return out, nil
+}
+
 // Close is ...
 func (s *Packet) Close() error {
 	return s.Conn.Close()
 }
+
+// Shutdown stops reading queries and waits for the one in flight until ctx
+// is done.
+func (s *Packet) Shutdown(ctx context.Context) error {
+	err := s.tr.shutdown(ctx)
+	if cerr := s.Conn.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+		err = multierr.Append(err, cerr)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/proxyproto"
+)
+
+// ProxyProtocol accepts the HAProxy PROXY protocol from load balancers, so
+// that the address of the client is used instead of the one of the load
+// balancer. TCP and TLS listeners accept version 1 and 2, UDP listeners
+// accept version 2 in front of every datagram.
+type ProxyProtocol struct {
+	// Allow is the addresses and CIDRs of the proxies, which must send a
+	// header. Clients connecting from other addresses are served as is.
+	Allow []string `json:"allow,omitempty"`
+	// Timeout is how long to wait for the header of a TCP connection, 5s
+	// by default.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// listener reads the header of connections from the allowed proxies.
+func (p *ProxyProtocol) listener(ln net.Listener) (net.Listener, error) {
+	if p == nil {
+		return ln, nil
+	}
+	prefixes, err := p.proxies()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyproto.Listener{
+		Listener: ln,
+		Trusted:  func(addr net.Addr) bool { return containsAddr(prefixes, addr) },
+		Timeout:  time.Duration(p.Timeout),
+	}, nil
+}
+
+// proxies returns the prefixes of the allowed proxies.
+func (p *ProxyProtocol) proxies() ([]netip.Prefix, error) {
+	if p == nil {
+		return nil, nil
+	}
+	prefixes, err := parsePrefixes(p.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol: %w", err)
+	}
+	return prefixes, nil
+}
+
+// parsePrefixes parses a list of CIDRs and single addresses.
+func parsePrefixes(ss []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// addrIP returns the IP address of a client.
+func addrIP(addr net.Addr) netip.Addr {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(v.IP)
+		return ip.Unmap()
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(v.IP)
+		return ip.Unmap()
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// containsAddr reports whether the IP address of addr is in prefixes.
+func containsAddr(prefixes []netip.Prefix, addr net.Addr) bool {
+	return prefixesContain(prefixes, addrIP(addr))
+}
+
+// prefixesContain reports whether ip is in prefixes.
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, v := range prefixes {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyClient returns the client address and the query of a datagram, which
+// starts with a PROXY protocol v2 header when it is sent by a proxy.
+func proxyClient(proxies []netip.Prefix, addr net.Addr, b []byte) (net.Addr, []byte, error) {
+	if !containsAddr(proxies, addr) {
+		return addr, b, nil
+	}
+	h, n, err := proxyproto.ParseV2(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Local {
+		return addr, b[n:], nil
+	}
+	return h.Source, b[n:], nil
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/proxyproto"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		input []string
+		addr  string
+		want  bool
+		err   bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:53", true, false},
+		{[]string{"10.0.0.0/8"}, "[::ffff:10.1.2.3]:53", true, false},
+		{[]string{"10.1.2.3"}, "10.1.2.4:53", false, false},
+		{[]string{"192.0.2.1", "2001:db8::/32"}, "[2001:db8::1]:53", true, false},
+		{[]string{"10.1.2.3/33"}, "", false, true},
+		{[]string{"localhost"}, "", false, true},
+	} {
+		prefixes, err := parsePrefixes(tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("parsePrefixes(%v) error = %v", tt.input, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		addr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tt.addr))
+		if got := containsAddr(prefixes, addr); got != tt.want {
+			t.Errorf("containsAddr(%v, %v) = %v, want %v", tt.input, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestStream_ProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pln, err := (&ProxyProtocol{Allow: []string{"127.0.0.1"}}).listener(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ServerOptions{MaxConnsPerIP: 1}
+	s := &Stream{Listener: pln, opts: opts, limiter: opts.limiter(), tr: newTracker(), up: echoUpstream, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	dial := func(client string) net.Conn {
+		conn := dialTestStream(t, ln.Addr().String())
+		h := &proxyproto.Header{
+			Source:      net.TCPAddrFromAddrPort(netip.MustParseAddrPort(client)),
+			Destination: ln.Addr().(*net.TCPAddr),
+		}
+		if _, err := conn.Write(h.AppendV1(nil)); err != nil {
+			t.Fatal(err)
+		}
+		writeTestQuery(t, conn, 1, "example.com.")
+		return conn
+	}
+
+	// the connection limit applies to the clients behind the proxy
+	for _, client := range []string{"192.0.2.1:1000", "192.0.2.2:1000"} {
+		if _, err := readTestResponse(dial(client), 2*time.Second); err != nil {
+			t.Fatalf("client %v: %v", client, err)
+		}
+	}
+	if msg, err := readTestResponse(dial("192.0.2.1:1001"), 2*time.Second); err == nil {
+		t.Errorf("second connection of the same client is answered: %v", msg)
+	}
+}
+
+func TestPacket_ProxyProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		allow    []string
+		header   bool
+		answered bool
+	}{
+		{"proxied", []string{"127.0.0.0/8"}, true, true},
+		{"missing header", []string{"127.0.0.0/8"}, false, false},
+		{"not a proxy", []string{"192.0.2.0/24"}, false, true},
+		{"header from client", []string{"192.0.2.0/24"}, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxies, err := (&ProxyProtocol{Allow: tt.allow}).proxies()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Packet{Conn: conn, proxies: proxies, tr: newTracker(), up: echoUpstream, lg: zap.NewNop()}
+			go s.Run()
+			t.Cleanup(func() { s.Close() })
+
+			client, err := net.Dial("udp", conn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			b := []byte{}
+			if tt.header {
+				h := &proxyproto.Header{
+					Source:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353},
+					Destination: conn.LocalAddr(),
+				}
+				b = h.AppendV2(b)
+			}
+			bb, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Write(append(b, bb...)); err != nil {
+				t.Fatal(err)
+			}
+
+			client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, dns.MaxMsgSize)
+			n, err := client.Read(buf)
+			if (err == nil) != tt.answered {
+				t.Fatalf("answered = %v, want %v", err == nil, tt.answered)
+			}
+			if err != nil {
+				return
+			}
+			msg := &dns.Msg{}
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Answer) != 1 {
+				t.Errorf("unexpected response %v, error: %v", msg, err)
+			}
+		})
+	}
+}
@@ -2,68 +2,183 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
 	"github.com/imgk/memory-go"
 )
 
-// NextProtoDQ is the ALPN token for DoQ. During connection establishment,
-// DNS/QUIC support is indicated by selecting the ALPN token "dq" in the
-// crypto handshake.
-// Current draft version:
+// NextProtoDoQ is the ALPN token for DNS over Dedicated QUIC Connections.
+// https://datatracker.ietf.org/doc/html/rfc9250
+const NextProtoDoQ = "doq"
+
+// NextProtoDQ is the ALPN token of the last draft version, which is only
+// offered when ServerOptions.DraftALPN is set. Draft versions do not prefix
+// the message with its length.
 // https://datatracker.ietf.org/doc/html/draft-ietf-dprive-dnsoquic-02
 const NextProtoDQ = "doq-i02"
 
+var draftNextProtos = []string{NextProtoDQ, "doq-i00", "dq"}
+
+// DoQ error codes, RFC 9250 Section 4.3.
+const (
+	DoQNoError          = 0x0
+	DoQInternalError    = 0x1
+	DoQProtocolError    = 0x2
+	DoQRequestCancelled = 0x3
+	DoQExcessiveLoad    = 0x4
+	DoQUnspecifiedError = 0x5
+)
+
+var errDoQProtocol = errors.New("doq protocol error")
+
+// quicLinger is how long a session closed by the server is kept after the
+// last answer, so that the client can receive it. The client closing the
+// session ends it earlier.
+const quicLinger = 500 * time.Millisecond
+
 // Quic is ...
 type Quic struct {
 	// Listener is ...
-	Listener *quic.Listener
+	Listener *quic.EarlyListener
+	// Transport is the transport of Listener, it keeps serving accepted
+	// connections after Listener is closed.
+	Transport *quic.Transport
 
-	up Upstream
-	lg *zap.Logger
+	opts    ServerOptions
+	limiter *connLimiter
+	tr      *tracker
+	up      Upstream
+	lg      *zap.Logger
 }
 
 // Run is ...
 func (s *Quic) Run() {
+	if !s.tr.enter() {
+		return
+	}
+	defer s.tr.leave()
+
 	// accept new session
 	for {
 		sess, err := s.Listener.Accept(context.Background())
 		if err != nil {
-			if strings.Contains(err.Error(), "server closed") {
+			if errors.Is(err, quic.ErrServerClosed) {
 				return
 			}
 			s.lg.Error(fmt.Sprintf("accept session error: %v", err))
 			return
 		}
-		go s.handleSession(sess)
+		if !s.limiter.acquire(sess.RemoteAddr()) {
+			sess.CloseWithError(DoQExcessiveLoad, "too many connections")
+			continue
+		}
+		if !s.tr.track(quicConn{sess}) {
+			s.limiter.release(sess.RemoteAddr())
+			sess.CloseWithError(DoQNoError, "")
+			continue
+		}
+		go func() {
+			defer s.tr.untrack(quicConn{sess})
+			defer s.limiter.release(sess.RemoteAddr())
+			s.handleSession(sess)
+		}()
 	}
 }
 
 // CLose is ...
 func (s *Quic) Close() error {
-	return s.Listener.Close()
+	return multierr.Combine(s.Listener.Close(), s.Transport.Close(), s.Transport.Conn.Close())
 }
 
-func (s *Quic) handleSession(sess quic.Connection) {
-	defer sess.CloseWithError(0, "")
+// Shutdown stops accepting connections and streams and waits for queries in
+// flight until ctx is done.
+func (s *Quic) Shutdown(ctx context.Context) error {
+	err := s.Listener.Close()
+	err = multierr.Append(err, s.tr.shutdown(ctx))
+	return multierr.Combine(err, s.Transport.Close(), s.Transport.Conn.Close())
+}
+
+// quicConn closes a QUIC connection when the grace period is over.
+type quicConn struct {
+	quic.EarlyConnection
+}
+
+func (c quicConn) Close() error {
+	return c.CloseWithError(DoQNoError, "")
+}
+
+func (s *Quic) handleSession(sess quic.EarlyConnection) {
+	// DoQ only uses client-initiated bidirectional streams
+	uni := make(chan struct{})
+	defer func() {
+		sess.CloseWithError(DoQNoError, "")
+		<-uni
+	}()
+	go func() {
+		defer close(uni)
+		if _, err := sess.AcceptUniStream(sess.Context()); err == nil {
+			sess.CloseWithError(DoQProtocolError, "unidirectional stream")
+		}
+	}()
+
+	draft := sess.ConnectionState().TLS.NegotiatedProtocol != NextProtoDoQ
+
+	// wait for queries in flight before closing the session
+	wg := sync.WaitGroup{}
+	lastAnswer := atomic.Int64{}
 
 	// accept new stream
-	for {
-		stream, err := sess.AcceptStream(context.Background())
+	for queries := 0; s.opts.MaxQueries <= 0 || queries < s.opts.MaxQueries; queries++ {
+		// no new streams are accepted while shutting down
+		stream, err := sess.AcceptStream(s.tr.draining)
 		if err != nil {
+			if s.tr.draining.Err() != nil {
+				break
+			}
+			wg.Wait()
+			var (
+				appErr  *quic.ApplicationError
+				idleErr *quic.IdleTimeoutError
+			)
+			if errors.As(err, &appErr) || errors.As(err, &idleErr) || errors.Is(err, context.Canceled) {
+				return
+			}
 			s.lg.Error(fmt.Sprintf("accept stream error: %v", err))
 			return
 		}
-		go s.handleStream(stream)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleStream(sess, stream, draft)
+			lastAnswer.Store(time.Now().UnixNano())
+		}()
+	}
+
+	// the server closes the session, closing right after the last answer
+	// would drop it if it is not received yet
+	wg.Wait()
+	if last := lastAnswer.Load(); last != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, last).Add(quicLinger)))
+		defer timer.Stop()
+		select {
+		case <-sess.Context().Done():
+		case <-s.tr.ctx.Done():
+		case <-timer.C:
+		}
 	}
 }
 
-func (s *Quic) handleStream(stream quic.Stream) {
+func (s *Quic) handleStream(sess quic.EarlyConnection, stream quic.Stream, draft bool) {
 	defer stream.Close()
 
 	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
@@ -72,31 +187,177 @@ func (s *Quic) handleStream(stream quic.Stream) {
 	msg := &dns.Msg{}
 
 	// read message
-	n, err := stream.Read(buf)
+	n, err := readQuicMessage(stream, buf, draft)
 	if err != nil {
+		if errors.Is(err, errDoQProtocol) {
+			s.lg.Error(fmt.Sprintf("server error: %v", err))
+			sess.CloseWithError(DoQProtocolError, err.Error())
+			return
+		}
 		s.lg.Error(fmt.Sprintf("server error: read stream error: %v", err))
 		return
 	}
 	if err := msg.Unpack(buf[:n]); err != nil {
 		s.lg.Error(fmt.Sprintf("server error: unpack error: %v", err))
+		sess.CloseWithError(DoQProtocolError, "malformed message")
 		return
 	}
+	if !draft {
+		if err := checkQuicMessage(msg); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: %v", err))
+			sess.CloseWithError(DoQProtocolError, err.Error())
+			return
+		}
+	}
+
+	// queries carried in 0-RTT data can be replayed, so only those which
+	// are safe to repeat are answered before the handshake completes
+	select {
+	case <-sess.HandshakeComplete():
+	default:
+		if !IsReplaySafe(msg) {
+			// the handshake may never complete, it is not done when the
+			// connection is closed
+			select {
+			case <-sess.HandshakeComplete():
+			case <-sess.Context().Done():
+				return
+			}
+		}
+	}
 
 	// request response
-	msg, err = s.up.Exchange(msg)
+	id := msg.Id
+	msg, err = s.tr.exchange(s.up, &Client{Addr: sess.RemoteAddr(), Transport: "quic", Listener: s.opts.Name}, msg, s.opts.queryTimeout())
+	if errors.Is(err, ErrDropped) {
+		stream.CancelWrite(DoQExcessiveLoad)
+		return
+	}
 	if err != nil {
-		s.lg.Error(fmt.Sprintf("server error: exchange error: %v", err))
+		s.lg.Error(fmt.Sprintf("server error: exchange error for %v: %v", sess.RemoteAddr(), err))
+		stream.CancelWrite(DoQInternalError)
 		return
 	}
+	msg.Id = id
+	removeTCPKeepalive(msg)
 	bb, err := msg.PackBuffer(buf)
 	if err != nil {
 		s.lg.Error(fmt.Sprintf("server error: pack error: %v", err))
+		stream.CancelWrite(DoQInternalError)
 		return
 	}
 
-	// write message
+	// write prefix and message
+	if err := stream.SetWriteDeadline(time.Now().Add(s.opts.writeTimeout())); err != nil {
+		s.lg.Error(fmt.Sprintf("server error: set write deadline error: %v", err))
+		return
+	}
+	if !draft {
+		if _, err := stream.Write([]byte{byte(len(bb) >> 8), byte(len(bb))}); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: write length error: %v", err))
+			return
+		}
+	}
 	if _, err := stream.Write(bb); err != nil {
 		s.lg.Error(fmt.Sprintf("server error: write error: %v", err))
 		return
 	}
 }
+
+// readQuicMessage reads exactly one query from a stream and makes sure the
+// client has closed its sending side afterwards.
+func readQuicMessage(r io.Reader, buf []byte, draft bool) (int, error) {
+	if draft {
+		// draft versions send the bare message and close the stream
+		n := 0
+		for {
+			nr, err := r.Read(buf[n:])
+			n += nr
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			if n == len(buf) {
+				return n, fmt.Errorf("%w: message too long", errDoQProtocol)
+			}
+		}
+	}
+
+	// read prefix
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, fmt.Errorf("%w: stream closed before message length", errDoQProtocol)
+		}
+		return 0, err
+	}
+
+	// read message
+	n := int(buf[0])<<8 | int(buf[1])
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, fmt.Errorf("%w: stream closed before end of message", errDoQProtocol)
+		}
+		return 0, err
+	}
+
+	// wait for STREAM FIN, only one query is allowed on a stream
+	b := [1]byte{}
+	for {
+		nr, err := r.Read(b[:])
+		if nr > 0 {
+			return 0, fmt.Errorf("%w: more than one message on stream", errDoQProtocol)
+		}
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// checkQuicMessage enforces the message rules of RFC 9250 Section 4.2.1.
+func checkQuicMessage(msg *dns.Msg) error {
+	if msg.Id != 0 {
+		return fmt.Errorf("%w: non-zero message id", errDoQProtocol)
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, v := range opt.Option {
+			if v.Option() == dns.EDNS0TCPKEEPALIVE {
+				return fmt.Errorf("%w: edns-tcp-keepalive option", errDoQProtocol)
+			}
+		}
+	}
+	return nil
+}
+
+// IsReplaySafe reports whether a query has no side effects and a small
+// response, so that processing a replayed copy of it does no harm.
+func IsReplaySafe(msg *dns.Msg) bool {
+	if msg.Opcode != dns.OpcodeQuery {
+		return false
+	}
+	for _, v := range msg.Question {
+		switch v.Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR, dns.TypeANY:
+			return false
+		}
+	}
+	return true
+}
+
+func removeTCPKeepalive(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, v := range opt.Option {
+		if v.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, v)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,377 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+type upstreamFunc func(*dns.Msg) (*dns.Msg, error)
+
+func (f upstreamFunc) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return f(in)
+}
+
+// echoUpstream answers every A query with 192.0.2.1.
+var echoUpstream = upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+	out := new(dns.Msg)
+	out.SetReply(in)
+	for _, v := range in.Question {
+		out.Answer = append(out.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: v.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return out, nil
+})
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func newTestQuic(t *testing.T, up Upstream, opts ServerOptions) *Quic {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, ln, err := ListenQuic(conn, newTestTLSConfig(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Quic{Listener: ln, Transport: tr, opts: opts, limiter: opts.limiter(), tr: newTracker(), up: up, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestQuic(t *testing.T, s *Quic, protos ...string) quic.Connection {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, s.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         protos,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn
+}
+
+func packTestQuery(t *testing.T, id uint16, prefix bool) []byte {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = id
+	bb, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix {
+		bb = append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)
+	}
+	return bb
+}
+
+func TestQuic_Exchange(t *testing.T) {
+	s := newTestQuic(t, echoUpstream, ServerOptions{})
+	conn := dialTestQuic(t, s, NextProtoDoQ)
+
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != NextProtoDoQ {
+		t.Fatalf("negotiated protocol = %q, want %q", proto, NextProtoDoQ)
+	}
+
+	// every query uses a new stream on the same connection
+	for i := 0; i < 3; i++ {
+		stream, err := conn.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Write(packTestQuery(t, 0, true)); err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+
+		bb, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bb) < 2 || int(bb[0])<<8|int(bb[1]) != len(bb)-2 {
+			t.Fatalf("invalid length prefix in response of %d bytes", len(bb))
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(bb[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Id != 0 || len(msg.Answer) != 1 {
+			t.Errorf("response id = %d, answers = %d, want 0 and 1", msg.Id, len(msg.Answer))
+		}
+	}
+}
+
+func TestQuic_ProtocolError(t *testing.T) {
+	tests := []struct {
+		name  string
+		query func(t *testing.T) []byte
+	}{{
+		"non-zero id",
+		func(t *testing.T) []byte { return packTestQuery(t, 1, true) },
+	}, {
+		"missing length prefix",
+		func(t *testing.T) []byte { return packTestQuery(t, 0, false) },
+	}, {
+		"two messages",
+		func(t *testing.T) []byte { return append(packTestQuery(t, 0, true), packTestQuery(t, 0, true)...) },
+	}, {
+		"edns-tcp-keepalive",
+		func(t *testing.T) []byte {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.Id = 0
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+			bb, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestQuic(t, echoUpstream, ServerOptions{})
+			conn := dialTestQuic(t, s, NextProtoDoQ)
+
+			stream, err := conn.OpenStreamSync(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Write(tt.query(t))
+			stream.Close()
+
+			_, err = io.ReadAll(stream)
+			var appErr *quic.ApplicationError
+			if !errors.As(err, &appErr) || appErr.ErrorCode != DoQProtocolError {
+				t.Fatalf("read error = %v, want DOQ_PROTOCOL_ERROR", err)
+			}
+		})
+	}
+}
+
+func TestQuic_DraftALPN(t *testing.T) {
+	s := newTestQuic(t, echoUpstream, ServerOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := quic.DialAddr(ctx, s.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{NextProtoDQ},
+	}, nil); err == nil {
+		t.Fatal("draft ALPN accepted without draft_alpn option")
+	}
+
+	s = newTestQuic(t, echoUpstream, ServerOptions{DraftALPN: true})
+	conn := dialTestQuic(t, s, NextProtoDQ)
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(packTestQuery(t, 1234, false)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	bb, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(bb); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1234 {
+		t.Errorf("response id = %d, want 1234", msg.Id)
+	}
+}
+
+func TestQuic_0RTT(t *testing.T) {
+	s := newTestQuic(t, echoUpstream, ServerOptions{Allow0RTT: true})
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{NextProtoDoQ},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// obtain a session ticket
+	conn, err := quic.DialAddr(ctx, s.Listener.Addr().String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(packTestQuery(t, 0, true))
+	stream.Close()
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWithError(0, "")
+
+	// resume with 0-RTT
+	early, err := quic.DialAddrEarly(ctx, s.Listener.Addr().String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.CloseWithError(0, "")
+	stream, err = early.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(packTestQuery(t, 0, true))
+	stream.Close()
+	bb, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !early.ConnectionState().Used0RTT {
+		t.Error("0-RTT was not used")
+	}
+	msg := new(dns.Msg)
+	if len(bb) < 2 || msg.Unpack(bb[2:]) != nil || len(msg.Answer) != 1 {
+		t.Errorf("invalid 0-RTT response")
+	}
+}
+
+func TestIsReplaySafe(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode int
+		qtype  uint16
+		want   bool
+	}{
+		{"query", dns.OpcodeQuery, dns.TypeA, true},
+		{"zone transfer", dns.OpcodeQuery, dns.TypeAXFR, false},
+		{"any", dns.OpcodeQuery, dns.TypeANY, false},
+		{"update", dns.OpcodeUpdate, dns.TypeSOA, false},
+		{"notify", dns.OpcodeNotify, dns.TypeSOA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", tt.qtype)
+			msg.Opcode = tt.opcode
+			if got := IsReplaySafe(msg); got != tt.want {
+				t.Errorf("IsReplaySafe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pendingConn is a connection whose handshake never completes.
+type pendingConn struct {
+	quic.EarlyConnection
+	ctx context.Context
+}
+
+func (c pendingConn) HandshakeComplete() <-chan struct{} { return nil }
+func (c pendingConn) Context() context.Context           { return c.ctx }
+func (c pendingConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 853}
+}
+
+// queryStream is a stream carrying a query.
+type queryStream struct {
+	quic.Stream
+	r io.Reader
+}
+
+func (s queryStream) Read(b []byte) (int, error) { return s.r.Read(b) }
+func (s queryStream) Close() error               { return nil }
+
+func TestQuic_0RTTAbandoned(t *testing.T) {
+	asked := make(chan struct{}, 1)
+	s := &Quic{tr: newTracker(), lg: zap.NewNop(), up: upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		asked <- struct{}{}
+		return echoUpstream(in)
+	})}
+
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeANY)
+	msg.Id = 0
+	bb, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb = append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleStream(pendingConn{ctx: ctx}, queryStream{r: bytes.NewReader(bb)}, false)
+	}()
+
+	// the query which is not safe to replay waits for the handshake
+	select {
+	case <-done:
+		t.Fatal("query answered before the handshake")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// and is given up on when the client abandons the handshake
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream is not released when the connection is closed")
+	}
+	select {
+	case <-asked:
+		t.Error("upstream is asked without a completed handshake")
+	default:
+	}
+}
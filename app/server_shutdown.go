@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// shutdownCloseTimeout is how long handlers may take to return once their
+// connections are closed by force.
+const shutdownCloseTimeout = time.Second
+
+// tracker tracks the connections of a server, so that it can stop accepting
+// queries, wait for the active ones and close whatever is left when the
+// grace period is over.
+type tracker struct {
+	// ctx is canceled when connections are closed by force, queries in
+	// flight give up waiting for the upstream
+	ctx    context.Context
+	cancel context.CancelFunc
+	// draining is canceled when the server stops accepting queries
+	draining      context.Context
+	stopAccepting context.CancelFunc
+
+	mu      sync.Mutex
+	closing bool
+	conns   map[io.Closer]struct{}
+	wg      sync.WaitGroup
+	// active is the number of handlers which entered and did not leave
+	active int
+	// exchanges is the number of upstream exchanges still running, including
+	// the ones given up on, idle is closed when it drops to zero
+	exchanges int
+	idle      chan struct{}
+}
+
+func newTracker() *tracker {
+	t := &tracker{conns: map[io.Closer]struct{}{}}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.draining, t.stopAccepting = context.WithCancel(context.Background())
+	return t
+}
+
+// enter reports whether the server is still running, it must be followed by
+// leave when true.
+func (t *tracker) enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	t.active++
+	return true
+}
+
+func (t *tracker) leave() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// track is enter for a connection which is closed when the grace period is
+// over, it must be followed by untrack when true.
+func (t *tracker) track(c io.Closer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	t.active++
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *tracker) untrack(c io.Closer) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.active--
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// closed reports whether the server is shutting down.
+func (t *tracker) closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// setReadDeadline waits for the next query until the idle timeout, or not at
+// all when the server is shutting down.
+func (t *tracker) setReadDeadline(conn readDeadliner, timeout time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return conn.SetReadDeadline(time.Now())
+	}
+	return conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// exchange asks up for the answer of a query from c, giving up after
+// timeout or when the connections are closed by force. Upstreams can not be
+// interrupted, so an exchange given up on keeps running and is waited for
+// by shutdown.
+func (t *tracker) exchange(up Upstream, c *Client, in *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ctx := t.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	ch := make(chan result, 1)
+	t.mu.Lock()
+	t.exchanges++
+	t.mu.Unlock()
+	go func() {
+		defer t.exchangeDone()
+		msg, err := ExchangeClient(up, c, in)
+		ch <- result{msg: msg, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.msg, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errQueryTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (t *tracker) exchangeDone() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exchanges--
+	if t.exchanges == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// waitExchanges waits for the upstream exchanges until ctx is done, and
+// returns the number of the ones still running.
+func (t *tracker) waitExchanges(ctx context.Context) int {
+	t.mu.Lock()
+	if t.exchanges == 0 {
+		t.mu.Unlock()
+		return 0
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exchanges
+}
+
+// shutdown stops accepting queries and interrupts connections waiting for
+// one, then waits for the rest and the upstream exchanges until ctx is done
+// and closes them. The exchanges still running are reported in the error.
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	for c := range t.conns {
+		if conn, ok := c.(readDeadliner); ok {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	t.mu.Unlock()
+	t.stopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.cancel()
+	case <-ctx.Done():
+		// grace period is over
+		t.cancel()
+		t.mu.Lock()
+		for c := range t.conns {
+			c.Close()
+		}
+		t.mu.Unlock()
+
+		// handlers return once their connections are closed, the ones
+		// which do not are reported rather than waited for forever
+		timer := time.NewTimer(shutdownCloseTimeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			t.mu.Lock()
+			n := t.active
+			t.mu.Unlock()
+			return fmt.Errorf("%w: %d handlers still running", ctx.Err(), n)
+		}
+	}
+
+	if n := t.waitExchanges(ctx); n > 0 {
+		return fmt.Errorf("%w: %d upstream exchanges still running", ctx.Err(), n)
+	}
+	return ctx.Err()
+}
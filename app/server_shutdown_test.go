@@ -0,0 +1,425 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// checkGoroutines fails the test when the number of goroutines does not go
+// back to n.
+func checkGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	for range 100 {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	t.Errorf("%d goroutines left, want %d\n%s", runtime.NumGoroutine(), n, buf)
+}
+
+// waitTracker waits until count of a tracker, one of active or exchanges,
+// is n.
+func waitTracker(t *testing.T, tr *tracker, count *int, n int) {
+	t.Helper()
+
+	for range 100 {
+		tr.mu.Lock()
+		v := *count
+		tr.mu.Unlock()
+		if v == n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("tracker count is not %d", n)
+}
+
+func TestStream_Shutdown(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	s := startTestStream(t, blockingUpstream(release), ServerOptions{})
+
+	idle, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	writeTestQuery(t, busy, 1, "slow.example.")
+	waitTracker(t, s.tr, &s.tr.exchanges, 1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errCh <- s.Shutdown(ctx)
+	}()
+
+	// idle connections are closed right away
+	if _, err := readTestResponse(idle, 2*time.Second); !errors.Is(err, io.EOF) {
+		t.Fatalf("read idle = %v, want io.EOF", err)
+	}
+	if _, err := net.Dial("tcp", s.Listener.Addr().String()); err == nil {
+		t.Error("connection accepted while shutting down")
+	}
+
+	// the query in flight is answered
+	close(release)
+	msg, err := readTestResponse(busy, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1 || len(msg.Answer) != 1 {
+		t.Errorf("unexpected response %v", msg)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+
+	idle.Close()
+	busy.Close()
+	checkGoroutines(t, n)
+}
+
+func TestStream_ShutdownGracePeriod(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	s := startTestStream(t, blockingUpstream(release), ServerOptions{})
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeTestQuery(t, conn, 1, "slow.example.")
+	waitTracker(t, s.tr, &s.tr.exchanges, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 upstream exchanges") {
+		t.Errorf("shutdown error = %v, want 1 upstream exchange reported", err)
+	}
+
+	// the connection is closed without waiting for the upstream
+	if msg, err := readTestResponse(conn, 2*time.Second); err == nil {
+		t.Errorf("unexpected response %v", msg)
+	}
+
+	// only the exchange with the upstream itself is left
+	conn.Close()
+	checkGoroutines(t, n+1)
+	close(release)
+	checkGoroutines(t, n)
+}
+
+func TestStream_ShutdownAbandonedExchange(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	s := startTestStream(t, blockingUpstream(release), ServerOptions{
+		QueryTimeout: caddy.Duration(50 * time.Millisecond),
+	})
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeTestQuery(t, conn, 1, "slow.example.")
+	if msg, err := readTestResponse(conn, 2*time.Second); err != nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("unexpected response %v, error: %v", msg, err)
+	}
+	conn.Close()
+
+	// the exchange given up on is waited for
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errCh <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("shutdown returned %v while the upstream is running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	checkGoroutines(t, n+2)
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+	checkGoroutines(t, n)
+}
+
+func TestPacket_Shutdown(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Packet{Conn: conn, tr: newTracker(), up: blockingUpstream(release), lg: zap.NewNop()}
+	go s.Run()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bb, err := new(dns.Msg).SetQuestion("slow.example.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(bb); err != nil {
+		t.Fatal(err)
+	}
+	waitTracker(t, s.tr, &s.tr.exchanges, 1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errCh <- s.Shutdown(ctx)
+	}()
+
+	close(release)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, dns.MaxMsgSize)
+	nr, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(buf[:nr]); err != nil || len(msg.Answer) != 1 {
+		t.Errorf("unexpected response %v, error: %v", msg, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("shutdown error: %v", err)
+	}
+
+	client.Close()
+	checkGoroutines(t, n)
+}
+
+// dropRelay forwards the packets of a client to addr and drops the packets
+// back, so that the client never completes a handshake.
+func dropRelay(t *testing.T, addr string) (string, func()) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			out.Write(buf[:n])
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, err := out.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		out.Close()
+	}
+}
+
+func TestQuic_Shutdown(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ServerOptions{Allow0RTT: true}
+	tr, ln, err := ListenQuic(conn, newTestTLSConfig(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Quic{Listener: ln, Transport: tr, opts: opts, tr: newTracker(), up: blockingUpstream(release), lg: zap.NewNop()}
+	go s.Run()
+
+	packQuery := func(name string, qtype uint16) []byte {
+		bb, err := new(dns.Msg).SetQuestion(name, qtype).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// DoQ queries have an ID of zero
+		bb[0], bb[1] = 0, 0
+		return append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)
+	}
+
+	// a session ticket for 0-RTT
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "dns.example",
+		NextProtos:         []string{NextProtoDoQ},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := quic.DialAddr(ctx, ln.Addr().String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(packQuery("slow.example.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	waitTracker(t, s.tr, &s.tr.exchanges, 1)
+	for i := 0; ; i++ {
+		if _, ok := tlsConfig.ClientSessionCache.Get(tlsConfig.ServerName); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no session ticket")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a session which never completes the handshake, with a query which is
+	// not answered in 0-RTT data
+	relay, closeRelay := dropRelay(t, ln.Addr().String())
+	early, err := quic.DialAddrEarly(ctx, relay, tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlyStream, err := early.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlyStream.Write(packQuery("example.com.", dns.TypeANY))
+	earlyStream.Close()
+	waitTracker(t, s.tr, &s.tr.active, 3)
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		errCh <- s.Shutdown(ctx)
+	}()
+
+	// the query in flight is answered
+	close(release)
+	bb, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &dns.Msg{}
+	if len(bb) < 2 {
+		t.Fatalf("short response of %d bytes", len(bb))
+	}
+	if err := msg.Unpack(bb[2:]); err != nil || len(msg.Answer) != 1 {
+		t.Errorf("unexpected response %v, error: %v", msg, err)
+	}
+
+	// the stuck session is closed when the grace period is over
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "still running") {
+			t.Errorf("shutdown error = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown does not return")
+	}
+
+	client.CloseWithError(0, "")
+	early.CloseWithError(0, "")
+	closeRelay()
+	checkGoroutines(t, n)
+}
+
+// stuckCloser is a connection of which the handler does not return when
+// it is closed.
+type stuckCloser struct{}
+
+func (stuckCloser) Close() error { return nil }
+
+func TestTracker_ShutdownStuck(t *testing.T) {
+	tr := newTracker()
+	c := stuckCloser{}
+	if !tr.track(c) {
+		t.Fatal("connection is not tracked")
+	}
+	release := make(chan struct{})
+	go func() {
+		<-release
+		tr.untrack(c)
+	}()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := tr.shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 handlers still running") {
+		t.Errorf("shutdown error = %v, want 1 handler reported", err)
+	}
+	if d := time.Since(start); d > shutdownCloseTimeout+time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+}
+
+func TestApp_GracePeriod(t *testing.T) {
+	for _, tt := range []struct {
+		grace caddy.Duration
+		want  time.Duration
+	}{
+		{0, DefaultGracePeriod},
+		{caddy.Duration(time.Second), time.Second},
+		{-1, 0},
+	} {
+		app := &App{GracePeriod: tt.grace}
+		if got := app.gracePeriod(); got != tt.want {
+			t.Errorf("grace period %v = %v, want %v", tt.grace, got, tt.want)
+		}
+	}
+
+	if got := (&ServerOptions{}).queryTimeout(); got != DefaultQueryTimeout {
+		t.Errorf("query timeout = %v, want %v", got, DefaultQueryTimeout)
+	}
+}
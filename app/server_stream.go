@@ -1,29 +1,44 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
 	"github.com/imgk/memory-go"
 )
 
+// DefaultMaxInFlight is the default of ServerOptions.MaxInFlight.
+const DefaultMaxInFlight = 32
+
 // Stream is ...
 type Stream struct {
 	// Listener is ...
 	net.Listener
 
-	up Upstream
-	lg *zap.Logger
+	transport string
+	opts      ServerOptions
+	limiter   *connLimiter
+	tr        *tracker
+	up        Upstream
+	lg        *zap.Logger
 }
 
 // Run is ..
 func (s *Stream) Run() {
+	if !s.tr.enter() {
+		return
+	}
+	defer s.tr.leave()
+
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
@@ -33,65 +48,134 @@ func (s *Stream) Run() {
 			s.lg.Error(fmt.Sprintf("server error: accept error: %v", err))
 			return
 		}
+		if !s.tr.track(conn) {
+			conn.Close()
+			continue
+		}
 		// handle net.Conn
-		go func(conn net.Conn, up Upstream) {
-			defer conn.Close()
-
-			ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
-			defer memory.Free(ptr)
-
-			msg := &dns.Msg{}
-
-			// handle message loop
-			for {
-				if err := conn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
-					s.lg.Error(fmt.Sprintf("server error: net.Conn.SetReadDeadline error: %v", err))
-					return
-				}
-
-				// read prefix
-				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-					if ne, ok := err.(net.Error); errors.Is(err, io.EOF) || (ok && ne.Timeout()) {
-						return
-					}
-					s.lg.Error(fmt.Sprintf("server error: read length error: %v", err))
-					return
-				}
-
-				// read message
-				n := int(buf[0])<<8 | int(buf[1])
-				if _, err := io.ReadFull(conn, buf[:n]); err != nil {
-					s.lg.Error(fmt.Sprintf("server error: read message error: %v", err))
-					return
-				}
-				if err := msg.Unpack(buf[:n]); err != nil {
-					s.lg.Error(fmt.Sprintf("server error: unpack error: %v", err))
-					return
-				}
-
-				// request response
-				msg, err = up.Exchange(msg)
-				if err != nil {
-					s.lg.Error(fmt.Sprintf("server error: exchange error: %v", err))
-					return
-				}
-				bb, err := msg.PackBuffer(buf)
-				if err != nil {
-					s.lg.Error(fmt.Sprintf("server error: pack error: %v", err))
-					return
-				}
-
-				// write prefix and message
-				if _, err := conn.Write([]byte{byte(len(bb) >> 8), byte(len(bb))}); err != nil {
-					s.lg.Error(fmt.Sprintf("server error: write length error: %v", err))
-					return
-				}
-				if _, err := conn.Write(bb); err != nil {
-					s.lg.Error(fmt.Sprintf("server error: write message error: %v", err))
-					return
-				}
+		go func() {
+			defer s.tr.untrack(conn)
+
+			// the address of the client is known after the PROXY protocol
+			// header is read
+			addr := conn.RemoteAddr()
+			if !s.limiter.acquire(addr) {
+				conn.Close()
+				return
+			}
+			defer s.limiter.release(addr)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// handleConn reads pipelined queries from a connection and answers them
+// concurrently, RFC 7766 Section 6.2.1.1. Replies are written in the order
+// they are ready, and reading pauses while MaxInFlight queries are pending.
+func (s *Stream) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	// wait for queries in flight before closing the connection
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	sem := make(chan struct{}, s.opts.maxInFlight())
+	mu := &sync.Mutex{}
+
+	prefix := [2]byte{}
+	for queries := 0; s.opts.MaxQueries <= 0 || queries < s.opts.MaxQueries; queries++ {
+		if err := s.tr.setReadDeadline(conn, s.opts.idleTimeout(DefaultStreamIdleTimeout)); err != nil {
+			s.lg.Error(fmt.Sprintf("server error: net.Conn.SetReadDeadline error: %v", err))
+			return
+		}
+
+		// read prefix
+		if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+			if ne, ok := err.(net.Error); errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || (ok && ne.Timeout()) {
+				return
+			}
+			if s.tr.closed() {
+				return
+			}
+			s.lg.Error(fmt.Sprintf("server error: read length error: %v", err))
+			return
+		}
+
+		// read message
+		sem <- struct{}{}
+		ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
+		n := int(prefix[0])<<8 | int(prefix[1])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			memory.Free(ptr)
+			<-sem
+			if !s.tr.closed() {
+				s.lg.Error(fmt.Sprintf("server error: read message error: %v", err))
 			}
-		}(conn, s.up)
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				memory.Free(ptr)
+				<-sem
+				wg.Done()
+			}()
+			s.serveQuery(conn, mu, buf, n)
+		}()
+	}
+}
+
+// serveQuery answers the query in buf[:n], writes are serialized by mu.
+func (s *Stream) serveQuery(conn net.Conn, mu *sync.Mutex, buf []byte, n int) {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(buf[:n]); err != nil {
+		s.lg.Error(fmt.Sprintf("server error: unpack error: %v", err))
+		conn.Close()
+		return
+	}
+
+	// edns-tcp-keepalive is hop-by-hop and must not reach the upstream
+	keepalive := tcpKeepalive(msg) != nil
+	removeTCPKeepalive(msg)
+
+	// request response
+	client := &Client{Addr: conn.RemoteAddr(), Transport: s.transport, Listener: s.opts.Name}
+	out, err := s.tr.exchange(s.up, client, msg, s.opts.queryTimeout())
+	if errors.Is(err, ErrDropped) {
+		return
+	}
+	if err != nil {
+		s.lg.Error(fmt.Sprintf("server error: exchange error for %v: %v", client.Addr, err))
+		out = new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure)
+	}
+	// replies are matched to queries by id only
+	out.Id = msg.Id
+	if keepalive && s.opts.TCPKeepalive {
+		setTCPKeepalive(out, s.opts.idleTimeout(DefaultStreamIdleTimeout))
+	} else {
+		removeTCPKeepalive(out)
+	}
+	bb, err := out.PackBuffer(buf)
+	if err != nil {
+		s.lg.Error(fmt.Sprintf("server error: pack error: %v", err))
+		conn.Close()
+		return
+	}
+
+	// write prefix and message
+	mu.Lock()
+	defer mu.Unlock()
+	if err := conn.SetWriteDeadline(time.Now().Add(s.opts.writeTimeout())); err != nil {
+		s.lg.Error(fmt.Sprintf("server error: net.Conn.SetWriteDeadline error: %v", err))
+		conn.Close()
+		return
+	}
+	if _, err := (&net.Buffers{{byte(len(bb) >> 8), byte(len(bb))}, bb}).WriteTo(conn); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			s.lg.Error(fmt.Sprintf("server error: write message error: %v", err))
+		}
+		conn.Close()
 	}
 }
 
@@ -99,3 +183,13 @@ func (s *Stream) Run() {
 func (s *Stream) Close() error {
 	return s.Listener.Close()
 }
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// queries in flight until ctx is done.
+func (s *Stream) Shutdown(ctx context.Context) error {
+	err := s.Listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return multierr.Append(err, s.tr.shutdown(ctx))
+}
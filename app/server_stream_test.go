@@ -0,0 +1,273 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func startTestStream(t *testing.T, up Upstream, opts ServerOptions) *Stream {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Stream{Listener: ln, opts: opts, limiter: opts.limiter(), tr: newTracker(), up: up, lg: zap.NewNop()}
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestStream(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestStream(t *testing.T, up Upstream, maxInFlight int) net.Conn {
+	t.Helper()
+
+	s := startTestStream(t, up, ServerOptions{MaxInFlight: maxInFlight})
+	return dialTestStream(t, s.Listener.Addr().String())
+}
+
+func writeTestQuery(t *testing.T, conn net.Conn, id uint16, name string) {
+	t.Helper()
+
+	msg := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	msg.Id = id
+	bb, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestResponse(conn net.Conn, timeout time.Duration) (*dns.Msg, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	bb := make([]byte, int(prefix[0])<<8|int(prefix[1]))
+	if _, err := io.ReadFull(conn, bb); err != nil {
+		return nil, err
+	}
+	msg := &dns.Msg{}
+	return msg, msg.Unpack(bb)
+}
+
+// blockingUpstream holds queries for slow.example. until release is closed.
+func blockingUpstream(release chan struct{}) Upstream {
+	return upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		if in.Question[0].Name == "slow.example." {
+			<-release
+		}
+		return echoUpstream(in)
+	})
+}
+
+func TestStream_Pipelining(t *testing.T) {
+	release := make(chan struct{})
+	conn := newTestStream(t, blockingUpstream(release), 0)
+
+	writeTestQuery(t, conn, 1, "slow.example.")
+	writeTestQuery(t, conn, 2, "fast.example.")
+	writeTestQuery(t, conn, 3, "fast.example.")
+
+	// the fast queries are answered while the slow one is in flight
+	got := map[uint16]bool{}
+	for range 2 {
+		msg, err := readTestResponse(conn, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[msg.Id] = true
+	}
+	if !got[2] || !got[3] {
+		t.Fatalf("answered %v before the slow query, want 2 and 3", got)
+	}
+
+	close(release)
+	msg, err := readTestResponse(conn, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1 || len(msg.Answer) != 1 {
+		t.Errorf("unexpected response %v", msg)
+	}
+}
+
+func TestStream_MaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	conn := newTestStream(t, blockingUpstream(release), 1)
+
+	writeTestQuery(t, conn, 1, "slow.example.")
+	writeTestQuery(t, conn, 2, "fast.example.")
+
+	// the second query waits for the only slot
+	_, err := readTestResponse(conn, 100*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read = %v, want timeout", err)
+	}
+
+	close(release)
+	for _, id := range []uint16{1, 2} {
+		msg, err := readTestResponse(conn, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Id != id {
+			t.Errorf("id = %d, want %d", msg.Id, id)
+		}
+	}
+}
+
+func TestStream_ExchangeError(t *testing.T) {
+	conn := newTestStream(t, upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("no upstream")
+	}), 0)
+
+	writeTestQuery(t, conn, 7, "example.com.")
+	msg, err := readTestResponse(conn, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 7 || msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected response %v", msg)
+	}
+}
+
+func TestStream_QueryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := startTestStream(t, blockingUpstream(release), ServerOptions{
+		QueryTimeout: caddy.Duration(50 * time.Millisecond),
+	})
+	conn := dialTestStream(t, s.Listener.Addr().String())
+
+	writeTestQuery(t, conn, 1, "slow.example.")
+	msg, err := readTestResponse(conn, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1 || msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected response %v", msg)
+	}
+}
+
+func TestStream_MaxQueries(t *testing.T) {
+	s := startTestStream(t, echoUpstream, ServerOptions{MaxQueries: 2})
+	conn := dialTestStream(t, s.Listener.Addr().String())
+
+	for id := range uint16(3) {
+		writeTestQuery(t, conn, id, "example.com.")
+	}
+	got := map[uint16]bool{}
+	for range 2 {
+		msg, err := readTestResponse(conn, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[msg.Id] = true
+	}
+	if !got[0] || !got[1] {
+		t.Errorf("answered %v, want 0 and 1", got)
+	}
+
+	// the third query is not read, closing may reset the connection
+	_, err := readTestResponse(conn, 2*time.Second)
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Errorf("read = %v, want connection closed", err)
+	}
+}
+
+func TestStream_MaxConns(t *testing.T) {
+	addr := startTestStream(t, echoUpstream, ServerOptions{MaxConns: 1}).Listener.Addr().String()
+
+	first := dialTestStream(t, addr)
+	writeTestQuery(t, first, 1, "example.com.")
+	if _, err := readTestResponse(first, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second connection is closed while the first one is open
+	second := dialTestStream(t, addr)
+	writeTestQuery(t, second, 2, "example.com.")
+	if _, err := readTestResponse(second, 2*time.Second); err == nil {
+		t.Fatal("second connection is answered")
+	}
+
+	first.Close()
+	for range 20 {
+		conn := dialTestStream(t, addr)
+		writeTestQuery(t, conn, 3, "example.com.")
+		if _, err := readTestResponse(conn, 2*time.Second); err == nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("connection is refused after the first one is closed")
+}
+
+func TestStream_TCPKeepalive(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		enabled   bool
+		keepalive bool
+		want      bool
+	}{
+		{"enabled", true, true, true},
+		{"not asked", true, false, false},
+		{"disabled", false, true, false},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			s := startTestStream(t, echoUpstream, ServerOptions{
+				IdleTimeout:  caddy.Duration(30 * time.Second),
+				TCPKeepalive: v.enabled,
+			})
+			conn := dialTestStream(t, s.Listener.Addr().String())
+
+			msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			if v.keepalive {
+				msg.SetEdns0(dns.DefaultMsgSize, false)
+				opt := msg.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+			}
+			bb, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(append([]byte{byte(len(bb) >> 8), byte(len(bb))}, bb...)); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := readTestResponse(conn, 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ka := tcpKeepalive(out)
+			if (ka != nil) != v.want {
+				t.Fatalf("keepalive = %v, want %v", ka, v.want)
+			}
+			if ka != nil && ka.Timeout != 300 {
+				t.Errorf("timeout = %d, want 300", ka.Timeout)
+			}
+		})
+	}
+}
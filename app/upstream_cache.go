@@ -41,6 +41,11 @@ func (m *Cache) Provision(ctx caddy.Context) error {
 
 // Exchange is ...
 func (m *Cache) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return m.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c.
+func (m *Cache) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
 	for i := range in.Question {
 		rr, ok := m.data[in.Question[i].Name]
 		if ok {
@@ -49,7 +54,7 @@ func (m *Cache) Exchange(in *dns.Msg) (*dns.Msg, error) {
 			return in, nil
 		}
 	}
-	out, err := m.upstream.Exchange(in)
+	out, err := ExchangeClient(m.upstream, c, in)
 	if err != nil || len(out.Answer) == 0 {
 		return out, err
 	}
@@ -57,4 +62,4 @@ func (m *Cache) Exchange(in *dns.Msg) (*dns.Msg, error) {
 	return out, nil
 }
 
-var _ Upstream = (*Cache)(nil)
+var _ ClientUpstream = (*Cache)(nil)
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(ClientSubnet{})
+}
+
+// Actions of ClientSubnet.
+const (
+	// ClientSubnetAdd adds the subnet of the client to the queries without
+	// an EDNS Client Subnet option.
+	ClientSubnetAdd = "add"
+	// ClientSubnetReplace sets the option to the subnet of the client,
+	// replacing the option of the query. The option is removed when the
+	// client is not known.
+	ClientSubnetReplace = "replace"
+	// ClientSubnetTruncate shortens the option of the query to IPv4Prefix
+	// or IPv6Prefix.
+	ClientSubnetTruncate = "truncate"
+	// ClientSubnetStrip removes the option.
+	ClientSubnetStrip = "strip"
+)
+
+// ClientSubnet handles the EDNS Client Subnet option of queries before
+// asking the next upstream, so that CDNs answer with servers close to the
+// clients without the full address of a client being sent. The subnet of a
+// client is taken from its address, and is not added for private and
+// other addresses which are not global unicast ones. Responses carry the
+// option as sent by the client, or none when the client did not send one.
+type ClientSubnet struct {
+	// Action is "add", "replace", "truncate" or "strip", "add" by default.
+	Action string `json:"action,omitempty"`
+	// IPv4Prefix is the longest prefix of IPv4 subnets, 24 by default.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	// IPv6Prefix is the longest prefix of IPv6 subnets, 56 by default.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// UpstreamRaw is the upstream asked with the changed queries.
+	UpstreamRaw json.RawMessage `json:"next" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+
+	upstream Upstream
+}
+
+// CaddyModule is ...
+func (ClientSubnet) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.upstreams.client_subnet",
+		New: func() caddy.Module { return new(ClientSubnet) },
+	}
+}
+
+// Provision is ...
+func (m *ClientSubnet) Provision(ctx caddy.Context) error {
+	mod, err := ctx.LoadModule(m, "UpstreamRaw")
+	if err != nil {
+		return err
+	}
+	m.upstream = mod.(Upstream)
+	return m.provision()
+}
+
+func (m *ClientSubnet) provision() error {
+	switch m.Action {
+	case "":
+		m.Action = ClientSubnetAdd
+	case ClientSubnetAdd, ClientSubnetReplace, ClientSubnetTruncate, ClientSubnetStrip:
+	default:
+		return fmt.Errorf("client_subnet: unknown action %q", m.Action)
+	}
+	if m.IPv4Prefix == 0 {
+		m.IPv4Prefix = 24
+	}
+	if m.IPv6Prefix == 0 {
+		m.IPv6Prefix = 56
+	}
+	if m.IPv4Prefix < 0 || m.IPv4Prefix > 32 || m.IPv6Prefix < 0 || m.IPv6Prefix > 128 {
+		return fmt.Errorf("client_subnet: invalid prefix length %d or %d", m.IPv4Prefix, m.IPv6Prefix)
+	}
+	return nil
+}
+
+// Exchange is ...
+func (m *ClientSubnet) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return m.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c.
+func (m *ClientSubnet) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	ecs := ecsOption(in)
+	subnet, ok := m.subnet(c, ecs)
+	if !ok {
+		return ExchangeClient(m.upstream, c, in)
+	}
+
+	q := in.Copy()
+	removeECS(q)
+	if subnet.IsValid() {
+		if q.IsEdns0() == nil {
+			q.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, newECS(subnet))
+	}
+	out, err := exchangeCopy(m.upstream, c, q)
+	if err != nil || out == nil {
+		return out, err
+	}
+
+	switch {
+	case in.IsEdns0() == nil:
+		extra := out.Extra[:0]
+		for _, rr := range out.Extra {
+			if _, ok := rr.(*dns.OPT); !ok {
+				extra = append(extra, rr)
+			}
+		}
+		out.Extra = extra
+	case ecs == nil:
+		removeECS(out)
+	default:
+		scope := uint8(0)
+		if v := ecsOption(out); v != nil {
+			scope = min(v.SourceScope, ecs.SourceNetmask)
+		}
+		removeECS(out)
+		if opt := out.IsEdns0(); opt != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        ecs.Family,
+				SourceNetmask: ecs.SourceNetmask,
+				SourceScope:   scope,
+				Address:       ecs.Address,
+			})
+		}
+	}
+	return out, nil
+}
+
+// subnet returns the subnet to send for a query from c with the option
+// ecs, which is the zero Prefix to send none, and ok is false when the
+// query is sent as it is.
+func (m *ClientSubnet) subnet(c *Client, ecs *dns.EDNS0_SUBNET) (subnet netip.Prefix, ok bool) {
+	switch m.Action {
+	case ClientSubnetStrip:
+		return netip.Prefix{}, ecs != nil
+	case ClientSubnetTruncate:
+		if ecs == nil {
+			return netip.Prefix{}, false
+		}
+		prefix, ok := ecsPrefix(ecs)
+		if !ok {
+			return netip.Prefix{}, true
+		}
+		return m.truncate(prefix.Addr(), prefix.Bits()), true
+	case ClientSubnetAdd:
+		if ecs != nil {
+			return netip.Prefix{}, false
+		}
+	}
+
+	ip := netip.Addr{}
+	if c != nil && c.Addr != nil {
+		ip = addrIP(c.Addr)
+	}
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return netip.Prefix{}, ecs != nil
+	}
+	return m.truncate(ip, ip.BitLen()), true
+}
+
+// truncate returns the prefix of ip with at most bits, or the limit of
+// its family.
+func (m *ClientSubnet) truncate(ip netip.Addr, bits int) netip.Prefix {
+	limit := m.IPv6Prefix
+	if ip.Is4() {
+		limit = m.IPv4Prefix
+	}
+	prefix, _ := ip.Prefix(min(bits, limit))
+	return prefix
+}
+
+// newECS returns an EDNS Client Subnet option of a prefix.
+func newECS(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       prefix.Addr().AsSlice(),
+	}
+	if prefix.Addr().Is6() {
+		ecs.Family = 2
+	}
+	return ecs
+}
+
+// removeECS removes the EDNS Client Subnet options of a message.
+func removeECS(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, v := range opt.Option {
+		if _, ok := v.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, v)
+		}
+	}
+	opt.Option = options
+}
+
+var (
+	_ ClientUpstream    = (*ClientSubnet)(nil)
+	_ caddy.Provisioner = (*ClientSubnet)(nil)
+)
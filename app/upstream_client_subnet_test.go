@@ -0,0 +1,110 @@
+package app
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ecsString returns the subnet of an EDNS Client Subnet option as
+// address/bits, or "" without one.
+func ecsString(msg *dns.Msg) string {
+	ecs := ecsOption(msg)
+	if ecs == nil {
+		return ""
+	}
+	prefix, ok := ecsPrefix(ecs)
+	if !ok {
+		return "invalid"
+	}
+	return prefix.String()
+}
+
+func TestClientSubnet(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		up     ClientSubnet
+		client string
+		msg    *dns.Msg
+		want   string
+	}{
+		{"add ipv4", ClientSubnet{}, "192.0.2.1", ecsQuery(0, 0, ""), "192.0.2.0/24"},
+		{"add ipv6", ClientSubnet{}, "2001:db8:1:2::1", ecsQuery(0, 0, ""), "2001:db8:1::/56"},
+		{"add without edns", ClientSubnet{}, "192.0.2.1", new(dns.Msg).SetQuestion("example.com.", dns.TypeA), "192.0.2.0/24"},
+		{"add prefix", ClientSubnet{IPv4Prefix: 16}, "192.0.2.1", ecsQuery(0, 0, ""), "192.0.0.0/16"},
+		{"add private", ClientSubnet{}, "10.0.0.1", ecsQuery(0, 0, ""), ""},
+		{"add loopback", ClientSubnet{}, "127.0.0.1", ecsQuery(0, 0, ""), ""},
+		{"add unknown client", ClientSubnet{}, "", ecsQuery(0, 0, ""), ""},
+		{"add existing", ClientSubnet{}, "192.0.2.1", ecsQuery(1, 32, "198.51.100.1"), "198.51.100.1/32"},
+		{"replace", ClientSubnet{Action: ClientSubnetReplace}, "192.0.2.1", ecsQuery(1, 32, "198.51.100.1"), "192.0.2.0/24"},
+		{"replace private", ClientSubnet{Action: ClientSubnetReplace}, "10.0.0.1", ecsQuery(1, 32, "198.51.100.1"), ""},
+		{"truncate", ClientSubnet{Action: ClientSubnetTruncate}, "192.0.2.1", ecsQuery(1, 32, "198.51.100.1"), "198.51.100.0/24"},
+		{"truncate short", ClientSubnet{Action: ClientSubnetTruncate}, "192.0.2.1", ecsQuery(1, 16, "198.51.0.0"), "198.51.0.0/16"},
+		{"truncate ipv6", ClientSubnet{Action: ClientSubnetTruncate}, "192.0.2.1", ecsQuery(2, 128, "2001:db8:1:2::1"), "2001:db8:1::/56"},
+		{"truncate none", ClientSubnet{Action: ClientSubnetTruncate}, "192.0.2.1", ecsQuery(0, 0, ""), ""},
+		{"strip", ClientSubnet{Action: ClientSubnetStrip}, "192.0.2.1", ecsQuery(1, 32, "198.51.100.1"), ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent *dns.Msg
+			up := tt.up
+			up.upstream = upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+				sent = in
+				out, _ := echoUpstream(in)
+				if opt := in.IsEdns0(); opt != nil {
+					out.SetEdns0(dns.DefaultMsgSize, false)
+					if ecs := ecsOption(in); ecs != nil {
+						scoped := *ecs
+						scoped.SourceScope = ecs.SourceNetmask
+						out.IsEdns0().Option = append(out.IsEdns0().Option, &scoped)
+					}
+				}
+				return out, nil
+			})
+			if err := up.provision(); err != nil {
+				t.Fatal(err)
+			}
+			c := &Client{}
+			if tt.client != "" {
+				c.Addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(tt.client), 53))
+			}
+			query := tt.msg.Copy()
+			out, err := up.ExchangeClient(c, tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ecsString(sent); got != tt.want {
+				t.Errorf("forwarded subnet = %q, want %q", got, tt.want)
+			}
+			if tt.msg.String() != query.String() {
+				t.Errorf("query is changed: %v", tt.msg)
+			}
+
+			// the response has the option of the query
+			if (out.IsEdns0() == nil) != (query.IsEdns0() == nil) {
+				t.Errorf("response edns = %v, want %v", out.IsEdns0() != nil, query.IsEdns0() != nil)
+			}
+			if got, want := ecsString(out), ecsString(query); got != want {
+				t.Errorf("response subnet = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClientSubnet_Provision(t *testing.T) {
+	for _, tt := range []struct {
+		up  ClientSubnet
+		err bool
+	}{
+		{ClientSubnet{}, false},
+		{ClientSubnet{Action: ClientSubnetStrip}, false},
+		{ClientSubnet{Action: "hide"}, true},
+		{ClientSubnet{IPv4Prefix: 33}, true},
+		{ClientSubnet{IPv6Prefix: -1}, true},
+	} {
+		if err := tt.up.provision(); (err != nil) != tt.err {
+			t.Errorf("%+v: error = %v", tt.up, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(GeoIPFilter{})
+}
+
+// Actions of GeoIPFilter.
+const (
+	// GeoIPDrop removes the addresses outside the countries from answers.
+	GeoIPDrop = "drop"
+	// GeoIPRewrite replaces the addresses outside the countries with
+	// RewriteIPv4 and RewriteIPv6.
+	GeoIPRewrite = "rewrite"
+	// GeoIPFallback asks the fallback upstream when an answer has an
+	// address outside the countries.
+	GeoIPFallback = "fallback"
+)
+
+// GeoIPFilter checks where the addresses of the answers of the next
+// upstream are, for split routing and against poisoned answers.
+type GeoIPFilter struct {
+	// Database is the path of a MaxMind DB (.mmdb) or a V2Ray geoip.dat
+	// file.
+	Database string `json:"database,omitempty"`
+	// Countries is the allowed countries of addresses, which are ISO codes
+	// such as "CN" for a MaxMind DB and codes such as "cn" or "private" for
+	// geoip.dat.
+	Countries []string `json:"countries,omitempty"`
+	// Action is "drop", "rewrite" or "fallback", "drop" by default.
+	Action string `json:"action,omitempty"`
+	// RewriteIPv4 is the address of A records of the "rewrite" action,
+	// 0.0.0.0 by default.
+	RewriteIPv4 string `json:"rewrite_ipv4,omitempty"`
+	// RewriteIPv6 is the address of AAAA records of the "rewrite" action,
+	// :: by default.
+	RewriteIPv6 string `json:"rewrite_ipv6,omitempty"`
+	// UpstreamRaw is the upstream the answers of which are checked.
+	UpstreamRaw json.RawMessage `json:"next" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+	// FallbackRaw is the upstream of the "fallback" action.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+
+	upstream Upstream
+	fallback Upstream
+	allowed  ipSet
+	rewrite4 netip.Addr
+	rewrite6 netip.Addr
+}
+
+// CaddyModule is ...
+func (GeoIPFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.upstreams.geoip_filter",
+		New: func() caddy.Module { return new(GeoIPFilter) },
+	}
+}
+
+// Provision is ...
+func (m *GeoIPFilter) Provision(ctx caddy.Context) error {
+	mod, err := ctx.LoadModule(m, "UpstreamRaw")
+	if err != nil {
+		return err
+	}
+	m.upstream = mod.(Upstream)
+	if len(m.FallbackRaw) > 0 {
+		mod, err := ctx.LoadModule(m, "FallbackRaw")
+		if err != nil {
+			return err
+		}
+		m.fallback = mod.(Upstream)
+	}
+	return m.provision()
+}
+
+func (m *GeoIPFilter) provision() error {
+	if m.Database == "" || len(m.Countries) == 0 {
+		return errors.New("geoip_filter: no database or countries")
+	}
+	switch m.Action {
+	case "":
+		m.Action = GeoIPDrop
+	case GeoIPDrop, GeoIPRewrite:
+	case GeoIPFallback:
+		if m.fallback == nil {
+			return errors.New("geoip_filter: no fallback upstream")
+		}
+	default:
+		return fmt.Errorf("geoip_filter: unknown action %q", m.Action)
+	}
+
+	m.rewrite4, m.rewrite6 = netip.IPv4Unspecified(), netip.IPv6Unspecified()
+	for _, v := range []struct {
+		s    string
+		addr *netip.Addr
+		is4  bool
+	}{
+		{m.RewriteIPv4, &m.rewrite4, true},
+		{m.RewriteIPv6, &m.rewrite6, false},
+	} {
+		if v.s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(v.s)
+		if err != nil || addr.Is4() != v.is4 {
+			return fmt.Errorf("geoip_filter: invalid rewrite address %q", v.s)
+		}
+		*v.addr = addr
+	}
+
+	data, err := os.ReadFile(m.Database)
+	if err != nil {
+		return fmt.Errorf("geoip_filter: %w", err)
+	}
+	m.allowed, err = geoIPSet(data, m.Countries)
+	if err != nil {
+		return fmt.Errorf("geoip_filter: load %v: %w", m.Database, err)
+	}
+	return nil
+}
+
+// Exchange is ...
+func (m *GeoIPFilter) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return m.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c.
+func (m *GeoIPFilter) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	out, err := exchangeCopy(m.upstream, c, in)
+	if err != nil || out == nil || m.allowedAnswer(out) {
+		return out, err
+	}
+
+	switch m.Action {
+	case GeoIPFallback:
+		return ExchangeClient(m.fallback, c, in)
+	case GeoIPRewrite:
+		for i, rr := range out.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				if !m.allowed.contains(answerAddr(v.A)) {
+					out.Answer[i] = &dns.A{Hdr: v.Hdr, A: m.rewrite4.AsSlice()}
+				}
+			case *dns.AAAA:
+				if !m.allowed.contains(answerAddr(v.AAAA)) {
+					out.Answer[i] = &dns.AAAA{Hdr: v.Hdr, AAAA: m.rewrite6.AsSlice()}
+				}
+			}
+		}
+		return out, nil
+	default:
+		answer := out.Answer[:0]
+		for _, rr := range out.Answer {
+			if ip, ok := rrAddr(rr); !ok || m.allowed.contains(ip) {
+				answer = append(answer, rr)
+			}
+		}
+		out.Answer = answer
+		return out, nil
+	}
+}
+
+// allowedAnswer tells whether all the addresses of a response are allowed.
+func (m *GeoIPFilter) allowedAnswer(out *dns.Msg) bool {
+	for _, rr := range out.Answer {
+		if ip, ok := rrAddr(rr); ok && !m.allowed.contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// rrAddr returns the address of an A or AAAA record.
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	switch v := rr.(type) {
+	case *dns.A:
+		return answerAddr(v.A), true
+	case *dns.AAAA:
+		return answerAddr(v.AAAA), true
+	}
+	return netip.Addr{}, false
+}
+
+func answerAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+var (
+	_ ClientUpstream    = (*GeoIPFilter)(nil)
+	_ caddy.Provisioner = (*GeoIPFilter)(nil)
+)
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerUpstream answers with A records of ips.
+func answerUpstream(ips ...string) upstreamFunc {
+	return func(in *dns.Msg) (*dns.Msg, error) {
+		out := new(dns.Msg).SetReply(in)
+		out.Answer = append(out.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: in.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "cdn.example.",
+		})
+		for _, v := range ips {
+			out.Answer = append(out.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "cdn.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(v),
+			})
+		}
+		return out, nil
+	}
+}
+
+func TestGeoIPFilter(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(database, testGeoIP(map[string][]string{"CN": {"1.0.1.0/24"}, "US": {"8.8.8.0/24"}}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	answers := func(out *dns.Msg) []string {
+		ss := []string{}
+		for _, rr := range out.Answer {
+			if v, ok := rr.(*dns.A); ok {
+				ss = append(ss, v.A.String())
+			}
+		}
+		return ss
+	}
+
+	for _, tt := range []struct {
+		name   string
+		filter GeoIPFilter
+		ips    []string
+		want   []string
+	}{
+		{"allowed", GeoIPFilter{}, []string{"1.0.1.1", "1.0.1.2"}, []string{"1.0.1.1", "1.0.1.2"}},
+		{"drop", GeoIPFilter{Action: GeoIPDrop}, []string{"1.0.1.1", "8.8.8.8"}, []string{"1.0.1.1"}},
+		{"rewrite", GeoIPFilter{Action: GeoIPRewrite}, []string{"8.8.8.8", "1.0.1.1"}, []string{"0.0.0.0", "1.0.1.1"}},
+		{"rewrite address", GeoIPFilter{Action: GeoIPRewrite, RewriteIPv4: "192.0.2.1"}, []string{"8.8.8.8"}, []string{"192.0.2.1"}},
+		{"fallback", GeoIPFilter{Action: GeoIPFallback, fallback: answerUpstream("192.0.2.53")}, []string{"1.0.1.1", "8.8.8.8"}, []string{"192.0.2.53"}},
+		{"fallback allowed", GeoIPFilter{Action: GeoIPFallback, fallback: answerUpstream("192.0.2.53")}, []string{"1.0.1.1"}, []string{"1.0.1.1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.filter
+			m.Database, m.Countries = database, []string{"cn"}
+			shared := (*dns.Msg)(nil)
+			m.upstream = upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+				out, err := answerUpstream(tt.ips...)(in)
+				shared = out
+				return out, err
+			})
+			if err := m.provision(); err != nil {
+				t.Fatal(err)
+			}
+			out, err := m.Exchange(new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := answers(out); !slices.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+			if len(out.Answer) == 0 || out.Answer[0].Header().Rrtype != dns.TypeCNAME {
+				t.Errorf("cname is removed")
+			}
+			if got := answers(shared); !slices.Equal(got, tt.ips) {
+				t.Errorf("response of the next upstream is changed to %v", got)
+			}
+		})
+	}
+
+	for _, m := range []GeoIPFilter{
+		{Countries: []string{"cn"}},
+		{Database: database},
+		{Database: database, Countries: []string{"cn"}, Action: "block"},
+		{Database: database, Countries: []string{"cn"}, Action: GeoIPFallback},
+		{Database: database, Countries: []string{"cn"}, Action: GeoIPRewrite, RewriteIPv4: "::1"},
+		{Database: database, Countries: []string{"jp"}},
+		{Database: database + ".missing", Countries: []string{"cn"}},
+	} {
+		if err := m.provision(); err == nil {
+			t.Errorf("%+v is accepted", m)
+		}
+	}
+}
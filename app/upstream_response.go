@@ -0,0 +1,129 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(ResponseFilter{})
+}
+
+// Actions of ResponseFilter.
+const (
+	// ResponseFallback discards the response and asks the fallback
+	// upstream.
+	ResponseFallback = "fallback"
+	// ResponseNXDomain answers with NXDOMAIN, as for bogus NXDOMAIN
+	// responses.
+	ResponseNXDomain = "nxdomain"
+	// ResponseRefuse answers with REFUSED.
+	ResponseRefuse = "refuse"
+)
+
+// ResponseFilter checks the responses of the next upstream with response
+// matchers, and acts on those which one of the matchers matches.
+type ResponseFilter struct {
+	// UpstreamRaw is the upstream the responses of which are checked.
+	UpstreamRaw json.RawMessage `json:"next" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+	// MatchersRaw is the response matchers, there must be at least one.
+	MatchersRaw []json.RawMessage `json:"match" caddy:"namespace=dnsproxy.response_matchers inline_key=matcher"`
+	// Action is "fallback", "nxdomain" or "refuse", "fallback" by default.
+	Action string `json:"action,omitempty"`
+	// FallbackRaw is the upstream of the "fallback" action.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=dnsproxy.upstreams inline_key=upstream"`
+
+	upstream Upstream
+	matchers []ResponseMatcher
+	fallback Upstream
+}
+
+// CaddyModule is ...
+func (ResponseFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnsproxy.upstreams.response_filter",
+		New: func() caddy.Module { return new(ResponseFilter) },
+	}
+}
+
+// Provision is ...
+func (m *ResponseFilter) Provision(ctx caddy.Context) error {
+	if len(m.MatchersRaw) == 0 {
+		return errors.New("response_filter: no matchers")
+	}
+	mod, err := ctx.LoadModule(m, "UpstreamRaw")
+	if err != nil {
+		return err
+	}
+	m.upstream = mod.(Upstream)
+	mods, err := ctx.LoadModule(m, "MatchersRaw")
+	if err != nil {
+		return err
+	}
+	for _, v := range mods.([]interface{}) {
+		m.matchers = append(m.matchers, v.(ResponseMatcher))
+	}
+	if len(m.FallbackRaw) > 0 {
+		mod, err := ctx.LoadModule(m, "FallbackRaw")
+		if err != nil {
+			return err
+		}
+		m.fallback = mod.(Upstream)
+	}
+	return m.provision()
+}
+
+func (m *ResponseFilter) provision() error {
+	switch m.Action {
+	case "", ResponseFallback:
+		m.Action = ResponseFallback
+		if m.fallback == nil {
+			return errors.New("response_filter: no fallback upstream")
+		}
+	case ResponseNXDomain, ResponseRefuse:
+	default:
+		return fmt.Errorf("response_filter: unknown action %q", m.Action)
+	}
+	return nil
+}
+
+// Exchange is ...
+func (m *ResponseFilter) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return m.ExchangeClient(nil, in)
+}
+
+// ExchangeClient is Exchange for a query from c.
+func (m *ResponseFilter) ExchangeClient(c *Client, in *dns.Msg) (*dns.Msg, error) {
+	out, err := exchangeCopy(m.upstream, c, in)
+	if err != nil || out == nil || !m.match(in, out) {
+		return out, err
+	}
+
+	switch m.Action {
+	case ResponseNXDomain:
+		return new(dns.Msg).SetRcode(in, dns.RcodeNameError), nil
+	case ResponseRefuse:
+		return new(dns.Msg).SetRcode(in, dns.RcodeRefused), nil
+	default:
+		return ExchangeClient(m.fallback, c, in)
+	}
+}
+
+func (m *ResponseFilter) match(in, out *dns.Msg) bool {
+	for _, v := range m.matchers {
+		if v.MatchResponse(in, out) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ ClientUpstream    = (*ResponseFilter)(nil)
+	_ caddy.Provisioner = (*ResponseFilter)(nil)
+)
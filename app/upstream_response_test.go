@@ -0,0 +1,102 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+func TestMatchResponseIP(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bogus.conf")
+	if err := os.WriteFile(name, []byte("# bogus nxdomain\nbogus-nxdomain=198.51.100.7\n203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &MatchResponseIP{Ranges: []string{"10.0.0.0/8", "fd00::/8"}, Files: []string{name}}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	in := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	for _, tt := range []struct {
+		ips  []string
+		want bool
+	}{
+		{[]string{"192.0.2.1"}, false},
+		{[]string{"192.0.2.1", "10.1.2.3"}, true},
+		{[]string{"198.51.100.7"}, true},
+		{[]string{"198.51.100.8"}, false},
+		{[]string{"203.0.113.200"}, true},
+		{[]string{"fd12::1"}, true},
+		{nil, false},
+	} {
+		out, _ := answerUpstream(tt.ips...)(in)
+		if got := m.MatchResponse(in, out); got != tt.want {
+			t.Errorf("match %v = %v, want %v", tt.ips, got, tt.want)
+		}
+	}
+
+	for _, m := range []*MatchResponseIP{
+		{},
+		{Ranges: []string{"10.0.0.0/33"}},
+		{Files: []string{name + ".missing"}},
+	} {
+		if err := m.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%+v is accepted", m)
+		}
+	}
+}
+
+func TestResponseFilter(t *testing.T) {
+	private := &MatchResponseIP{Ranges: []string{"10.0.0.0/8"}}
+	if err := private.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		filter ResponseFilter
+		ips    []string
+		rcode  int
+		want   []string
+	}{
+		{"no match", ResponseFilter{}, []string{"192.0.2.1"}, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"fallback", ResponseFilter{}, []string{"10.0.0.1"}, dns.RcodeSuccess, []string{"192.0.2.53"}},
+		{"nxdomain", ResponseFilter{Action: ResponseNXDomain}, []string{"10.0.0.1"}, dns.RcodeNameError, []string{}},
+		{"refuse", ResponseFilter{Action: ResponseRefuse}, []string{"10.0.0.1"}, dns.RcodeRefused, []string{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.filter
+			m.upstream = answerUpstream(tt.ips...)
+			m.matchers = []ResponseMatcher{private}
+			m.fallback = answerUpstream("192.0.2.53")
+			if err := m.provision(); err != nil {
+				t.Fatal(err)
+			}
+			in := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+			out, err := m.Exchange(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, rr := range out.Answer {
+				if v, ok := rr.(*dns.A); ok {
+					got = append(got, v.A.String())
+				}
+			}
+			if out.Rcode != tt.rcode || out.Id != in.Id || !slices.Equal(got, tt.want) {
+				t.Errorf("response = %v %v, want %v %v", dns.RcodeToString[out.Rcode], got, dns.RcodeToString[tt.rcode], tt.want)
+			}
+		})
+	}
+
+	for _, m := range []ResponseFilter{
+		{},
+		{Action: "drop"},
+	} {
+		if err := m.provision(); err == nil {
+			t.Errorf("%+v is accepted", m)
+		}
+	}
+}
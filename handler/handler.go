@@ -3,8 +3,13 @@ package handler
 import (
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
 	"unsafe"
 
@@ -13,8 +18,10 @@ import (
 
 	"github.com/imgk/memory-go"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 
 	"github.com/imgk/caddy-dnsproxy/app"
+	"github.com/imgk/caddy-dnsproxy/pkg/odoh"
 )
 
 func init() {
@@ -24,12 +31,29 @@ func init() {
 // DefaultPrefix is ...
 const DefaultPrefix = "/dns-query"
 
+// MediaTypeDNSMessage is the media type of DoH requests and responses.
+const MediaTypeDNSMessage = "application/dns-message"
+
 // Handler is ...
 type Handler struct {
 	// Prefix is ...
 	Prefix string `json:"prefix,omitempty"`
+	// JSONPrefix is the path of the JSON API, such as "/resolve". JSON
+	// queries are always answered under Prefix when the request has a name
+	// parameter.
+	JSONPrefix string `json:"json_prefix,omitempty"`
+	// ODoH enables Oblivious DoH target mode, RFC 9230. Oblivious queries
+	// are accepted under Prefix and the key configs are served at
+	// /.well-known/odohconfigs.
+	ODoH *ODoH `json:"odoh,omitempty"`
+	// ACL restricts the clients of the handler.
+	ACL *app.ACL `json:"acl,omitempty"`
+	// Name is the listener name of the queries, the name of the http server
+	// by default.
+	Name string `json:"name,omitempty"`
 
 	up app.Upstream
+	lg *zap.Logger
 }
 
 // CaddyModule is ...
@@ -45,28 +69,51 @@ func (m *Handler) Provision(ctx caddy.Context) error {
 	if m.Prefix == "" {
 		m.Prefix = DefaultPrefix
 	}
-	ctx.App(app.CaddyAppID)
-	if ctx.AppIfConfigured(app.CaddyAppID) == nil {
-		return errors.New(app.CaddyAppID + " is not configured")
+	mod, err := ctx.AppIfConfigured(app.CaddyAppID)
+	if err != nil {
+		return err
 	}
-	mod, err := ctx.App(app.CaddyAppID)
+	m.lg = ctx.Logger(m)
+	m.up, err = m.ACL.Upstream(mod.(app.Upstream), m.lg)
 	if err != nil {
 		return err
 	}
-	m.up = mod.(app.Upstream)
+	if m.ODoH != nil {
+		if err := m.ODoH.Provision(ctx, m.lg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup is ...
+func (m *Handler) Cleanup() error {
+	if m.ODoH != nil {
+		return m.ODoH.Cleanup()
+	}
 	return nil
 }
 
 // ServeHTTP is ...
 func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.ODoH != nil && r.URL.Path == ODoHConfigsPath {
+		return m.serveODoHConfigs(w, r)
+	}
+	if m.JSONPrefix != "" && strings.HasPrefix(r.URL.Path, m.JSONPrefix) {
+		return m.serveJSON(w, r)
+	}
 	if strings.HasPrefix(r.URL.Path, m.Prefix) {
 		switch r.Method {
 		case http.MethodGet:
+			if r.URL.Query().Has("name") {
+				return m.serveJSON(w, r)
+			}
 			return m.serveGet(w, r)
 		case http.MethodPost:
 			return m.servePost(w, r)
 		default:
-			return next.ServeHTTP(w, r)
+			w.Header().Set("Allow", "GET, POST")
+			return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
 		}
 	}
 	return next.ServeHTTP(w, r)
@@ -74,60 +121,196 @@ func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 
 func (m *Handler) serveGet(w http.ResponseWriter, r *http.Request) error {
 	ss, ok := r.URL.Query()["dns"]
-	if !ok || len(ss) < 1 {
-		return errors.New("no dns query")
+	if !ok || len(ss) < 1 || ss[0] == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("no dns query"))
+	}
+	// padding is not allowed, but some clients send it anyway
+	s := strings.TrimRight(ss[0], "=")
+	if base64.RawURLEncoding.DecodedLen(len(s)) > dns.MaxMsgSize {
+		return caddyhttp.Error(http.StatusRequestURITooLong, errors.New("dns query too long"))
 	}
 
 	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
 	defer memory.Free(ptr)
 
-	n, err := base64.RawURLEncoding.Decode(buf, func(s string) []byte {
-		return unsafe.Slice((*byte)(unsafe.Pointer(*(*uintptr)(unsafe.Pointer(&s)))), len(s))
-	}(ss[0]))
+	n, err := base64.RawURLEncoding.Decode(buf, unsafe.Slice(unsafe.StringData(s), len(s)))
 	if err != nil {
-		return err
+		return caddyhttp.Error(http.StatusBadRequest, err)
 	}
 
-	return m.response(w, buf, n)
+	return m.response(w, r, buf, n)
 }
 
 func (m *Handler) servePost(w http.ResponseWriter, r *http.Request) error {
-	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize)
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mt == odoh.MediaType && m.ODoH != nil {
+		if r.ContentLength > dns.MaxMsgSize {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("odoh query too long"))
+		}
+		return m.serveODoH(w, r)
+	}
+	if err != nil || mt != MediaTypeDNSMessage {
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("unsupported content type"))
+	}
+	if r.ContentLength > dns.MaxMsgSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("dns query too long"))
+	}
+
+	// one extra byte to tell a maximum sized message from an oversized one
+	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize + 1)
 	defer memory.Free(ptr)
 
 	// read dns message from request
 	n, err := Buffer(buf).ReadFrom(r.Body)
+	if err != nil {
+		if errors.Is(err, io.ErrShortBuffer) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("dns query too long"))
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	return m.response(w, r, buf, int(n))
+}
+
+func (m *Handler) response(w http.ResponseWriter, r *http.Request, buf []byte, n int) error {
+	if !accepts(r, MediaTypeDNSMessage) {
+		return caddyhttp.Error(http.StatusNotAcceptable, errors.New("not acceptable"))
+	}
+
+	bb, out, err := m.exchange(r, buf[:n], buf)
 	if err != nil {
 		return err
 	}
 
-	return m.response(w, buf, int(n))
+	// write response back
+	w.Header().Set("Content-Type", MediaTypeDNSMessage)
+	w.Header().Set("Content-Length", strconv.Itoa(len(bb)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(MinTTL(out)), 10))
+	_, err = w.Write(bb)
+	return err
 }
 
-func (m *Handler) response(w http.ResponseWriter, buf []byte, n int) error {
+// exchange answers a wire format query, packing the response into buf.
+func (m *Handler) exchange(r *http.Request, query, buf []byte) ([]byte, *dns.Msg, error) {
 	// parse dns message
 	msg := &dns.Msg{}
-	if err := msg.Unpack(buf[:n]); err != nil {
-		return err
+	if err := msg.Unpack(query); err != nil {
+		return nil, nil, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if msg.Response {
+		return nil, nil, caddyhttp.Error(http.StatusBadRequest, errors.New("not a dns query"))
+	}
+
+	// requests in TLS early data can be replayed, RFC 8470
+	if r.TLS != nil && !r.TLS.HandshakeComplete && !app.IsReplaySafe(msg) {
+		return nil, nil, caddyhttp.Error(http.StatusTooEarly, errors.New("query is not safe to replay"))
 	}
 
-	// request response
-	msg, err := m.up.Exchange(msg)
+	// request response, the message id is echoed as received so that
+	// clients using id 0 for cacheability get id 0 back
+	id := msg.Id
+	out, err := app.ExchangeClient(m.up, m.client(r), msg)
+	if errors.Is(err, app.ErrDropped) {
+		return nil, nil, caddyhttp.Error(http.StatusTooManyRequests, err)
+	}
 	if err != nil {
-		return err
+		m.lg.Error(fmt.Sprintf("handler error: exchange error: %v", err))
+		out = new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure)
 	}
+	out.Id = id
 
-	bb, err := msg.PackBuffer(buf)
+	bb, err := out.PackBuffer(buf)
 	if err != nil {
-		return err
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError, err)
 	}
+	return bb, out, nil
+}
 
-	// write response back
-	_, err = w.Write(bb)
-	return err
+// client returns the client of a request, which is the one found by the
+// trusted_proxies of the server when the request is proxied.
+func (m *Handler) client(r *http.Request) *app.Client {
+	c := &app.Client{Transport: "https", Listener: m.Name}
+	if c.Listener == "" {
+		if srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+			c.Listener = srv.Name()
+		}
+	}
+
+	s, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if !ok || s == "" {
+		s = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return c
+		}
+		addr = netip.AddrPortFrom(ip, 0)
+	}
+	c.Addr = net.TCPAddrFromAddrPort(addr)
+	return c
+}
+
+// MinTTL returns the freshness lifetime of a response, RFC 8484 Section 5.1.
+// Negative answers are bound by the SOA record in the authority section.
+func MinTTL(msg *dns.Msg) uint32 {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0
+	}
+
+	ttl, found := uint32(0), false
+	update := func(v uint32) {
+		if !found || v < ttl {
+			ttl, found = v, true
+		}
+	}
+	for _, v := range msg.Answer {
+		update(v.Header().Ttl)
+	}
+	if found {
+		return ttl
+	}
+	for _, v := range msg.Ns {
+		update(v.Header().Ttl)
+		if soa, ok := v.(*dns.SOA); ok {
+			update(soa.Minttl)
+		}
+	}
+	return ttl
 }
 
-var _ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+// accepts reports whether the Accept header of the request allows a
+// media type. A missing header accepts everything.
+func accepts(r *http.Request, mediaType string) bool {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		for _, vv := range strings.Split(v, ",") {
+			mt, params, err := mime.ParseMediaType(vv)
+			if err != nil {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(q, 64); err != nil || f == 0 {
+					continue
+				}
+			}
+			switch mt {
+			case "*/*", "application/*", mediaType:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
+)
 
 // Buffer is ...
 type Buffer []byte
@@ -0,0 +1,434 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-dnsproxy/app"
+)
+
+type upstreamFunc func(*dns.Msg) (*dns.Msg, error)
+
+func (f upstreamFunc) Exchange(in *dns.Msg) (*dns.Msg, error) {
+	return f(in)
+}
+
+// echoUpstream answers every A query with 192.0.2.1.
+var echoUpstream = upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+	out := new(dns.Msg)
+	out.SetReply(in)
+	for _, v := range in.Question {
+		out.Answer = append(out.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: v.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return out, nil
+})
+
+var notFound = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	return caddyhttp.Error(http.StatusNotFound, nil)
+})
+
+func newTestHandler() *Handler {
+	return &Handler{Prefix: DefaultPrefix, up: echoUpstream, lg: zap.NewNop()}
+}
+
+// serveHTTP adapts a handler to net/http the way Caddy does, turning
+// handler errors into status codes.
+func serveHTTP(m caddyhttp.MiddlewareHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := m.ServeHTTP(w, r, notFound); err != nil {
+			code := http.StatusInternalServerError
+			if he := (caddyhttp.HandlerError{}); errors.As(err, &he) {
+				code = he.StatusCode
+			}
+			w.WriteHeader(code)
+		}
+	}
+}
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func packTestQuery(t *testing.T, opcode int) []byte {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Opcode = opcode
+	msg.Id = 0
+	bb, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bb
+}
+
+// startHTTP3 serves the handler over HTTP/3 and, on the same port number,
+// over HTTPS.
+func startHTTP3(t *testing.T, m *Handler) *httptest.Server {
+	t.Helper()
+
+	tlsConfig := newTestTLSConfig(t)
+	h2 := httptest.NewUnstartedServer(serveHTTP(m))
+	h2.TLS = tlsConfig
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+
+	_, port, _ := net.SplitHostPort(h2.Listener.Addr().String())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3 := &http3.Server{Handler: serveHTTP(m), TLSConfig: tlsConfig}
+	go h3.Serve(conn)
+	t.Cleanup(func() { h3.Close() })
+	return h2
+}
+
+func checkResponse(t *testing.T, resp *http.Response) {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	bb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(bb); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 {
+		t.Errorf("answers = %d, want 1", len(msg.Answer))
+	}
+}
+
+func TestHandler_HTTP3(t *testing.T) {
+	h2 := startHTTP3(t, newTestHandler())
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	query := packTestQuery(t, dns.OpcodeQuery)
+	url := h2.URL + DefaultPrefix
+
+	resp, err := client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 3 {
+		t.Errorf("protocol = %s, want HTTP/3", resp.Proto)
+	}
+	checkResponse(t, resp)
+
+	resp, err = client.Post(url, "application/dns-message", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, resp)
+}
+
+// TestHandler_AltSvc serves the handler with the http app of Caddy, which
+// advertises HTTP/3 in the responses over HTTP/1 and HTTP/2.
+func TestHandler_AltSvc(t *testing.T) {
+	// caddy does not load modules when json.RawMessage is an alias of
+	// jsontext.Value, with GOEXPERIMENT=jsonv2
+	if reflect.TypeOf(json.RawMessage{}).PkgPath() != "encoding/json" {
+		t.Skip("caddy does not recognize json.RawMessage")
+	}
+
+	cert := newTestTLSConfig(t).Certificates[0]
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	type object = map[string]any
+	cfg, err := json.Marshal(object{
+		"admin":   object{"disabled": true},
+		"logging": object{"logs": object{"default": object{"level": "ERROR"}}},
+		"storage": object{"module": "file_system", "root": t.TempDir()},
+		"apps": object{
+			"tls": object{"certificates": object{"load_pem": []object{{
+				"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})),
+				"key":         string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})),
+			}}}},
+			"dnsproxy": object{"handlers": []object{{
+				"upstream": object{"upstream": "terminate"},
+				"match":    []object{{"matcher": "all"}},
+			}}},
+			"http": object{"servers": object{"doh": object{
+				"listen":                  []string{addr},
+				"protocols":               []string{"h1", "h2", "h3"},
+				"tls_connection_policies": []object{{}},
+				"automatic_https":         object{"disable": true},
+				"routes":                  []object{{"handle": []object{{"handler": "dns_over_https"}}}},
+			}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caddy.Load(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+	query := packTestQuery(t, dns.OpcodeQuery)
+	resp, err := client.Get("https://" + addr + DefaultPrefix + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("status = %d, protocol = %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+
+	want := `h3=":` + port + `"; ma=2592000`
+	if got := resp.Header.Get("Alt-Svc"); got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+}
+
+func TestHandler_EarlyData(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode int
+		early  bool
+		want   int
+	}{
+		{"query in early data", dns.OpcodeQuery, true, http.StatusOK},
+		{"notify in early data", dns.OpcodeNotify, true, http.StatusTooEarly},
+		{"notify after handshake", dns.OpcodeNotify, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := packTestQuery(t, tt.opcode)
+			r := httptest.NewRequest(http.MethodGet, DefaultPrefix+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+			r.TLS = &tls.ConnectionState{HandshakeComplete: !tt.early}
+			w := httptest.NewRecorder()
+
+			serveHTTP(newTestHandler())(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_Client(t *testing.T) {
+	m := newTestHandler()
+	r := httptest.NewRequest(http.MethodGet, DefaultPrefix, nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if c := m.client(r); c.Transport != "https" || c.Listener != "" || c.Addr.String() != "192.0.2.1:1234" {
+		t.Errorf("client = %+v", c)
+	}
+
+	m.Name = "doh"
+	r.RemoteAddr = "invalid"
+	if c := m.client(r); c.Transport != "https" || c.Listener != "doh" || c.Addr != nil {
+		t.Errorf("named client = %+v", c)
+	}
+}
+
+func TestHandler_RFC8484(t *testing.T) {
+	failUpstream := upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("upstream failure")
+	})
+	dropUpstream := upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		return nil, app.ErrDropped
+	})
+	query := func(id uint16, response bool) []byte {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Id = id
+		msg.Response = response
+		bb, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bb
+	}
+	get := func(bb []byte) string {
+		return DefaultPrefix + "?dns=" + base64.RawURLEncoding.EncodeToString(bb)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		contentType  string
+		accept       string
+		body         []byte
+		up           upstreamFunc
+		code         int
+		id           uint16
+		cacheControl string
+	}{
+		{name: "get", method: http.MethodGet, target: get(query(0, false)), code: 200, id: 0, cacheControl: "max-age=60"},
+		{name: "get keeps id", method: http.MethodGet, target: get(query(4321, false)), code: 200, id: 4321, cacheControl: "max-age=60"},
+		{name: "get padded", method: http.MethodGet, target: DefaultPrefix + "?dns=" + base64.URLEncoding.EncodeToString(query(0, false)), code: 200, cacheControl: "max-age=60"},
+		{name: "get without dns", method: http.MethodGet, target: DefaultPrefix, code: 400},
+		{name: "get invalid base64", method: http.MethodGet, target: DefaultPrefix + "?dns=!!!", code: 400},
+		{name: "get invalid message", method: http.MethodGet, target: get([]byte{1, 2, 3}), code: 400},
+		{name: "get response message", method: http.MethodGet, target: get(query(0, true)), code: 400},
+		{name: "post", method: http.MethodPost, target: DefaultPrefix, contentType: MediaTypeDNSMessage, body: query(7, false), code: 200, id: 7, cacheControl: "max-age=60"},
+		{name: "post without content type", method: http.MethodPost, target: DefaultPrefix, body: query(0, false), code: 415},
+		{name: "post wrong content type", method: http.MethodPost, target: DefaultPrefix, contentType: "application/json", body: query(0, false), code: 415},
+		{name: "post too large", method: http.MethodPost, target: DefaultPrefix, contentType: MediaTypeDNSMessage, body: make([]byte, dns.MaxMsgSize+1), code: 413},
+		{name: "accept any", method: http.MethodGet, target: get(query(0, false)), accept: "*/*", code: 200, cacheControl: "max-age=60"},
+		{name: "accept dns message", method: http.MethodGet, target: get(query(0, false)), accept: "text/html, application/dns-message;q=0.9", code: 200, cacheControl: "max-age=60"},
+		{name: "not acceptable", method: http.MethodGet, target: get(query(0, false)), accept: "text/html, application/dns-message;q=0", code: 406},
+		{name: "method not allowed", method: http.MethodPut, target: DefaultPrefix, code: 405},
+		{name: "other path", method: http.MethodGet, target: "/index.html", code: 404},
+		{name: "upstream failure", method: http.MethodGet, target: get(query(0, false)), up: failUpstream, code: 200, cacheControl: "max-age=0"},
+		{name: "dropped", method: http.MethodGet, target: get(query(0, false)), up: dropUpstream, code: 429},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			m := newTestHandler()
+			if tt.up != nil {
+				m.up = tt.up
+			}
+			serveHTTP(m)(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			if got := w.Header().Get("Content-Type"); got != MediaTypeDNSMessage {
+				t.Errorf("Content-Type = %q, want %q", got, MediaTypeDNSMessage)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cacheControl)
+			}
+			msg := new(dns.Msg)
+			if err := msg.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Id != tt.id {
+				t.Errorf("id = %d, want %d", msg.Id, tt.id)
+			}
+		})
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	rr := func(s string) dns.RR {
+		v, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   uint32
+	}{{
+		name:   "answers",
+		answer: []dns.RR{rr("example.com. 300 IN CNAME www.example.com."), rr("www.example.com. 60 IN A 192.0.2.1")},
+		want:   60,
+	}, {
+		name:  "nxdomain",
+		rcode: dns.RcodeNameError,
+		ns:    []dns.RR{rr("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 900")},
+		want:  900,
+	}, {
+		name: "nodata without soa",
+		want: 0,
+	}, {
+		name:   "servfail",
+		rcode:  dns.RcodeServerFailure,
+		answer: []dns.RR{rr("www.example.com. 60 IN A 192.0.2.1")},
+		want:   0,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &dns.Msg{Answer: tt.answer, Ns: tt.ns}
+			msg.Rcode = tt.rcode
+			if got := MinTTL(msg); got != tt.want {
+				t.Errorf("MinTTL() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+
+	"github.com/imgk/caddy-dnsproxy/app"
+)
+
+// MediaTypeDNSJSON is the media type of the JSON API used by Google and
+// Cloudflare.
+const MediaTypeDNSJSON = "application/dns-json"
+
+// JSONResponse is the body of a JSON API response.
+type JSONResponse struct {
+	// Status is the response code.
+	Status int `json:"Status"`
+	// TC is ...
+	TC bool `json:"TC"`
+	// RD is ...
+	RD bool `json:"RD"`
+	// RA is ...
+	RA bool `json:"RA"`
+	// AD is ...
+	AD bool `json:"AD"`
+	// CD is ...
+	CD bool `json:"CD"`
+	// Question is ...
+	Question []JSONQuestion `json:"Question"`
+	// Answer is ...
+	Answer []JSONRecord `json:"Answer,omitempty"`
+	// Authority is ...
+	Authority []JSONRecord `json:"Authority,omitempty"`
+	// Additional is ...
+	Additional []JSONRecord `json:"Additional,omitempty"`
+	// EDNSClientSubnet is the client subnet in the response as
+	// address/scope prefix length.
+	EDNSClientSubnet string `json:"edns_client_subnet,omitempty"`
+}
+
+// JSONQuestion is ...
+type JSONQuestion struct {
+	// Name is ...
+	Name string `json:"name"`
+	// Type is ...
+	Type uint16 `json:"type"`
+}
+
+// JSONRecord is ...
+type JSONRecord struct {
+	// Name is ...
+	Name string `json:"name"`
+	// Type is ...
+	Type uint16 `json:"type"`
+	// TTL is ...
+	TTL uint32 `json:"TTL"`
+	// Data is the record data in presentation format.
+	Data string `json:"data"`
+}
+
+func (m *Handler) serveJSON(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	contentType := MediaTypeDNSJSON
+	if !accepts(r, MediaTypeDNSJSON) {
+		if !accepts(r, "application/json") {
+			return caddyhttp.Error(http.StatusNotAcceptable, errors.New("not acceptable"))
+		}
+		contentType = "application/json"
+	}
+
+	msg, err := ParseJSONQuery(r.URL.Query())
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	// request response
+	out, err := app.ExchangeClient(m.up, m.client(r), msg)
+	if errors.Is(err, app.ErrDropped) {
+		return caddyhttp.Error(http.StatusTooManyRequests, err)
+	}
+	if err != nil {
+		m.lg.Error(fmt.Sprintf("handler error: exchange error: %v", err))
+		out = new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure)
+	}
+
+	bb, err := json.Marshal(NewJSONResponse(out))
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// write response back
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(bb)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(MinTTL(out)), 10))
+	_, err = w.Write(bb)
+	return err
+}
+
+// ParseJSONQuery builds a query from the parameters of a JSON API request:
+// name, type, cd, do and edns_client_subnet.
+func ParseJSONQuery(query url.Values) (*dns.Msg, error) {
+	name := query.Get("name")
+	if name == "" {
+		return nil, errors.New("no name")
+	}
+	if len(strings.TrimSuffix(name, ".")) > 253 {
+		return nil, errors.New("name too long")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, errors.New("invalid name")
+	}
+
+	qtype := dns.TypeA
+	if s := query.Get("type"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil && n > 0 {
+			qtype = uint16(n)
+		} else if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			qtype = t
+		} else {
+			return nil, errors.New("invalid type")
+		}
+	}
+
+	cd, err := parseJSONBool(query.Get("cd"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cd: %w", err)
+	}
+	do, err := parseJSONBool(query.Get("do"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid do: %w", err)
+	}
+
+	msg := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	msg.CheckingDisabled = cd
+
+	var ecs *dns.EDNS0_SUBNET
+	if s := query.Get("edns_client_subnet"); s != "" {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edns_client_subnet: %w", err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ecs = &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       ipNet.IP,
+		}
+		if ip.To4() == nil {
+			ecs.Family = 2
+		}
+	}
+	if do || ecs != nil {
+		msg.SetEdns0(dns.DefaultMsgSize, do)
+		if ecs != nil {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+	}
+	return msg, nil
+}
+
+func parseJSONBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	default:
+		return false, errors.New("not a boolean")
+	}
+}
+
+// NewJSONResponse converts a response to its JSON API representation.
+func NewJSONResponse(msg *dns.Msg) *JSONResponse {
+	resp := &JSONResponse{
+		Status:   msg.Rcode,
+		TC:       msg.Truncated,
+		RD:       msg.RecursionDesired,
+		RA:       msg.RecursionAvailable,
+		AD:       msg.AuthenticatedData,
+		CD:       msg.CheckingDisabled,
+		Question: make([]JSONQuestion, 0, len(msg.Question)),
+	}
+	for _, v := range msg.Question {
+		resp.Question = append(resp.Question, JSONQuestion{Name: v.Name, Type: v.Qtype})
+	}
+	resp.Answer = newJSONRecords(msg.Answer)
+	resp.Authority = newJSONRecords(msg.Ns)
+	resp.Additional = newJSONRecords(msg.Extra)
+
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, v := range opt.Option {
+			if ecs, ok := v.(*dns.EDNS0_SUBNET); ok {
+				resp.EDNSClientSubnet = ecs.Address.String() + "/" + strconv.Itoa(int(ecs.SourceScope))
+			}
+		}
+	}
+	return resp
+}
+
+func newJSONRecords(rrs []dns.RR) []JSONRecord {
+	records := []JSONRecord(nil)
+	for _, v := range rrs {
+		hdr := v.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		records = append(records, JSONRecord{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(v.String(), hdr.String()),
+		})
+	}
+	return records
+}
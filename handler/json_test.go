@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandler_JSON(t *testing.T) {
+	var query *dns.Msg
+	up := upstreamFunc(func(in *dns.Msg) (*dns.Msg, error) {
+		query = in
+		out, err := echoUpstream(in)
+		if err == nil {
+			out.RecursionAvailable = true
+			if opt := in.IsEdns0(); opt != nil {
+				out.Extra = append(out.Extra, dns.Copy(opt))
+			}
+		}
+		return out, err
+	})
+
+	tests := []struct {
+		name        string
+		target      string
+		accept      string
+		code        int
+		contentType string
+		qtype       uint16
+		cd, do      bool
+		ecs         string
+	}{
+		{name: "resolve", target: "/resolve?name=example.com", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeA},
+		{name: "dns-query", target: DefaultPrefix + "?name=example.com&type=AAAA", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeAAAA},
+		{name: "numeric type", target: "/resolve?name=example.com.&type=28", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeAAAA},
+		{name: "lowercase type", target: "/resolve?name=example.com&type=mx", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeMX},
+		{name: "flags", target: "/resolve?name=example.com&cd=1&do=true", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeA, cd: true, do: true},
+		{name: "client subnet", target: "/resolve?name=example.com&edns_client_subnet=192.0.2.0/24", code: 200, contentType: MediaTypeDNSJSON, qtype: dns.TypeA, ecs: "192.0.2.0/0"},
+		{name: "accept json", target: "/resolve?name=example.com", accept: "application/json", code: 200, contentType: "application/json", qtype: dns.TypeA},
+		{name: "not acceptable", target: "/resolve?name=example.com", accept: "text/html", code: 406},
+		{name: "no name", target: "/resolve", code: 400},
+		{name: "invalid name", target: "/resolve?name=a..b", code: 400},
+		{name: "invalid type", target: "/resolve?name=example.com&type=NOPE", code: 400},
+		{name: "invalid cd", target: "/resolve?name=example.com&cd=2", code: 400},
+		{name: "invalid subnet", target: "/resolve?name=example.com&edns_client_subnet=nope", code: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query = nil
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			m := newTestHandler()
+			m.JSONPrefix = "/resolve"
+			m.up = up
+			serveHTTP(m)(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := query.Question[0].Qtype; got != tt.qtype {
+				t.Errorf("query type = %d, want %d", got, tt.qtype)
+			}
+			if query.CheckingDisabled != tt.cd {
+				t.Errorf("query cd = %v, want %v", query.CheckingDisabled, tt.cd)
+			}
+			if opt := query.IsEdns0(); (opt != nil && opt.Do()) != tt.do {
+				t.Errorf("query do = %v, want %v", !tt.do, tt.do)
+			}
+
+			resp := JSONResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != dns.RcodeSuccess || !resp.RD || !resp.RA || resp.CD != tt.cd {
+				t.Errorf("unexpected header %+v", resp)
+			}
+			if len(resp.Question) != 1 || resp.Question[0].Name != "example.com." || resp.Question[0].Type != tt.qtype {
+				t.Errorf("unexpected question %+v", resp.Question)
+			}
+			if resp.EDNSClientSubnet != tt.ecs {
+				t.Errorf("edns_client_subnet = %q, want %q", resp.EDNSClientSubnet, tt.ecs)
+			}
+		})
+	}
+}
+
+func TestNewJSONResponse(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	msg = new(dns.Msg).SetRcode(msg, dns.RcodeNameError)
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ns = append(msg.Ns, soa)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	bb, err := json.Marshal(NewJSONResponse(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Status":3,"TC":false,"RD":true,"RA":false,"AD":false,"CD":false,` +
+		`"Question":[{"name":"example.com.","type":1}],` +
+		`"Authority":[{"name":"example.com.","type":6,"TTL":3600,"data":"ns.example.com. admin.example.com. 1 7200 3600 1209600 900"}]}`
+	if string(bb) != want {
+		t.Errorf("got %s\nwant %s", bb, want)
+	}
+}
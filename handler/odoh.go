@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"github.com/imgk/memory-go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/odoh"
+)
+
+// ODoHConfigsPath is the well-known path of the key configs of a target.
+const ODoHConfigsPath = "/.well-known/odohconfigs"
+
+// DefaultODoHKeyRotation is ...
+const DefaultODoHKeyRotation = 24 * time.Hour
+
+// odohStorageKey is where the key seeds are kept, so that all instances
+// sharing the storage publish the same keys.
+const odohStorageKey = "dnsproxy/odoh/keys.json"
+
+// ODoH is the Oblivious DoH target configuration of the handler.
+type ODoH struct {
+	// KeyRotation is how often a new key pair is generated. The previous
+	// key pair is still accepted for another period.
+	KeyRotation caddy.Duration `json:"key_rotation,omitempty"`
+
+	storage certmagic.Storage
+	lg      *zap.Logger
+	cancel  context.CancelFunc
+
+	mu      sync.RWMutex
+	keys    []*odoh.KeyPair
+	configs []byte
+}
+
+type odohKey struct {
+	Seed    []byte    `json:"seed"`
+	Created time.Time `json:"created"`
+}
+
+// Provision is ...
+func (o *ODoH) Provision(ctx caddy.Context, lg *zap.Logger) error {
+	o.storage = ctx.Storage()
+	o.lg = lg
+	return o.start()
+}
+
+func (o *ODoH) start() error {
+	if o.KeyRotation <= 0 {
+		o.KeyRotation = caddy.Duration(DefaultODoHKeyRotation)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := o.rotate(ctx); err != nil {
+		cancel()
+		return err
+	}
+	o.cancel = cancel
+
+	// pick up keys rotated by other instances and rotate our own
+	go func() {
+		ticker := time.NewTicker(time.Duration(o.KeyRotation) / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := o.rotate(ctx); err != nil && ctx.Err() == nil {
+					o.lg.Error(fmt.Sprintf("odoh error: rotate key error: %v", err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Cleanup is ...
+func (o *ODoH) Cleanup() error {
+	if o.cancel != nil {
+		o.cancel()
+	}
+	return nil
+}
+
+// rotate loads the keys from storage, generating a new key pair if the
+// newest one is due for rotation.
+func (o *ODoH) rotate(ctx context.Context) error {
+	if err := o.storage.Lock(ctx, odohStorageKey); err != nil {
+		return err
+	}
+	defer o.storage.Unlock(ctx, odohStorageKey)
+
+	stored := []odohKey{}
+	bb, err := o.storage.Load(ctx, odohStorageKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bb, &stored); err != nil {
+			return err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return err
+	}
+
+	if len(stored) == 0 || time.Since(stored[0].Created) >= time.Duration(o.KeyRotation) {
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			return err
+		}
+		stored = append([]odohKey{{Seed: seed, Created: time.Now()}}, stored...)
+		if len(stored) > 2 {
+			stored = stored[:2]
+		}
+		bb, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		if err := o.storage.Store(ctx, odohStorageKey, bb); err != nil {
+			return err
+		}
+		o.lg.Info("rotate odoh key")
+	}
+
+	keys := make([]*odoh.KeyPair, 0, len(stored))
+	for _, v := range stored {
+		k, err := odoh.NewKeyPair(v.Seed)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.configs = odoh.Configs{keys[0].Config}.Marshal()
+	o.mu.Unlock()
+	return nil
+}
+
+// Configs returns ObliviousDoHConfigs of the current key.
+func (o *ODoH) Configs() []byte {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.configs
+}
+
+// DecryptQuery decrypts a query with any of the current keys.
+func (o *ODoH) DecryptQuery(m *odoh.Message) ([]byte, *odoh.ResponseContext, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for _, k := range o.keys {
+		query, ctx, err := k.DecryptQuery(m)
+		if errors.Is(err, odoh.ErrUnknownKeyID) {
+			continue
+		}
+		return query, ctx, err
+	}
+	return nil, nil, odoh.ErrUnknownKeyID
+}
+
+func (m *Handler) serveODoHConfigs(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	bb := m.ODoH.Configs()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bb)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(time.Duration(m.ODoH.KeyRotation)/4/time.Second)))
+	_, err := w.Write(bb)
+	return err
+}
+
+func (m *Handler) serveODoH(w http.ResponseWriter, r *http.Request) error {
+	if !accepts(r, odoh.MediaType) {
+		return caddyhttp.Error(http.StatusNotAcceptable, errors.New("not acceptable"))
+	}
+
+	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize + 1)
+	defer memory.Free(ptr)
+
+	// read oblivious message from request
+	n, err := Buffer(buf).ReadFrom(r.Body)
+	if err != nil {
+		if errors.Is(err, io.ErrShortBuffer) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("odoh query too long"))
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	msg, err := odoh.ParseMessage(buf[:n])
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	query, ctx, err := m.ODoH.DecryptQuery(msg)
+	if err != nil {
+		if errors.Is(err, odoh.ErrUnknownKeyID) {
+			return caddyhttp.Error(http.StatusUnauthorized, err)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	bb, _, err := m.exchange(r, query, buf)
+	if err != nil {
+		return err
+	}
+	resp, err := ctx.EncryptResponse(bb, 0)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	bb = resp.Marshal()
+
+	// write response back, responses must not be cached by the proxy
+	w.Header().Set("Content-Type", odoh.MediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(bb)))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	_, err = w.Write(bb)
+	return err
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/imgk/memory-go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/odoh"
+)
+
+func init() {
+	caddy.RegisterModule(Proxy{})
+}
+
+// DefaultProxyPrefix is ...
+const DefaultProxyPrefix = "/proxy"
+
+// DefaultProxyTimeout is ...
+const DefaultProxyTimeout = 5 * time.Second
+
+// Proxy is an Oblivious DoH proxy, RFC 9230 Section 5. It relays encrypted
+// queries to the target named by the targethost and targetpath parameters
+// without passing on anything which identifies the client.
+type Proxy struct {
+	// Prefix is ...
+	Prefix string `json:"prefix,omitempty"`
+	// Targets is the list of target hosts queries may be relayed to, "*"
+	// allows any target. No target is allowed when it is empty, so that the
+	// proxy is not an open relay into the network it runs in.
+	Targets []string `json:"targets,omitempty"`
+	// Timeout is ...
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+	lg     *zap.Logger
+}
+
+// CaddyModule is ...
+func (Proxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.odoh_proxy",
+		New: func() caddy.Module { return new(Proxy) },
+	}
+}
+
+// Provision is ...
+func (m *Proxy) Provision(ctx caddy.Context) error {
+	if m.Prefix == "" {
+		m.Prefix = DefaultProxyPrefix
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = caddy.Duration(DefaultProxyTimeout)
+	}
+	m.client = &http.Client{
+		Timeout: time.Duration(m.Timeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	m.lg = ctx.Logger(m)
+	return nil
+}
+
+// ServeHTTP is ...
+func (m *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !strings.HasPrefix(r.URL.Path, m.Prefix) {
+		return next.ServeHTTP(w, r)
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != odoh.MediaType {
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("unsupported content type"))
+	}
+
+	query := r.URL.Query()
+	host, path := query.Get("targethost"), query.Get("targetpath")
+	if host == "" || !strings.HasPrefix(path, "/") {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("no odoh target"))
+	}
+	if !slices.Contains(m.Targets, "*") && !slices.Contains(m.Targets, host) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("odoh target not allowed"))
+	}
+	target := &url.URL{Scheme: "https", Host: host, Path: path}
+	if target.Hostname() == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid odoh target"))
+	}
+
+	if r.ContentLength > dns.MaxMsgSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("odoh query too long"))
+	}
+
+	ptr, buf := memory.Alloc[byte](dns.MaxMsgSize + 1)
+	defer memory.Free(ptr)
+
+	n, err := Buffer(buf).ReadFrom(r.Body)
+	if err != nil {
+		if errors.Is(err, io.ErrShortBuffer) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("odoh query too long"))
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	// only the encrypted message is relayed, the headers of the client
+	// are never forwarded
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), bytes.NewReader(buf[:n]))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	req.Header.Set("Content-Type", odoh.MediaType)
+	req.Header.Set("Accept", odoh.MediaType)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.lg.Error(fmt.Sprintf("proxy error: relay error: %v", err))
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	defer resp.Body.Close()
+
+	n, err = Buffer(buf).ReadFrom(resp.Body)
+	if err != nil {
+		m.lg.Error(fmt.Sprintf("proxy error: read response error: %v", err))
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+
+	// write response back
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(int(n)))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(resp.StatusCode)
+	_, err = w.Write(buf[:n])
+	return err
+}
+
+var _ caddyhttp.MiddlewareHandler = (*Proxy)(nil)
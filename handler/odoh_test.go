@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/odoh"
+)
+
+func newTestODoH(t *testing.T, storage certmagic.Storage) *ODoH {
+	t.Helper()
+
+	o := &ODoH{storage: storage, lg: zap.NewNop()}
+	if err := o.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Cleanup() })
+	return o
+}
+
+// odohClient is an in-process Oblivious DoH client.
+type odohClient struct {
+	client *http.Client
+	target *url.URL
+	proxy  string
+}
+
+func (c *odohClient) configs(t *testing.T) odoh.Configs {
+	t.Helper()
+
+	resp, err := c.client.Get(c.target.Scheme + "://" + c.target.Host + ODoHConfigsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("configs status = %d", resp.StatusCode)
+	}
+	bb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := odoh.ParseConfigs(bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) == 0 {
+		t.Fatal("no odoh configs")
+	}
+	return configs
+}
+
+// exchange sends a query through the proxy, returning the status code and
+// the decrypted response of successful queries.
+func (c *odohClient) exchange(t *testing.T, config odoh.ConfigContents, query []byte) (int, *dns.Msg) {
+	t.Helper()
+
+	m, qctx, err := config.EncryptQuery(query, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := c.proxy + "?" + url.Values{"targethost": {c.target.Host}, "targetpath": {DefaultPrefix}}.Encode()
+	resp, err := c.client.Post(target, odoh.MediaType, bytes.NewReader(m.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	if got := resp.Header.Get("Content-Type"); got != odoh.MediaType {
+		t.Errorf("Content-Type = %q, want %q", got, odoh.MediaType)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-cache, no-store" {
+		t.Errorf("Cache-Control = %q, want no-cache, no-store", got)
+	}
+
+	bb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = odoh.ParseMessage(bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err = qctx.DecryptResponse(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(bb); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, msg
+}
+
+func TestODoH_Exchange(t *testing.T) {
+	m := newTestHandler()
+	m.ODoH = newTestODoH(t, &certmagic.FileStorage{Path: t.TempDir()})
+	target := httptest.NewTLSServer(serveHTTP(m))
+	defer target.Close()
+
+	u, _ := url.Parse(target.URL)
+	p := &Proxy{Prefix: DefaultProxyPrefix, Targets: []string{u.Host}, client: target.Client(), lg: zap.NewNop()}
+	proxy := httptest.NewTLSServer(serveHTTP(p))
+	defer proxy.Close()
+
+	c := &odohClient{client: proxy.Client(), target: u, proxy: proxy.URL + DefaultProxyPrefix}
+	config := c.configs(t)[0].Contents
+
+	code, msg := c.exchange(t, config, packTestQuery(t, dns.OpcodeQuery))
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer %v", msg.Answer)
+	}
+
+	// a query to an unknown key is rejected
+	other, err := odoh.NewKeyPair(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := c.exchange(t, other.Config.Contents, packTestQuery(t, dns.OpcodeQuery)); code != http.StatusUnauthorized {
+		t.Errorf("unknown key status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// an invalid dns message inside a valid oblivious message
+	if code, _ := c.exchange(t, config, []byte{0x00}); code != http.StatusBadRequest {
+		t.Errorf("invalid query status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestODoH_KeyRotation(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	o1 := newTestODoH(t, storage)
+
+	// instances sharing the storage publish the same key
+	o2 := newTestODoH(t, storage)
+	if !bytes.Equal(o1.Configs(), o2.Configs()) {
+		t.Fatal("instances publish different keys")
+	}
+	old := o1.keys[0]
+	query, _, err := old.Config.Contents.EncryptQuery(packTestQuery(t, dns.OpcodeQuery), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// age the stored key past the rotation period
+	ctx := context.Background()
+	bb, err := storage.Load(ctx, odohStorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []odohKey{}
+	if err := json.Unmarshal(bb, &keys); err != nil {
+		t.Fatal(err)
+	}
+	keys[0].Created = time.Now().Add(-2 * time.Duration(o1.KeyRotation))
+	if bb, err = json.Marshal(keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, odohStorageKey, bb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o1.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(o1.keys[0].KeyID(), old.KeyID()) {
+		t.Fatal("key not rotated")
+	}
+	configs, err := odoh.ParseConfigs(o1.Configs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 || !bytes.Equal(configs[0].Contents.KeyID(), o1.keys[0].KeyID()) {
+		t.Error("configs do not publish the new key only")
+	}
+
+	// the previous key is still accepted
+	if _, _, err := o1.DecryptQuery(query); err != nil {
+		t.Errorf("DecryptQuery() with previous key = %v", err)
+	}
+
+	// other instances pick up the new key without rotating again
+	if err := o2.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(o1.Configs(), o2.Configs()) {
+		t.Error("instances publish different keys after rotation")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// client identifying headers must not be relayed
+		if r.Header.Get("User-Agent") == "client" || r.Header.Get("Cookie") != "" {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		w.Header().Set("Content-Type", odoh.MediaType)
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		query       url.Values
+		body        []byte
+		targets     []string
+		code        int
+	}{
+		{name: "relay", query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, targets: []string{u.Host}, code: 200},
+		{name: "any target", query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, targets: []string{"*"}, code: 200},
+		{name: "not allowed", query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, targets: []string{"example.com"}, code: 403},
+		{name: "no targets", query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, code: 403},
+		{name: "get", method: http.MethodGet, query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, targets: []string{"*"}, code: 405},
+		{name: "content type", contentType: MediaTypeDNSMessage, query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, targets: []string{"*"}, code: 415},
+		{name: "no host", query: url.Values{"targetpath": {"/dns-query"}}, targets: []string{"*"}, code: 400},
+		{name: "no path", query: url.Values{"targethost": {u.Host}}, targets: []string{"*"}, code: 400},
+		{name: "too long", query: url.Values{"targethost": {u.Host}, "targetpath": {"/dns-query"}}, body: make([]byte, dns.MaxMsgSize+1), targets: []string{"*"}, code: 413},
+		{name: "unreachable", query: url.Values{"targethost": {"127.0.0.1:1"}, "targetpath": {"/dns-query"}}, targets: []string{"*"}, code: 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.method == "" {
+				tt.method = http.MethodPost
+			}
+			if tt.contentType == "" {
+				tt.contentType = odoh.MediaType
+			}
+			if tt.body == nil {
+				tt.body = []byte("oblivious")
+			}
+			r := httptest.NewRequest(tt.method, DefaultProxyPrefix+"?"+tt.query.Encode(), bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("User-Agent", "client")
+			r.Header.Set("Cookie", "id=client")
+			w := httptest.NewRecorder()
+
+			p := &Proxy{Prefix: DefaultProxyPrefix, Targets: tt.targets, client: target.Client(), lg: zap.NewNop()}
+			serveHTTP(p)(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusOK && w.Body.String() != "oblivious" {
+				t.Errorf("body = %q, want %q", w.Body.String(), "oblivious")
+			}
+		})
+	}
+}
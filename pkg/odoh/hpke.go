@@ -0,0 +1,151 @@
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE algorithm identifiers, RFC 9180 Section 7. Only the mandatory
+// Oblivious DoH suite is implemented.
+const (
+	KEMX25519HKDFSHA256 uint16 = 0x0020
+	KDFHKDFSHA256       uint16 = 0x0001
+	AEADAES128GCM       uint16 = 0x0001
+)
+
+const (
+	nSecret = 32
+	nEnc    = 32
+	nSk     = 32
+	nH      = 32
+	nK      = 16
+	nN      = 12
+)
+
+var (
+	kemSuiteID  = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+func concat(bb ...[]byte) []byte {
+	out := []byte{}
+	for _, b := range bb {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func expand(prk, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, concat([]byte("HPKE-v1"), suiteID, []byte(label), ikm), salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, n int) []byte {
+	return expand(prk, concat(binary.BigEndian.AppendUint16(nil, uint16(n)), []byte("HPKE-v1"), suiteID, []byte(label), info), n)
+}
+
+// deriveKeyPair is DeriveKeyPair of DHKEM(X25519, HKDF-SHA256).
+func deriveKeyPair(ikm []byte) (*ecdh.PrivateKey, error) {
+	prk := labeledExtract(kemSuiteID, nil, "dkp_prk", ikm)
+	return ecdh.X25519().NewPrivateKey(labeledExpand(kemSuiteID, prk, "sk", nil, nSk))
+}
+
+func extractAndExpand(dh, kemContext []byte) []byte {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, nSecret)
+}
+
+func encap(pkR *ecdh.PublicKey, skE *ecdh.PrivateKey) (sharedSecret, enc []byte, err error) {
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	return extractAndExpand(dh, concat(enc, pkR.Bytes())), enc, nil
+}
+
+func decap(enc []byte, skR *ecdh.PrivateKey) ([]byte, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	return extractAndExpand(dh, concat(enc, skR.PublicKey().Bytes())), nil
+}
+
+// hpkeContext is an HPKE encryption context in base mode.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func newHPKEContext(sharedSecret, info []byte) (*hpkeContext, error) {
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := concat([]byte{0x00}, pskIDHash, infoHash)
+
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	aead, err := newAEAD(labeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, nK))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, nN),
+		exporterSecret: labeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, nH),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *hpkeContext) nonce() []byte {
+	nonce := append([]byte{}, c.baseNonce...)
+	seq := binary.BigEndian.AppendUint64(nil, c.seq)
+	for i := range seq {
+		nonce[nN-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+func (c *hpkeContext) Seal(aad, plaintext []byte) []byte {
+	ciphertext := c.aead.Seal(nil, c.nonce(), plaintext, aad)
+	c.seq++
+	return ciphertext
+}
+
+func (c *hpkeContext) Open(aad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, c.nonce(), ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+	return plaintext, nil
+}
+
+func (c *hpkeContext) Export(exporterContext []byte, n int) []byte {
+	return labeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, n)
+}
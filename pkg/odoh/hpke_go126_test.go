@@ -0,0 +1,55 @@
+//go:build go1.26
+
+package odoh
+
+import (
+	"bytes"
+	"crypto/hpke"
+	"testing"
+)
+
+// TestHPKEInterop checks the key schedule against the standard library.
+func TestHPKEInterop(t *testing.T) {
+	skR, err := deriveKeyPair(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kem := hpke.DHKEM(skR.Curve())
+	pk, err := kem.NewPublicKey(skR.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, sender, err := hpke.NewSender(pk, hpke.HKDFSHA256(), hpke.AES128GCM(), []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedSecret, err := decap(enc, skR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := newHPKEContext(sharedSecret, []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ct, err := sender.Seal([]byte("aad"), []byte("plaintext"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := recipient.Open([]byte("aad"), ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != "plaintext" {
+			t.Errorf("Open() = %q, want %q", pt, "plaintext")
+		}
+	}
+	want, err := sender.Export("odoh response", nK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recipient.Export([]byte("odoh response"), nK); !bytes.Equal(got, want) {
+		t.Errorf("Export() = %x, want %x", got, want)
+	}
+}
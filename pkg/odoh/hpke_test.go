@@ -0,0 +1,102 @@
+package odoh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestKEM uses the DHKEM(X25519, HKDF-SHA256) base mode test vector of
+// RFC 9180 Appendix A.1.1.
+func TestKEM(t *testing.T) {
+	ikmE := mustDecodeHex(t, "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234")
+	ikmR := mustDecodeHex(t, "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037")
+	skRm := mustDecodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	pkRm := mustDecodeHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	enc := mustDecodeHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+
+	skR, err := deriveKeyPair(ikmR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(skR.Bytes(), skRm) || !bytes.Equal(skR.PublicKey().Bytes(), pkRm) {
+		t.Fatalf("DeriveKeyPair() = %x, %x, want %x, %x", skR.Bytes(), skR.PublicKey().Bytes(), skRm, pkRm)
+	}
+	skE, err := deriveKeyPair(ikmE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedSecret, gotEnc, err := encap(skR.PublicKey(), skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotEnc, enc) {
+		t.Errorf("Encap() enc = %x, want %x", gotEnc, enc)
+	}
+	got, err := decap(enc, skR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sharedSecret) {
+		t.Errorf("Decap() = %x, want %x", got, sharedSecret)
+	}
+}
+
+func TestHPKEContext(t *testing.T) {
+	skR, err := deriveKeyPair(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedSecret, enc, err := encap(skR.PublicKey(), skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newHPKEContext(sharedSecret, []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret, err = decap(enc, skR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := newHPKEContext(sharedSecret, []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sequence numbers advance on both sides
+	for i := 0; i < 3; i++ {
+		ct := sender.Seal([]byte("aad"), []byte("plaintext"))
+		if _, err := recipient.Open([]byte("bad"), ct); err == nil {
+			t.Fatal("Open() with wrong aad succeeded")
+		}
+		pt, err := recipient.Open([]byte("aad"), ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != "plaintext" {
+			t.Errorf("Open() = %q, want %q", pt, "plaintext")
+		}
+	}
+	if !bytes.Equal(sender.Export([]byte("ctx"), 16), recipient.Export([]byte("ctx"), 16)) {
+		t.Error("exported secrets differ")
+	}
+}
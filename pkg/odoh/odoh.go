@@ -0,0 +1,352 @@
+// Package odoh implements the message format and encryption of Oblivious
+// DNS over HTTPS, RFC 9230.
+package odoh
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Version is the version of ObliviousDoHConfig defined by RFC 9230.
+const Version uint16 = 0x0001
+
+// Message types of ObliviousDoHMessage.
+const (
+	QueryType    uint8 = 0x01
+	ResponseType uint8 = 0x02
+)
+
+// MediaType is the media type of Oblivious DoH requests and responses.
+const MediaType = "application/oblivious-dns-message"
+
+var (
+	// ErrUnknownKeyID is returned when a query is encrypted to a key
+	// which is not known to the target.
+	ErrUnknownKeyID = errors.New("odoh: unknown key id")
+	// ErrInvalidMessage is returned for malformed messages and messages
+	// which fail to decrypt.
+	ErrInvalidMessage = errors.New("odoh: invalid message")
+)
+
+func appendVector(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func readVector(b []byte) (v, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// ConfigContents is ObliviousDoHConfigContents.
+type ConfigContents struct {
+	KEMID     uint16
+	KDFID     uint16
+	AEADID    uint16
+	PublicKey []byte
+}
+
+// Marshal is ...
+func (c *ConfigContents) Marshal() []byte {
+	b := binary.BigEndian.AppendUint16(nil, c.KEMID)
+	b = binary.BigEndian.AppendUint16(b, c.KDFID)
+	b = binary.BigEndian.AppendUint16(b, c.AEADID)
+	return appendVector(b, c.PublicKey)
+}
+
+// KeyID is the identifier of the key, RFC 9230 Section 6.2.
+func (c *ConfigContents) KeyID() []byte {
+	return expand(hkdf.Extract(sha256.New, c.Marshal(), nil), []byte("odoh key id"), nH)
+}
+
+func (c *ConfigContents) supported() bool {
+	return c.KEMID == KEMX25519HKDFSHA256 && c.KDFID == KDFHKDFSHA256 && c.AEADID == AEADAES128GCM
+}
+
+// Config is ObliviousDoHConfig.
+type Config struct {
+	Version  uint16
+	Contents ConfigContents
+}
+
+// Configs is ObliviousDoHConfigs, served by targets at
+// /.well-known/odohconfigs.
+type Configs []Config
+
+// Marshal is ...
+func (c Configs) Marshal() []byte {
+	b := []byte{}
+	for _, v := range c {
+		b = binary.BigEndian.AppendUint16(b, v.Version)
+		b = appendVector(b, v.Contents.Marshal())
+	}
+	return appendVector(nil, b)
+}
+
+// ParseConfigs parses ObliviousDoHConfigs, skipping configs of unknown
+// versions or with unsupported algorithms.
+func ParseConfigs(b []byte) (Configs, error) {
+	b, rest, ok := readVector(b)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("odoh: invalid configs")
+	}
+	configs := Configs{}
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("odoh: invalid config")
+		}
+		version := binary.BigEndian.Uint16(b)
+		contents, rest, ok := readVector(b[2:])
+		if !ok {
+			return nil, errors.New("odoh: invalid config")
+		}
+		b = rest
+		if version != Version {
+			continue
+		}
+		if len(contents) < 6 {
+			return nil, errors.New("odoh: invalid config contents")
+		}
+		c := ConfigContents{
+			KEMID:  binary.BigEndian.Uint16(contents[0:]),
+			KDFID:  binary.BigEndian.Uint16(contents[2:]),
+			AEADID: binary.BigEndian.Uint16(contents[4:]),
+		}
+		pk, rest, ok := readVector(contents[6:])
+		if !ok || len(rest) != 0 {
+			return nil, errors.New("odoh: invalid config contents")
+		}
+		c.PublicKey = pk
+		if !c.supported() {
+			continue
+		}
+		configs = append(configs, Config{Version: version, Contents: c})
+	}
+	return configs, nil
+}
+
+// Message is ObliviousDoHMessage. For responses KeyID carries the
+// response nonce.
+type Message struct {
+	Type             uint8
+	KeyID            []byte
+	EncryptedMessage []byte
+}
+
+// Marshal is ...
+func (m *Message) Marshal() []byte {
+	b := appendVector([]byte{m.Type}, m.KeyID)
+	return appendVector(b, m.EncryptedMessage)
+}
+
+// ParseMessage is ...
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < 1 {
+		return nil, ErrInvalidMessage
+	}
+	m := &Message{Type: b[0]}
+	keyID, rest, ok := readVector(b[1:])
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+	encrypted, rest, ok := readVector(rest)
+	if !ok || len(rest) != 0 || len(encrypted) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	m.KeyID, m.EncryptedMessage = keyID, encrypted
+	return m, nil
+}
+
+func (m *Message) aad() []byte {
+	return appendVector([]byte{m.Type}, m.KeyID)
+}
+
+// encodePlaintext is ObliviousDoHMessagePlaintext with zero padding.
+func encodePlaintext(msg []byte, padding int) []byte {
+	return appendVector(appendVector(nil, msg), make([]byte, padding))
+}
+
+func decodePlaintext(b []byte) ([]byte, error) {
+	msg, rest, ok := readVector(b)
+	if !ok || len(msg) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	padding, rest, ok := readVector(rest)
+	if !ok || len(rest) != 0 {
+		return nil, ErrInvalidMessage
+	}
+	for _, v := range padding {
+		if v != 0 {
+			return nil, ErrInvalidMessage
+		}
+	}
+	return msg, nil
+}
+
+// KeyPair is the HPKE key pair of a target.
+type KeyPair struct {
+	// Config is ...
+	Config Config
+
+	privateKey *ecdh.PrivateKey
+	keyID      []byte
+}
+
+// NewKeyPair derives a key pair from a secret seed of at least 32 bytes.
+func NewKeyPair(seed []byte) (*KeyPair, error) {
+	if len(seed) < nSk {
+		return nil, errors.New("odoh: seed too short")
+	}
+	sk, err := deriveKeyPair(seed)
+	if err != nil {
+		return nil, err
+	}
+	k := &KeyPair{
+		Config: Config{
+			Version: Version,
+			Contents: ConfigContents{
+				KEMID:     KEMX25519HKDFSHA256,
+				KDFID:     KDFHKDFSHA256,
+				AEADID:    AEADAES128GCM,
+				PublicKey: sk.PublicKey().Bytes(),
+			},
+		},
+		privateKey: sk,
+	}
+	k.keyID = k.Config.Contents.KeyID()
+	return k, nil
+}
+
+// KeyID is ...
+func (k *KeyPair) KeyID() []byte {
+	return k.keyID
+}
+
+// DecryptQuery decrypts a query message encrypted to this key pair.
+func (k *KeyPair) DecryptQuery(m *Message) ([]byte, *ResponseContext, error) {
+	if m.Type != QueryType {
+		return nil, nil, ErrInvalidMessage
+	}
+	if subtle.ConstantTimeCompare(m.KeyID, k.keyID) != 1 {
+		return nil, nil, ErrUnknownKeyID
+	}
+	if len(m.EncryptedMessage) < nEnc {
+		return nil, nil, ErrInvalidMessage
+	}
+	enc, ct := m.EncryptedMessage[:nEnc], m.EncryptedMessage[nEnc:]
+
+	sharedSecret, err := decap(enc, k.privateKey)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	ctx, err := newHPKEContext(sharedSecret, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := ctx.Open(m.aad(), ct)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	query, err := decodePlaintext(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, &ResponseContext{query: plaintext, secret: ctx.Export([]byte("odoh response"), nK)}, nil
+}
+
+// EncryptQuery encrypts a query to the key of a target, adding padding
+// zero bytes to the plaintext.
+func (c *ConfigContents) EncryptQuery(query []byte, padding int) (*Message, *QueryContext, error) {
+	if !c.supported() {
+		return nil, nil, errors.New("odoh: unsupported config")
+	}
+	pkR, err := ecdh.X25519().NewPublicKey(c.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, enc, err := encap(pkR, skE)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := newHPKEContext(sharedSecret, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext := encodePlaintext(query, padding)
+	m := &Message{Type: QueryType, KeyID: c.KeyID()}
+	m.EncryptedMessage = concat(enc, ctx.Seal(m.aad(), plaintext))
+	return m, &QueryContext{ResponseContext{query: plaintext, secret: ctx.Export([]byte("odoh response"), nK)}}, nil
+}
+
+// ResponseContext is the state kept by a target to encrypt the response
+// to a query.
+type ResponseContext struct {
+	query  []byte
+	secret []byte
+}
+
+// aead derives the response key and nonce, RFC 9230 Section 6.4.
+func (c *ResponseContext) aead(responseNonce []byte) (cipher.AEAD, []byte, error) {
+	salt := appendVector(append([]byte{}, c.query...), responseNonce)
+	prk := hkdf.Extract(sha256.New, c.secret, salt)
+	aead, err := newAEAD(expand(prk, []byte("odoh key"), nK))
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, expand(prk, []byte("odoh nonce"), nN), nil
+}
+
+// EncryptResponse encrypts the response to the query of this context.
+func (c *ResponseContext) EncryptResponse(response []byte, padding int) (*Message, error) {
+	nonce := make([]byte, max(nN, nK))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, aeadNonce, err := c.aead(nonce)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Type: ResponseType, KeyID: nonce}
+	m.EncryptedMessage = aead.Seal(nil, aeadNonce, encodePlaintext(response, padding), m.aad())
+	return m, nil
+}
+
+// QueryContext is the state kept by a client to decrypt the response to
+// its query.
+type QueryContext struct {
+	ResponseContext
+}
+
+// DecryptResponse is ...
+func (c *QueryContext) DecryptResponse(m *Message) ([]byte, error) {
+	if m.Type != ResponseType {
+		return nil, ErrInvalidMessage
+	}
+	aead, aeadNonce, err := c.aead(m.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, m.EncryptedMessage, m.aad())
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return decodePlaintext(plaintext)
+}
@@ -0,0 +1,113 @@
+package odoh_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/imgk/caddy-dnsproxy/pkg/odoh"
+)
+
+func newKeyPair(t *testing.T, b byte) *odoh.KeyPair {
+	t.Helper()
+
+	k, err := odoh.NewKeyPair(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestConfigs(t *testing.T) {
+	k1, k2 := newKeyPair(t, 1), newKeyPair(t, 2)
+	bb := odoh.Configs{k1.Config, k2.Config}.Marshal()
+
+	// configs of unknown versions are skipped
+	unknown := []byte{0x00, 0x02, 0x00, 0x01, 0xff}
+	n := int(bb[0])<<8 | int(bb[1]) + len(unknown)
+	bb = append(append([]byte{byte(n >> 8), byte(n)}, bb[2:]...), unknown...)
+
+	configs, err := odoh.ParseConfigs(bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("configs = %d, want 2", len(configs))
+	}
+	if !bytes.Equal(configs[0].Contents.KeyID(), k1.KeyID()) || !bytes.Equal(configs[1].Contents.KeyID(), k2.KeyID()) {
+		t.Error("key ids differ after parsing")
+	}
+
+	if _, err := odoh.ParseConfigs(bb[:len(bb)-1]); err == nil {
+		t.Error("truncated configs parsed")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	k := newKeyPair(t, 1)
+
+	for _, padding := range []int{0, 17} {
+		m, qctx, err := k.Config.Contents.EncryptQuery([]byte("query"), padding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err = odoh.ParseMessage(m.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		query, rctx, err := k.DecryptQuery(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(query) != "query" {
+			t.Errorf("query = %q, want %q", query, "query")
+		}
+
+		r, err := rctx.EncryptResponse([]byte("response"), padding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = odoh.ParseMessage(r.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := qctx.DecryptResponse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response) != "response" {
+			t.Errorf("response = %q, want %q", response, "response")
+		}
+	}
+}
+
+func TestDecryptQuery_Errors(t *testing.T) {
+	k := newKeyPair(t, 1)
+
+	m, _, err := newKeyPair(t, 2).Config.Contents.EncryptQuery([]byte("query"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := k.DecryptQuery(m); !errors.Is(err, odoh.ErrUnknownKeyID) {
+		t.Errorf("DecryptQuery() with other key = %v, want %v", err, odoh.ErrUnknownKeyID)
+	}
+
+	m, qctx, err := k.Config.Contents.EncryptQuery([]byte("query"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.EncryptedMessage[len(m.EncryptedMessage)-1] ^= 1
+	if _, _, err := k.DecryptQuery(m); !errors.Is(err, odoh.ErrInvalidMessage) {
+		t.Errorf("DecryptQuery() of tampered message = %v, want %v", err, odoh.ErrInvalidMessage)
+	}
+
+	// a response must not be accepted as a query and vice versa
+	m.Type = odoh.ResponseType
+	if _, _, err := k.DecryptQuery(m); !errors.Is(err, odoh.ErrInvalidMessage) {
+		t.Errorf("DecryptQuery() of response = %v, want %v", err, odoh.ErrInvalidMessage)
+	}
+	if _, err := qctx.DecryptResponse(m); !errors.Is(err, odoh.ErrInvalidMessage) {
+		t.Errorf("DecryptResponse() of query = %v, want %v", err, odoh.ErrInvalidMessage)
+	}
+}
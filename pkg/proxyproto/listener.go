@@ -0,0 +1,125 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default of Listener.Timeout.
+const DefaultTimeout = 5 * time.Second
+
+// Listener reads the header of connections from trusted proxies.
+type Listener struct {
+	net.Listener
+	// Trusted reports whether a connection comes from a proxy, which must
+	// send a header. Connections from other addresses are used as is.
+	Trusted func(net.Addr) bool
+	// Timeout is how long to wait for the header.
+	Timeout time.Duration
+}
+
+// Accept is ...
+func (ln *Listener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if ln.Trusted == nil || !ln.Trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := ln.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Conn is a connection from a proxy. The header is read on the first call
+// to Read, RemoteAddr or LocalAddr, so Accept is not blocked by slow
+// proxies.
+type Conn struct {
+	net.Conn
+
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once     sync.Once
+	header   *Header
+	err      error
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Read(c.r)
+
+		// restore the deadline of the caller
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+// Header returns the header sent by the proxy.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+// Read is ...
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client, or the address of the
+// proxy when the header has no address.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.err != nil || c.header.Local {
+		return c.Conn.RemoteAddr()
+	}
+	return c.header.Source
+}
+
+// LocalAddr returns the address the client connected to.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.err != nil || c.header.Local {
+		return c.Conn.LocalAddr()
+	}
+	return c.header.Destination
+}
+
+// SetDeadline is ...
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline is ...
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// NetConn returns the connection from the proxy.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var (
+	_ net.Listener = (*Listener)(nil)
+	_ net.Conn     = (*Conn)(nil)
+)
@@ -0,0 +1,263 @@
+// Package proxyproto implements version 1 and 2 of the HAProxy PROXY
+// protocol, which lets a proxy or load balancer pass the address of the
+// client to the server behind it.
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoHeader is returned when the data does not start with a PROXY
+	// protocol header.
+	ErrNoHeader = errors.New("proxyproto: no header")
+	// ErrInvalidHeader is returned for malformed headers.
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+)
+
+// signature is the first 12 bytes of a version 2 header.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the length of the longest version 1 header.
+const maxV1Length = 107
+
+// version 2 commands, address families and transport protocols
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+
+	protoStream = 0x1
+	protoDgram  = 0x2
+)
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+	// Local is set when the connection is made by the proxy on its own,
+	// such as for health checks, or the proxy does not know the client.
+	// Source and Destination are nil then.
+	Local bool
+	// Source is the address of the client, a *net.TCPAddr or a
+	// *net.UDPAddr.
+	Source net.Addr
+	// Destination is the address the client connected to.
+	Destination net.Addr
+}
+
+// Read reads a version 1 or 2 header from r.
+func Read(r *bufio.Reader) (*Header, error) {
+	// both versions are longer than the signature
+	b, err := r.Peek(len(signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	if bytes.Equal(b, signature) {
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1Length)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == maxV1Length {
+			return nil, fmt.Errorf("%w: line too long", ErrInvalidHeader)
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: line does not end with CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Local: true}, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %d fields", ErrInvalidHeader, len(fields))
+	}
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" {
+		return nil, fmt.Errorf("%w: address %q", ErrInvalidHeader, ip)
+	}
+	switch {
+	case proto == "TCP4" && addr.Is4():
+	case proto == "TCP6" && addr.Is6():
+	default:
+		return nil, fmt.Errorf("%w: address %q of %s", ErrInvalidHeader, ip, proto)
+	}
+	// ports have no leading zeros
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	b = append(b, make([]byte, binary.BigEndian.Uint16(b[14:]))...)
+	if _, err := io.ReadFull(r, b[16:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	h, _, err := ParseV2(b)
+	return h, err
+}
+
+// ParseV2 parses the version 2 header at the start of b, such as a datagram
+// sent by a proxy, and returns the length of the header.
+func ParseV2(b []byte) (*Header, int, error) {
+	if !bytes.HasPrefix(b, signature) {
+		return nil, 0, ErrNoHeader
+	}
+	if len(b) < 16 {
+		return nil, 0, fmt.Errorf("%w: short header", ErrInvalidHeader)
+	}
+	n := 16 + int(binary.BigEndian.Uint16(b[14:]))
+	if len(b) < n {
+		return nil, 0, fmt.Errorf("%w: short header", ErrInvalidHeader)
+	}
+	if b[12]>>4 != 0x2 {
+		return nil, 0, fmt.Errorf("%w: version %d", ErrInvalidHeader, b[12]>>4)
+	}
+
+	switch b[12] & 0xf {
+	case cmdLocal:
+		return &Header{Version: 2, Local: true}, n, nil
+	case cmdProxy:
+	default:
+		return nil, 0, fmt.Errorf("%w: command %d", ErrInvalidHeader, b[12]&0xf)
+	}
+
+	addrs := b[16:n]
+	h := &Header{Version: 2}
+	var src, dst netip.AddrPort
+	switch b[13] >> 4 {
+	case famInet:
+		if len(addrs) < 12 {
+			return nil, 0, fmt.Errorf("%w: short address", ErrInvalidHeader)
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[0:4])), binary.BigEndian.Uint16(addrs[8:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[4:8])), binary.BigEndian.Uint16(addrs[10:]))
+	case famInet6:
+		if len(addrs) < 36 {
+			return nil, 0, fmt.Errorf("%w: short address", ErrInvalidHeader)
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[0:16])), binary.BigEndian.Uint16(addrs[32:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[16:32])), binary.BigEndian.Uint16(addrs[34:]))
+	default:
+		// unix sockets and unspecified addresses carry no client address
+		h.Local = true
+		return h, n, nil
+	}
+
+	switch b[13] & 0xf {
+	case protoStream:
+		h.Source, h.Destination = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	case protoDgram:
+		h.Source, h.Destination = net.UDPAddrFromAddrPort(src), net.UDPAddrFromAddrPort(dst)
+	default:
+		h.Local = true
+	}
+	return h, n, nil
+}
+
+// AppendV1 appends the header in version 1 format to b. Only TCP addresses
+// can be sent in version 1.
+func (h *Header) AppendV1(b []byte) []byte {
+	src, ok1 := h.Source.(*net.TCPAddr)
+	dst, ok2 := h.Destination.(*net.TCPAddr)
+	if h.Local || !ok1 || !ok2 {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	sap, dap := src.AddrPort(), dst.AddrPort()
+	proto := "TCP6"
+	if sap.Addr().Unmap().Is4() && dap.Addr().Unmap().Is4() {
+		proto = "TCP4"
+		sap = netip.AddrPortFrom(sap.Addr().Unmap(), sap.Port())
+		dap = netip.AddrPortFrom(dap.Addr().Unmap(), dap.Port())
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, sap.Addr(), dap.Addr(), sap.Port(), dap.Port())
+}
+
+// AppendV2 appends the header in version 2 format to b.
+func (h *Header) AppendV2(b []byte) []byte {
+	b = append(b, signature...)
+	sap, dap, proto, ok := h.addrPorts()
+	if h.Local || !ok {
+		return append(b, 0x2<<4|cmdLocal, famUnspec, 0, 0)
+	}
+	if sap.Addr().Unmap().Is4() && dap.Addr().Unmap().Is4() {
+		b = append(b, 0x2<<4|cmdProxy, famInet<<4|proto, 0, 12)
+		s, d := sap.Addr().Unmap().As4(), dap.Addr().Unmap().As4()
+		b = append(append(b, s[:]...), d[:]...)
+	} else {
+		b = append(b, 0x2<<4|cmdProxy, famInet6<<4|proto, 0, 36)
+		s, d := sap.Addr().As16(), dap.Addr().As16()
+		b = append(append(b, s[:]...), d[:]...)
+	}
+	b = binary.BigEndian.AppendUint16(b, sap.Port())
+	return binary.BigEndian.AppendUint16(b, dap.Port())
+}
+
+func (h *Header) addrPorts() (src, dst netip.AddrPort, proto byte, ok bool) {
+	switch s := h.Source.(type) {
+	case *net.TCPAddr:
+		d, ok := h.Destination.(*net.TCPAddr)
+		if !ok {
+			return src, dst, 0, false
+		}
+		return s.AddrPort(), d.AddrPort(), protoStream, true
+	case *net.UDPAddr:
+		d, ok := h.Destination.(*net.UDPAddr)
+		if !ok {
+			return src, dst, 0, false
+		}
+		return s.AddrPort(), d.AddrPort(), protoDgram, true
+	}
+	return src, dst, 0, false
+}
@@ -0,0 +1,187 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRead(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		src   string
+		local bool
+		err   error
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 853\r\n", "192.0.2.1:56324", false, nil},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 853\r\n", "[2001:db8::1]:56324", false, nil},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", true, nil},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ::1 ::1 1 2\r\n", "", true, nil},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n", "", false, ErrInvalidHeader},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 853\r\n", "", false, ErrInvalidHeader},
+		{"v1 leading zero", "PROXY TCP4 192.0.2.1 198.51.100.1 0853 853\r\n", "", false, ErrInvalidHeader},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\n", "", false, ErrInvalidHeader},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", false, ErrInvalidHeader},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", "", false, io.EOF},
+		{"no header", "\x00\x1d\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00", "", false, ErrNoHeader},
+		{"v2 local", string(signature) + "\x20\x00\x00\x00", "", true, nil},
+		{"v2 unspec", string(signature) + "\x21\x00\x00\x00", "", true, nil},
+		{"v2 bad version", string(signature) + "\x11\x11\x00\x0c" + strings.Repeat("\x00", 12), "", false, ErrInvalidHeader},
+		{"v2 bad command", string(signature) + "\x22\x11\x00\x0c" + strings.Repeat("\x00", 12), "", false, ErrInvalidHeader},
+		{"v2 short address", string(signature) + "\x21\x11\x00\x04" + strings.Repeat("\x00", 4), "", false, ErrInvalidHeader},
+		{"v2 truncated", string(signature) + "\x21\x11\x00\x0c\x00", "", false, io.ErrUnexpectedEOF},
+		{
+			"v2 tcp4 with tlv",
+			string(signature) + "\x21\x11\x00\x10" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04\x03\x55" + "\x04\x00\x01\x00",
+			"192.0.2.1:56324", false, nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := Read(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Local != tt.local {
+				t.Errorf("local = %v, want %v", h.Local, tt.local)
+			}
+			if !tt.local && h.Source.String() != tt.src {
+				t.Errorf("source = %v, want %v", h.Source, tt.src)
+			}
+		})
+	}
+}
+
+func TestHeader_Append(t *testing.T) {
+	for _, h := range []*Header{
+		{Source: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, Destination: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 853}},
+		{Source: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 853}},
+		{Source: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, Destination: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}},
+		{Local: true},
+	} {
+		for _, v := range []struct {
+			version int
+			b       []byte
+		}{
+			{1, h.AppendV1(nil)},
+			{2, h.AppendV2(nil)},
+		} {
+			if _, ok := h.Source.(*net.UDPAddr); ok && v.version == 1 {
+				continue
+			}
+			got, err := Read(bufio.NewReader(bytes.NewReader(v.b)))
+			if err != nil {
+				t.Fatalf("v%d %q: %v", v.version, v.b, err)
+			}
+			if got.Version != v.version || got.Local != h.Local {
+				t.Errorf("v%d: got %+v, want %+v", v.version, got, h)
+			}
+			if !h.Local && (got.Source.String() != h.Source.String() || got.Destination.String() != h.Destination.String()) {
+				t.Errorf("v%d: got %v -> %v, want %v -> %v", v.version, got.Source, got.Destination, h.Source, h.Destination)
+			}
+		}
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	h := &Header{Source: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, Destination: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}}
+	b := append(h.AppendV2(nil), "payload"...)
+
+	got, n, err := ParseV2(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[n:]) != "payload" {
+		t.Errorf("payload = %q", b[n:])
+	}
+	if addr, ok := got.Source.(*net.UDPAddr); !ok || addr.String() != "192.0.2.1:5353" {
+		t.Errorf("source = %v", got.Source)
+	}
+	if _, _, err := ParseV2([]byte("payload")); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("error = %v, want ErrNoHeader", err)
+	}
+	if _, _, err := ParseV2(b[:20]); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("error = %v, want ErrInvalidHeader", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	trusted := true
+	pln := &Listener{Listener: ln, Trusted: func(net.Addr) bool { return trusted }, Timeout: 100 * time.Millisecond}
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 853}
+	header := (&Header{Source: src, Destination: dst}).AppendV2(nil)
+
+	for _, tt := range []struct {
+		name    string
+		trusted bool
+		input   []byte
+		remote  string
+		err     bool
+	}{
+		{"proxied", true, append(header, "query"...), src.String(), false},
+		{"not trusted", false, []byte("query"), "", false},
+		{"missing header", true, []byte("query\r\n\r\n\r\n"), "", true},
+		{"timeout", true, nil, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted = tt.trusted
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write(tt.input); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := pln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			b := make([]byte, 5)
+			_, err = io.ReadFull(conn, b)
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if conn.RemoteAddr().String() != client.LocalAddr().String() {
+					t.Errorf("remote = %v, want the proxy address", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "query" {
+				t.Errorf("read %q, want %q", b, "query")
+			}
+			want := tt.remote
+			if want == "" {
+				want = client.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != want {
+				t.Errorf("remote = %v, want %v", conn.RemoteAddr(), want)
+			}
+		})
+	}
+}